@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/functions/signin/auth"
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/migrate"
+	"github.com/portals-me/account/lib/password"
+	sessionlib "github.com/portals-me/account/lib/session"
+	"github.com/portals-me/account/lib/sink"
+	"github.com/portals-me/account/lib/throttle"
+	"github.com/portals-me/account/lib/user"
+)
+
+// The method recorded in the audit log for the actions by this tool
+const auditMethod = "accountctl"
+
+// sort key prefix of the auth record for each provider
+var providerPrefixes = map[string]string{
+	"password": "name-pass##",
+	"twitter":  "twitter##",
+	"google":   "google##",
+	"saml":     "saml##",
+	"github":   "github##",
+}
+
+func getUser(table dynamo.Table, userID string) (user.UserInfo, error) {
+	var userInfo user.UserInfo
+	if err := user.NewRepository(table).Get(userID, &userInfo); err != nil {
+		if err == dynamo.ErrNotFound {
+			return user.UserInfo{}, errors.New("User not found: " + userID)
+		}
+
+		return user.UserInfo{}, err
+	}
+
+	return userInfo, nil
+}
+
+func requireID(userID string) error {
+	if userID == "" {
+		return errors.New("-id is required")
+	}
+
+	return nil
+}
+
+func recordAction(table dynamo.Table, userID string, event string, detail map[string]string) {
+	if err := audit.NewRepository(table).Append(userID, event, auditMethod, audit.Source{}, detail); err != nil {
+		fmt.Fprintf(os.Stderr, "Audit: %+v\n", err.Error())
+	}
+}
+
+// readKey reads the private key for JWT from the file, or jwtPrivate env
+func readKey(keyFile string) (string, error) {
+	if keyFile == "" {
+		if key := os.Getenv("jwtPrivate"); key != "" {
+			return key, nil
+		}
+
+		return "", errors.New("-key-file or jwtPrivate is required")
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+func runCreate(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	name := flags.String("name", "", "name of the user")
+	displayName := flags.String("display-name", "", "display name of the user")
+	picture := flags.String("picture", "", "URL for the avatar image")
+	email := flags.String("email", "", "email address of the user")
+	pw := flags.String("password", "", "password, the user signs in with the name and this password")
+	role := flags.String("role", authz.RoleUser, "role of the user")
+	flags.Parse(args)
+
+	if !authz.IsRole(*role) {
+		return errors.New("Unknown role: " + *role)
+	}
+
+	userInfo := user.UserInfo{
+		ID:          uuid.NewV4().String(),
+		Name:        *name,
+		Picture:     *picture,
+		DisplayName: *displayName,
+		Email:       *email,
+		Role:        *role,
+	}
+	if err := user.Validate(table, userInfo); err != nil {
+		return err
+	}
+
+	if *pw != "" {
+		if err := (auth.Password{UserName: *name, Password: *pw}).CreateUser(table, userInfo); err != nil {
+			return err
+		}
+	} else {
+		if err := table.Put(userInfo.ToDDB()).If("attribute_not_exists(id)").Run(); err != nil {
+			return err
+		}
+	}
+
+	recordAction(table, userInfo.ID, audit.Signup, nil)
+
+	return printJSON(userInfo)
+}
+
+func runGet(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	name := flags.String("name", "", "name of the user")
+	provider := flags.String("provider", "", "password, twitter, google, saml or github")
+	subject := flags.String("subject", "", "user_name, Twitter user ID, Google sub or <entity ID>##<NameID> of SAML for -provider")
+	flags.Parse(args)
+
+	if *name != "" {
+		var users []user.UserInfo
+		if err := table.
+			Get("name", *name).
+			Index("name").
+			All(&users); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			return errors.New("User not found: " + *name)
+		}
+
+		*userID = users[0].ID
+	} else if *provider != "" {
+		prefix, ok := providerPrefixes[*provider]
+		if !ok {
+			return errors.New("Unknown provider: " + *provider)
+		}
+
+		var record auth.Record
+		if err := table.
+			Get("sort", prefix+*subject).
+			Index("auth").
+			One(&record); err != nil {
+			if err == dynamo.ErrNotFound {
+				return errors.New("User not found: " + prefix + *subject)
+			}
+
+			return err
+		}
+
+		*userID = record.ID
+	}
+
+	if err := requireID(*userID); err != nil {
+		return errors.New("-id, -name or -provider is required")
+	}
+
+	userInfo, err := getUser(table, *userID)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(userInfo)
+}
+
+func runRecords(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("records", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	activities := flags.Bool("activities", false, "include the audit log")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	var records []map[string]interface{}
+	if err := table.
+		Get("id", *userID).
+		All(&records); err != nil {
+		return err
+	}
+
+	output := []map[string]interface{}{}
+	for _, record := range records {
+		if sort, _ := record["sort"].(string); !*activities && strings.HasPrefix(sort, "activity##") {
+			continue
+		}
+
+		// Never show the password hash
+		if _, ok := record["check_data"]; ok {
+			record["check_data"] = "(redacted)"
+		}
+		output = append(output, record)
+	}
+
+	return printJSON(output)
+}
+
+func runRename(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("rename", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	name := flags.String("name", "", "new name of the user")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	userInfo, err := getUser(table, *userID)
+	if err != nil {
+		return err
+	}
+
+	if err := user.NewRepository(table).Rename(userInfo, *name); err != nil {
+		return err
+	}
+
+	// Password users sign in with the name
+	if err := password.NewRepository(table).Rename(userInfo.ID, *name); err != nil && err != dynamo.ErrNotFound {
+		return err
+	}
+
+	recordAction(table, userInfo.ID, audit.NameChanged, map[string]string{
+		"old_name": userInfo.Name,
+		"new_name": *name,
+	})
+
+	return nil
+}
+
+func runSetRole(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("set-role", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	role := flags.String("role", "", "user, moderator or admin")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+	if !authz.IsRole(*role) {
+		return errors.New("Unknown role: " + *role)
+	}
+
+	if err := user.NewRepository(table).SetRole(*userID, *role); err != nil {
+		return err
+	}
+
+	// The role is a claim of JWT, existing tokens must be reissued
+	if err := sessionlib.NewRepository(table).RevokeAll(*userID); err != nil {
+		return err
+	}
+
+	recordAction(table, *userID, audit.ProfileUpdated, map[string]string{
+		"fields": "role",
+	})
+
+	return nil
+}
+
+func runSuspend(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("suspend", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	reason := flags.String("reason", "", "reason for the suspension")
+	until := flags.String("until", "", "RFC3339 time when the suspension ends, indefinite if omitted")
+	pendingDeletion := flags.Bool("pending-deletion", false, "mark the user as pending deletion instead")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	status := user.StatusSuspended
+	if *pendingDeletion {
+		status = user.StatusPendingDeletion
+	}
+
+	untilUnix := int64(0)
+	detail := map[string]string{
+		"reason": *reason,
+		"status": status,
+	}
+	if *until != "" {
+		parsed, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return err
+		}
+
+		untilUnix = parsed.Unix()
+		detail["until"] = parsed.UTC().Format(time.RFC3339)
+	}
+
+	if err := user.NewRepository(table).SetStatus(*userID, status, *reason, untilUnix); err != nil {
+		return err
+	}
+
+	if err := sessionlib.NewRepository(table).RevokeAll(*userID); err != nil {
+		return err
+	}
+
+	recordAction(table, *userID, audit.Suspended, detail)
+
+	return nil
+}
+
+func runUnsuspend(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("unsuspend", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	if err := user.NewRepository(table).SetStatus(*userID, user.StatusActive, "", 0); err != nil {
+		return err
+	}
+
+	recordAction(table, *userID, audit.Unsuspended, map[string]string{})
+
+	return nil
+}
+
+func runLockout(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("lockout", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	userInfo, err := getUser(table, *userID)
+	if err != nil {
+		return err
+	}
+
+	lockout, err := throttle.NewRepository(table).Lockout(userInfo.Name)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(lockout)
+}
+
+func runUnlock(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("unlock", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	userInfo, err := getUser(table, *userID)
+	if err != nil {
+		return err
+	}
+
+	if err := throttle.NewRepository(table).Unlock(userInfo.Name); err != nil {
+		return err
+	}
+
+	recordAction(table, userInfo.ID, audit.Unlocked, map[string]string{})
+
+	return nil
+}
+
+func runDelete(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	yes := flags.Bool("yes", false, "confirm the deletion")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+	if !*yes {
+		return errors.New("-yes is required to delete the user")
+	}
+
+	if _, err := getUser(table, *userID); err != nil {
+		return err
+	}
+
+	return user.NewRepository(table).Delete(*userID)
+}
+
+func runJwt(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("jwt", flag.ExitOnError)
+	userID := flags.String("id", "", "ID of the user")
+	keyFile := flags.String("key-file", "", "PEM file of the private key, jwtPrivate env is used if omitted")
+	flags.Parse(args)
+
+	if err := requireID(*userID); err != nil {
+		return err
+	}
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	userInfo, err := getUser(table, *userID)
+	if err != nil {
+		return err
+	}
+
+	// The token is bound to a session so that it can be revoked from /self/sessions
+	newSession, err := sessionlib.NewRepository(table).Create(userInfo.ID, auditMethod, auditMethod, auditMethod, "")
+	if err != nil {
+		return err
+	}
+
+	token, err := auth.CreateJwt(key, userInfo, jwt.Claims{
+		SessionID: newSession.SessionID,
+	})
+	if err != nil {
+		return err
+	}
+
+	recordAction(table, userInfo.ID, audit.SigninSucceeded, map[string]string{
+		"session_id": newSession.SessionID,
+	})
+
+	fmt.Println(token)
+	return nil
+}
+
+func runVerify(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := flags.String("key-file", "", "PEM file of the private key, jwtPrivate env is used if omitted")
+	noVerify := flags.Bool("no-verify", false, "decode the token without verification")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("token is required")
+	}
+	token := []byte(flags.Arg(0))
+
+	var payload jwt.JwtPayload
+	var err error
+	if *noVerify {
+		payload, err = jwt.Decode(token)
+	} else {
+		key, keyErr := readKey(*keyFile)
+		if keyErr != nil {
+			return keyErr
+		}
+
+		payload, err = jwt.ES256Signer{Key: key}.VerifyPayload(token)
+	}
+	if err != nil {
+		return err
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(payload.Data, &data); err != nil {
+		return err
+	}
+
+	return printJSON(map[string]interface{}{
+		"iss":   payload.Issuer,
+		"iat":   payload.IssuedAt,
+		"exp":   payload.ExpirationTime,
+		"sid":   payload.SessionID,
+		"role":  payload.Role,
+		"scope": payload.Scope,
+		"data":  data,
+	})
+}
+
+func runMigrate(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "count the items to be changed without writing")
+	pageSize := flags.Int64("page-size", 100, "number of items scanned between checkpoints")
+	flags.Parse(args)
+
+	runner := migrate.NewRunner(table, os.Stdout)
+	runner.DryRun = *dryRun
+	runner.PageSize = *pageSize
+
+	return runner.Run(migrate.All)
+}
+
+func runMigrations(table dynamo.Table, args []string) error {
+	runner := migrate.NewRunner(table, os.Stdout)
+
+	states := []migrate.State{}
+	for _, migration := range migrate.All {
+		state, err := runner.State(migration)
+		if err != nil {
+			return err
+		}
+
+		states = append(states, state)
+	}
+
+	return printJSON(states)
+}
+
+func runReplay(table dynamo.Table, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	sinksFile := flags.String("sinks", "", "JSON file of the sink config, eventSinks is used if empty")
+	topicArn := flags.String("topic", os.Getenv("accountTableSubscriptionTopicArn"), "topic ARN for the default sink config")
+	dryRun := flags.Bool("dry-run", false, "list the dead letters without replaying")
+	flags.Parse(args)
+
+	raw := os.Getenv("eventSinks")
+	if *sinksFile != "" {
+		content, err := os.ReadFile(*sinksFile)
+		if err != nil {
+			return err
+		}
+
+		raw = string(content)
+	}
+
+	config, err := sink.LoadRouterConfig(raw, *topicArn, table.Name())
+	if err != nil {
+		return err
+	}
+
+	router, err := sink.NewRouter(config, awsSession)
+	if err != nil {
+		return err
+	}
+	router.Published = sink.NewTableIdempotencyStore(table)
+
+	queue, err := sink.NewDeadLetterQueue(config.DeadLetter, table)
+	if err != nil {
+		return err
+	}
+
+	return sink.Replay(router, queue, *dryRun, os.Stdout)
+}
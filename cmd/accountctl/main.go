@@ -0,0 +1,114 @@
+// accountctl is a command-line tool for the account table
+//
+//	accountctl [-table <table>] [-region <region>] [-endpoint <url>] <command> [flags]
+//
+// Use -endpoint to work against DynamoDB Local, e.g. -endpoint http://localhost:8000
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+type command struct {
+	usage string
+	run   func(table dynamo.Table, args []string) error
+}
+
+// awsSession is configured by the global flags, for the commands using other services than DynamoDB
+var awsSession *session.Session
+
+var commands = map[string]command{
+	"create":     {"create a user, with -password for a password user", runCreate},
+	"get":        {"look up a user by -id, -name or -provider and -subject", runGet},
+	"records":    {"list the auth records of the user", runRecords},
+	"rename":     {"rename the user", runRename},
+	"set-role":   {"change the role of the user", runSetRole},
+	"suspend":    {"suspend the user, with -until for a timed suspension", runSuspend},
+	"unsuspend":  {"unsuspend the user", runUnsuspend},
+	"lockout":    {"show the failed password signins of the user", runLockout},
+	"unlock":     {"clear the failed password signins of the user", runUnlock},
+	"delete":     {"delete the user with all the records", runDelete},
+	"jwt":        {"mint a JWT for the user for debugging", runJwt},
+	"verify":     {"verify and decode a JWT", runVerify},
+	"migrate":    {"apply the pending migrations, with -dry-run to only count the changes", runMigrate},
+	"migrations": {"show the state of the migrations", runMigrations},
+	"replay":     {"re-drive the dead letters of the account events, with -dry-run to only list them", runReplay},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: accountctl [flags] <command> [command flags]\n\nFlags:\n")
+	flag.PrintDefaults()
+
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+func printJSON(value interface{}) error {
+	raw, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(raw))
+	return nil
+}
+
+func main() {
+	tableName := flag.String("table", os.Getenv("authTable"), "name of the account table")
+	region := flag.String("region", os.Getenv("AWS_REGION"), "AWS region")
+	endpoint := flag.String("endpoint", "", "DynamoDB endpoint for a local backend")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if *tableName == "" {
+		fmt.Fprintln(os.Stderr, "-table or authTable is required")
+		os.Exit(2)
+	}
+
+	config := aws.NewConfig()
+	if *region != "" {
+		config = config.WithRegion(*region)
+	}
+	awsSession = session.Must(session.NewSession(config))
+
+	// The endpoint is only for DynamoDB, the sinks of replay are reached in the region
+	dbConfig := aws.NewConfig()
+	if *endpoint != "" {
+		dbConfig = dbConfig.WithEndpoint(*endpoint)
+	}
+	db := dynamo.NewFromIface(dynamodb.New(awsSession, dbConfig))
+
+	if err := cmd.run(db.Table(*tableName), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -12,7 +12,8 @@ const userSchema = {
     format: "uuid"
   }),
   name: devkit.Schema.string({
-    description: "So called `screen_name`, this must be unique among all users"
+    description:
+      "So called `screen_name`, this must be unique among all users case-insensitively"
   }),
   picture: devkit.Schema.string({
     format: "url",
@@ -20,14 +21,21 @@ const userSchema = {
   }),
   display_name: devkit.Schema.string({
     description: "The name for profile"
+  }),
+  email: devkit.Schema.string({
+    format: "email",
+    description: "Address used for password reset"
   })
 };
 
 const authSchema = {
   auth_type: {
-    enum: ["password", "twitter", "google"],
+    enum: ["password", "twitter", "google", "saml", "github"],
     type: "string"
   },
+  device_label: devkit.Schema.string({
+    description: "Label of the session, User-Agent is used if omitted"
+  }),
   data: {
     oneOf: [
       devkit.Schema.object(
@@ -57,16 +65,93 @@ const authSchema = {
         {
           description: "Valid when auth_type is `google`"
         }
+      ),
+      devkit.Schema.object(
+        {
+          saml_response: devkit.Schema.string({
+            description: "SAMLResponse posted to the ACS URL, base64"
+          })
+        },
+        {
+          description: "Valid when auth_type is `saml`"
+        }
+      ),
+      devkit.Schema.object(
+        {
+          code: devkit.Schema.string({
+            description: "Authorization code of GitHub OAuth"
+          }),
+          redirect_uri: devkit.Schema.string({
+            description:
+              "Same as the redirect_uri of the authorization request, if given"
+          })
+        },
+        {
+          description: "Valid when auth_type is `github`"
+        }
       )
     ]
   }
 };
 
+const WeakPassword = new devkit.Component(
+  swagger,
+  "WeakPassword",
+  devkit.Schema.object({
+    message: devkit.Schema.string(),
+    reasons: {
+      type: "array",
+      items: devkit.Schema.object({
+        code: {
+          enum: [
+            "too_short",
+            "too_simple",
+            "contains_user_name",
+            "contains_display_name",
+            "breached"
+          ],
+          type: "string"
+        },
+        message: devkit.Schema.string()
+      })
+    }
+  })
+);
+
+const FieldErrors = new devkit.Component(
+  swagger,
+  "FieldErrors",
+  devkit.Schema.object({
+    message: devkit.Schema.string(),
+    errors: {
+      type: "array",
+      items: devkit.Schema.object({
+        field: devkit.Schema.string(),
+        code: {
+          enum: [
+            "read_only",
+            "unknown_field",
+            "invalid_type",
+            "required",
+            "too_short",
+            "invalid",
+            "already_exists",
+            "invalid_domain"
+          ],
+          type: "string"
+        },
+        message: devkit.Schema.string()
+      })
+    }
+  })
+);
+
 const SignInInput = new devkit.Component(
   swagger,
   "SignInInput",
   devkit.Schema.object({
     auth_type: authSchema.auth_type,
+    device_label: authSchema.device_label,
     data: authSchema.data
   })
 );
@@ -92,6 +177,39 @@ swagger.addPath(
         })
       )
     )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "Invalid input or credentials. Unknown user_name and wrong password are not distinguished"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The account is suspended or pending deletion"
+      }).addContent(
+        "application/json",
+        devkit.Schema.object({
+          code: devkit.Schema.string({
+            enum: ["account_suspended", "account_pending_deletion"]
+          }),
+          message: devkit.Schema.string(),
+          until: {
+            type: "integer",
+            description:
+              "Unix time when the suspension ends, omitted for indefinite suspension"
+          }
+        })
+      )
+    )
+    .addResponse(
+      "429",
+      new devkit.Response({
+        description:
+          "Too many failed attempts for the user_name or the source IP. See `Retry-After` header"
+      })
+    )
 );
 
 const { id, ...SignUpInputUser } = userSchema;
@@ -127,6 +245,13 @@ swagger.addPath(
         })
       )
     )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "Invalid input. The reasons are returned when the password does not satisfy the policy"
+      }).addContent("application/json", WeakPassword)
+    )
 );
 
 swagger.addPath(
@@ -163,7 +288,33 @@ const User = new devkit.Component(
   swagger,
   "User",
   devkit.Schema.object({
-    ...userSchema
+    ...userSchema,
+    role: devkit.Schema.string({
+      enum: ["user", "moderator", "admin"]
+    }),
+    scopes: {
+      type: "array",
+      items: devkit.Schema.string(),
+      description: "Scopes granted in addition to the ones of the role"
+    },
+    status: devkit.Schema.string({
+      enum: ["active", "suspended", "pending_deletion"]
+    }),
+    status_reason: devkit.Schema.string(),
+    status_until: {
+      type: "integer",
+      description: "Unix time when the suspension ends"
+    },
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    updated_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    version: {
+      type: "integer",
+      description: "Incremented on every update, used as ETag"
+    }
   })
 );
 
@@ -172,7 +323,16 @@ swagger.addPath(
   "put",
   new devkit.Path({
     summary: "Update the requested user",
-    tags: ["self"]
+    tags: ["self"],
+    parameters: [
+      {
+        in: "header",
+        name: "If-Match",
+        description:
+          "The ETag of the user, the update fails with 412 if the user has been updated since then",
+        schema: devkit.Schema.string()
+      }
+    ]
   })
     .addRequestBody(
       new devkit.RequestBody().addContent(
@@ -182,12 +342,2445 @@ swagger.addPath(
         })
       )
     )
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content. `ETag` header is the new version of the user"
+      })
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description:
+          "The user has been updated by another request at the same time"
+      })
+    )
+    .addResponse(
+      "412",
+      new devkit.Response({
+        description:
+          "The user has been updated since the version of If-Match. `ETag` header is the current version"
+      })
+    )
+);
+
+swagger.addPath(
+  "/self",
+  "patch",
+  new devkit.Path({
+    summary: "Update the requested user partially",
+    description:
+      "JSON Merge Patch (RFC 7396) of the user. Omitted fields are kept, `null` clears the field. Only email can be cleared",
+    tags: ["self"],
+    parameters: [
+      {
+        in: "header",
+        name: "If-Match",
+        description:
+          "The ETag of the user, the update fails with 412 if the user has been updated since then",
+        schema: devkit.Schema.string()
+      }
+    ]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/merge-patch+json",
+        devkit.Schema.object({
+          ...SignUpInputUser
+        })
+      )
+    )
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content. `ETag` header is the new version of the user"
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "Some fields are invalid, unknown or read-only such as `id`"
+      }).addContent("application/json", FieldErrors)
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description:
+          "The user has been updated by another request at the same time"
+      })
+    )
+    .addResponse(
+      "412",
+      new devkit.Response({
+        description:
+          "The user has been updated since the version of If-Match. `ETag` header is the current version"
+      })
+    )
+    .addResponse(
+      "415",
+      new devkit.Response({
+        description:
+          "Content-Type is neither application/merge-patch+json nor application/json"
+      })
+    )
+);
+
+swagger.addPath(
+  "/self/password",
+  "post",
+  new devkit.Path({
+    summary: "Change the password of the requested user",
+    description:
+      "All the existing sessions are revoked after the password is changed",
+    tags: ["self"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          current_password: devkit.Schema.string(),
+          new_password: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "new_password does not satisfy the policy"
+      }).addContent("application/json", WeakPassword)
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "current_password is wrong"
+      })
+    )
+);
+
+const Activity = new devkit.Component(
+  swagger,
+  "Activity",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    user_id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    event: {
+      enum: [
+        "signin_succeeded",
+        "signin_failed",
+        "signup",
+        "name_changed",
+        "profile_updated",
+        "password_changed",
+        "password_reset",
+        "identity_linked",
+        "token_created",
+        "token_revoked"
+      ],
+      type: "string"
+    },
+    method: devkit.Schema.string({
+      description: "auth_type used for the event"
+    }),
+    source_ip: devkit.Schema.string(),
+    user_agent: devkit.Schema.string(),
+    detail: {
+      type: "object",
+      additionalProperties: devkit.Schema.string()
+    },
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    })
+  })
+);
+
+swagger.addPath(
+  "/self/activity",
+  "get",
+  new devkit.Path({
+    summary: "List the security-relevant events of the requested user",
+    description:
+      "Signin, signup, profile changes, password changes and token revocations, newest first",
+    tags: ["self"],
+    parameters: [
+      {
+        in: "query",
+        required: false,
+        name: "limit",
+        schema: {
+          type: "integer",
+          maximum: 100
+        }
+      },
+      {
+        in: "query",
+        required: false,
+        name: "cursor",
+        schema: devkit.Schema.string()
+      }
+    ]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the activities and the cursor for the next page"
+    }).addContent(
+      "application/json",
+      devkit.Schema.object({
+        activities: {
+          type: "array",
+          items: Activity
+        },
+        cursor: devkit.Schema.string()
+      })
+    )
+  )
+);
+
+const Session = new devkit.Component(
+  swagger,
+  "Session",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    device_label: devkit.Schema.string(),
+    user_agent: devkit.Schema.string(),
+    source_ip: devkit.Schema.string(),
+    auth_method: devkit.Schema.string(),
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    last_seen_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    current: {
+      type: "boolean",
+      description: "True if this is the session of the requesting token"
+    }
+  })
+);
+
+swagger.addPath(
+  "/self/sessions",
+  "get",
+  new devkit.Path({
+    summary: "List the active sessions of the requested user",
+    tags: ["self"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the sessions"
+    }).addContent("application/json", {
+      type: "array",
+      items: Session
+    })
+  )
+);
+
+swagger.addPath(
+  "/self/sessions/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Sign out the session",
+    description: "Tokens of the session are rejected by the authorizer after this",
+    tags: ["self"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
     .addResponse(
       "204",
       new devkit.Response({
         description: "No Content"
       })
     )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The session does not exist"
+      })
+    )
+);
+
+const PersonalAccessToken = new devkit.Component(
+  swagger,
+  "PersonalAccessToken",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    name: devkit.Schema.string(),
+    scopes: {
+      type: "array",
+      items: devkit.Schema.string({
+        enum: [
+          "profile:write",
+          "password:write",
+          "activity:read",
+          "sessions:read",
+          "sessions:write",
+          "tokens:read",
+          "tokens:write",
+          "consents:write",
+          "users:read",
+          "users:write",
+          "clients:read",
+          "clients:write",
+          "providers:read",
+          "providers:write"
+        ]
+      })
+    },
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    expires_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    last_used_at: devkit.Schema.string({
+      format: "date-time"
+    })
+  })
+);
+
+const WebhookEndpoint = new devkit.Component(
+  swagger,
+  "WebhookEndpoint",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    client_id: devkit.Schema.string(),
+    url: devkit.Schema.string({
+      format: "url"
+    }),
+    event_types: {
+      type: "array",
+      items: devkit.Schema.string({
+        description:
+          "An event type or a prefix such as `user.*`, every event if empty"
+      })
+    },
+    status: devkit.Schema.string({
+      enum: ["active", "disabled"]
+    }),
+    consecutive_failures: {
+      type: "integer"
+    },
+    disabled_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    })
+  })
+);
+
+const WebhookDelivery = new devkit.Component(
+  swagger,
+  "WebhookDelivery",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    endpoint_id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    event_id: devkit.Schema.string(),
+    event_type: devkit.Schema.string(),
+    attempt: {
+      type: "integer"
+    },
+    succeeded: {
+      type: "boolean"
+    },
+    status_code: {
+      type: "integer"
+    },
+    error: devkit.Schema.string(),
+    delivered_at: devkit.Schema.string({
+      format: "date-time"
+    }),
+    next_attempt_at: devkit.Schema.string({
+      format: "date-time",
+      description: "Set if the delivery is scheduled to be retried"
+    })
+  })
+);
+
+const SamlAttributes = new devkit.Component(
+  swagger,
+  "SamlAttributes",
+  devkit.Schema.object(
+    {
+      name: devkit.Schema.string({
+        description: "Defaults to uid"
+      }),
+      display_name: devkit.Schema.string({
+        description: "Defaults to displayName"
+      }),
+      email: devkit.Schema.string({
+        description: "Defaults to email"
+      }),
+      picture: devkit.Schema.string({
+        description: "Defaults to picture"
+      })
+    },
+    {
+      description:
+        "Names of the attributes, the defaults are used for empty names"
+    }
+  )
+);
+
+const SamlProvider = new devkit.Component(
+  swagger,
+  "SamlProvider",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    entity_id: devkit.Schema.string(),
+    sso_url: devkit.Schema.string({
+      format: "url"
+    }),
+    certificate: devkit.Schema.string(),
+    attributes: SamlAttributes,
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    })
+  })
+);
+
+const ScimTenant = new devkit.Component(
+  swagger,
+  "ScimTenant",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    name: devkit.Schema.string(),
+    saml_entity_id: devkit.Schema.string(),
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    })
+  })
+);
+
+const scimMultiValue = devkit.Schema.object({
+  value: devkit.Schema.string(),
+  type: devkit.Schema.string(),
+  primary: { type: "boolean" }
+});
+
+const ScimUser = new devkit.Component(
+  swagger,
+  "ScimUser",
+  devkit.Schema.object({
+    schemas: {
+      type: "array",
+      items: devkit.Schema.string()
+    },
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    externalId: devkit.Schema.string({
+      description: "The ID of the user in the directory"
+    }),
+    userName: devkit.Schema.string({
+      description: "name of the account"
+    }),
+    displayName: devkit.Schema.string(),
+    name: devkit.Schema.object({
+      formatted: devkit.Schema.string()
+    }),
+    emails: {
+      type: "array",
+      description: "Only the primary email is stored",
+      items: scimMultiValue
+    },
+    photos: {
+      type: "array",
+      description:
+        "Only the primary photo is stored, under the domain of the service",
+      items: scimMultiValue
+    },
+    active: {
+      type: "boolean",
+      description: "false suspends the account"
+    },
+    meta: devkit.Schema.object({
+      resourceType: devkit.Schema.string(),
+      created: devkit.Schema.string({
+        format: "date-time"
+      }),
+      lastModified: devkit.Schema.string({
+        format: "date-time"
+      }),
+      version: devkit.Schema.string(),
+      location: devkit.Schema.string()
+    })
+  })
+);
+
+const OAuthClient = new devkit.Component(
+  swagger,
+  "OAuthClient",
+  devkit.Schema.object({
+    id: devkit.Schema.string({
+      format: "uuid"
+    }),
+    name: devkit.Schema.string(),
+    redirect_uris: {
+      type: "array",
+      items: devkit.Schema.string()
+    },
+    scopes: {
+      type: "array",
+      items: devkit.Schema.string()
+    },
+    grant_types: {
+      type: "array",
+      items: devkit.Schema.string()
+    },
+    created_at: devkit.Schema.string({
+      format: "date-time"
+    })
+  })
+);
+
+const OAuthError = new devkit.Component(
+  swagger,
+  "OAuthError",
+  devkit.Schema.object({
+    error: devkit.Schema.string(),
+    error_description: devkit.Schema.string()
+  })
+);
+
+const AuthorizeError = new devkit.Component(
+  swagger,
+  "AuthorizeError",
+  devkit.Schema.object({
+    error: devkit.Schema.string(),
+    error_description: devkit.Schema.string(),
+    redirect_to: devkit.Schema.string({
+      description: "Set if the error can be returned to the client"
+    })
+  })
+);
+
+const TokenResponse = new devkit.Component(
+  swagger,
+  "TokenResponse",
+  devkit.Schema.object({
+    access_token: devkit.Schema.string(),
+    token_type: devkit.Schema.string({
+      enum: ["Bearer"]
+    }),
+    expires_in: {
+      type: "integer"
+    },
+    refresh_token: devkit.Schema.string({
+      description: "Issued for the offline_access scope"
+    }),
+    id_token: devkit.Schema.string({
+      description: "Issued for the openid scope"
+    }),
+    scope: devkit.Schema.string()
+  })
+);
+
+const UserInfoClaims = new devkit.Component(
+  swagger,
+  "UserInfoClaims",
+  devkit.Schema.object({
+    sub: devkit.Schema.string(),
+    name: devkit.Schema.string({
+      description: "display_name, for the profile scope"
+    }),
+    preferred_username: devkit.Schema.string({
+      description: "For the profile scope"
+    }),
+    picture: devkit.Schema.string({
+      description: "For the profile scope"
+    }),
+    updated_at: {
+      type: "integer",
+      description: "For the profile scope"
+    },
+    email: devkit.Schema.string({
+      description: "For the email scope"
+    })
+  })
+);
+
+const Introspection = new devkit.Component(
+  swagger,
+  "Introspection",
+  devkit.Schema.object({
+    active: {
+      type: "boolean"
+    },
+    scope: devkit.Schema.string(),
+    client_id: devkit.Schema.string(),
+    username: devkit.Schema.string(),
+    token_type: devkit.Schema.string({
+      enum: ["Bearer", "Refresh"]
+    }),
+    exp: {
+      type: "integer"
+    },
+    iat: {
+      type: "integer"
+    },
+    sub: devkit.Schema.string({
+      description: "The user ID, or the client ID of a service token"
+    }),
+    sub_type: devkit.Schema.string({
+      enum: ["user", "service"]
+    }),
+    jti: devkit.Schema.string(),
+    user: User
+  })
+);
+
+swagger.addPath(
+  "/self/tokens",
+  "get",
+  new devkit.Path({
+    summary: "List the personal access tokens of the requested user",
+    tags: ["self"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the tokens, the raw tokens are never returned"
+    }).addContent("application/json", {
+      type: "array",
+      items: PersonalAccessToken
+    })
+  )
+);
+
+swagger.addPath(
+  "/self/tokens",
+  "post",
+  new devkit.Path({
+    summary: "Create a personal access token",
+    description:
+      "The token is accepted by the authorizer as a Bearer token in place of the JWT. Only the hash is stored, so the token is shown only once. The token is rejected after the password change or the sign-out from all devices.",
+    tags: ["self"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          name: devkit.Schema.string(),
+          scopes: {
+            type: "array",
+            items: devkit.Schema.string()
+          },
+          expires_in_days: {
+            type: "integer",
+            description: "Defaults to 30, up to 365"
+          }
+        })
+      )
+    )
+    .addResponse(
+      "201",
+      new devkit.Response({
+        description: "Returns the token with its metadata"
+      }).addContent("application/json", {
+        allOf: [
+          PersonalAccessToken,
+          devkit.Schema.object({
+            token: devkit.Schema.string()
+          })
+        ]
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The name, scopes or expires_in_days is invalid"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description:
+          "The scopes contain one which is not granted to the requesting user, or the request is authorized by a personal access token or a token of an OAuth client"
+      })
+    )
+);
+
+swagger.addPath(
+  "/self/tokens/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Revoke the personal access token",
+    tags: ["self"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The token does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/password/reset",
+  "post",
+  new devkit.Path({
+    summary: "Request a password reset token",
+    description:
+      "The token is delivered to the user through the notifier. This always returns 202 whether the user exists or not.",
+    tags: ["password"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          user_name: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "202",
+      new devkit.Response({
+        description: "Accepted"
+      })
+    )
+);
+
+swagger.addPath(
+  "/password/reset/confirm",
+  "post",
+  new devkit.Path({
+    summary: "Reset the password with the token",
+    description:
+      "The token is single-use and expires in 1 hour. All the existing sessions are revoked after the password is changed",
+    tags: ["password"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          token: devkit.Schema.string(),
+          new_password: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "The token is invalid or expired, or new_password does not satisfy the policy"
+      }).addContent("application/json", WeakPassword)
+    )
+);
+
+const authorizationRequestSchema = {
+  response_type: devkit.Schema.string({
+    enum: ["code"]
+  }),
+  client_id: devkit.Schema.string(),
+  redirect_uri: devkit.Schema.string(),
+  scope: devkit.Schema.string({
+    description:
+      "Space-separated OpenID Connect scopes (`openid`, `profile`, `email`, `offline_access`) and API scopes"
+  }),
+  state: devkit.Schema.string(),
+  nonce: devkit.Schema.string(),
+  code_challenge: devkit.Schema.string(),
+  code_challenge_method: devkit.Schema.string({
+    enum: ["S256"]
+  })
+};
+
+swagger.addPath(
+  "/oauth/authorize",
+  "get",
+  new devkit.Path({
+    summary: "Describe the authorization request for the consent page",
+    description:
+      "The consent page of the web app (the authorization_endpoint of the discovery) calls this with the token of the signed-in user. Personal access tokens and tokens of OAuth clients are rejected",
+    tags: ["oauth"],
+    parameters: [
+      {
+        in: "query",
+        required: true,
+        name: "response_type",
+        schema: authorizationRequestSchema.response_type
+      },
+      {
+        in: "query",
+        required: true,
+        name: "client_id",
+        schema: authorizationRequestSchema.client_id
+      },
+      {
+        in: "query",
+        required: true,
+        name: "redirect_uri",
+        schema: authorizationRequestSchema.redirect_uri
+      },
+      {
+        in: "query",
+        required: true,
+        name: "scope",
+        schema: authorizationRequestSchema.scope
+      },
+      {
+        in: "query",
+        name: "state",
+        schema: authorizationRequestSchema.state
+      },
+      {
+        in: "query",
+        name: "nonce",
+        schema: authorizationRequestSchema.nonce
+      },
+      {
+        in: "query",
+        required: true,
+        name: "code_challenge",
+        schema: authorizationRequestSchema.code_challenge
+      },
+      {
+        in: "query",
+        required: true,
+        name: "code_challenge_method",
+        schema: authorizationRequestSchema.code_challenge_method
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the client and the requested scopes"
+      }).addContent(
+        "application/json",
+        devkit.Schema.object({
+          client: OAuthClient,
+          scopes: {
+            type: "array",
+            items: devkit.Schema.string()
+          },
+          consent_required: {
+            type: "boolean",
+            description: "False if the user has approved the scopes before"
+          }
+        })
+      )
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The request is invalid"
+      }).addContent("application/json", AuthorizeError)
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The token is not a signin token"
+      })
+    )
+);
+
+swagger.addPath(
+  "/oauth/authorize",
+  "post",
+  new devkit.Path({
+    summary: "Approve or deny the authorization request",
+    description:
+      "On approval the consent is recorded and an authorization code is issued. The web app navigates to redirect_to to return to the client",
+    tags: ["oauth"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          ...authorizationRequestSchema,
+          approved: {
+            type: "boolean"
+          }
+        })
+      )
+    )
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description:
+          "Returns the redirect URI with the code, or with `error=access_denied` if denied"
+      }).addContent(
+        "application/json",
+        devkit.Schema.object({
+          redirect_to: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The request is invalid"
+      }).addContent("application/json", AuthorizeError)
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The token is not a signin token"
+      })
+    )
+);
+
+swagger.addPath(
+  "/oauth/token",
+  "post",
+  new devkit.Path({
+    summary: "Token endpoint of OAuth 2.0",
+    description:
+      "Exchanges an authorization code with the PKCE code_verifier, rotates a refresh token, or issues a service token to a confidential client. Access tokens expire in an hour and are accepted by the authorizer within the granted API scopes. Confidential clients authenticate by HTTP Basic or client_secret",
+    tags: ["oauth"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/x-www-form-urlencoded",
+        devkit.Schema.object({
+          grant_type: devkit.Schema.string({
+            enum: ["authorization_code", "refresh_token", "client_credentials"]
+          }),
+          client_id: devkit.Schema.string(),
+          client_secret: devkit.Schema.string({
+            description: "Of a confidential client, unless given by HTTP Basic"
+          }),
+          code: devkit.Schema.string(),
+          redirect_uri: devkit.Schema.string(),
+          code_verifier: devkit.Schema.string(),
+          refresh_token: devkit.Schema.string(),
+          scope: devkit.Schema.string({
+            description:
+              "Narrows the scope of the refresh_token and client_credentials grants"
+          })
+        })
+      )
+    )
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the tokens"
+      }).addContent("application/json", TokenResponse)
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The grant is invalid, expired or already used"
+      }).addContent("application/json", OAuthError)
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description:
+          "invalid_client, the client is unknown or the secret is wrong"
+      }).addContent("application/json", OAuthError)
+    )
+);
+
+swagger.addPath(
+  "/userinfo",
+  "get",
+  new devkit.Path({
+    summary: "UserInfo endpoint of OpenID Connect",
+    description:
+      "Requires an access token with the openid scope. The claims are read from the current profile",
+    tags: ["oauth"]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the claims of the granted scopes"
+      }).addContent("application/json", UserInfoClaims)
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid, expired or revoked"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The token does not have the openid scope"
+      })
+    )
+);
+
+swagger.addPath(
+  "/introspect",
+  "post",
+  new devkit.Path({
+    summary: "Token introspection of RFC 7662",
+    description:
+      "Checks any token issued by this API, the signin tokens, the access tokens, the personal access tokens and the refresh tokens. Requires a confidential client by HTTP Basic or client_secret",
+    tags: ["oauth"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/x-www-form-urlencoded",
+        devkit.Schema.object({
+          token: devkit.Schema.string(),
+          client_id: devkit.Schema.string(),
+          client_secret: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description:
+          "Returns the state of the token, only active is returned for an invalid, expired or revoked token"
+      }).addContent("application/json", Introspection)
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "token is missing"
+      }).addContent("application/json", OAuthError)
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description:
+          "invalid_client, the client is unknown, public or the secret is wrong"
+      }).addContent("application/json", OAuthError)
+    )
+);
+
+swagger.addPath(
+  "/revoke",
+  "post",
+  new devkit.Path({
+    summary: "Token revocation of RFC 7009",
+    description:
+      "Revokes the access token or the refresh token issued to the client. The other tokens are ignored",
+    tags: ["oauth"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/x-www-form-urlencoded",
+        devkit.Schema.object({
+          token: devkit.Schema.string(),
+          token_type_hint: devkit.Schema.string({
+            description: "Ignored, the type is told by the token",
+            enum: ["access_token", "refresh_token"]
+          }),
+          client_id: devkit.Schema.string(),
+          client_secret: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Revoked, or the token is invalid or not of the client"
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "token is missing"
+      }).addContent("application/json", OAuthError)
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description:
+          "invalid_client, the client is unknown or the secret is wrong"
+      }).addContent("application/json", OAuthError)
+    )
+);
+
+swagger.addPath(
+  "/.well-known/openid-configuration",
+  "get",
+  new devkit.Path({
+    summary: "Discovery document of OpenID Connect",
+    tags: ["oauth"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the provider metadata"
+    })
+  )
+);
+
+swagger.addPath(
+  "/.well-known/jwks.json",
+  "get",
+  new devkit.Path({
+    summary: "Public key to verify the ID tokens and the access tokens",
+    tags: ["oauth"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the JWK Set"
+    })
+  )
+);
+
+swagger.addPath(
+  "/admin/users",
+  "get",
+  new devkit.Path({
+    summary: "Search users by ID or name",
+    description: "Requires the admin role. Either id or name is required",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "query",
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      },
+      {
+        in: "query",
+        name: "name",
+        description: "Matched case-insensitively",
+        schema: devkit.Schema.string()
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the users"
+      }).addContent("application/json", {
+        type: "array",
+        items: User
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "Neither id nor name is given"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}",
+  "get",
+  new devkit.Path({
+    summary: "Get the user with all the auth records",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the user and the records except the activities. Password hashes are removed"
+      }).addContent("application/json", devkit.Schema.object({
+        user: User,
+        records: {
+          type: "array",
+          items: devkit.Schema.object({})
+        },
+        lockout: {
+          type: "object",
+          nullable: true,
+          description:
+            "The failed password signins by the name, null if there are none",
+          properties: {
+            key: devkit.Schema.string(),
+            failures: {
+              type: "integer"
+            },
+            last_failure_at: {
+              type: "integer",
+              description: "Unix time"
+            },
+            locked_until: {
+              type: "integer",
+              description:
+                "Unix time, signin by the name is rejected until this time"
+            }
+          }
+        }
+      }))
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Delete the user with all the records",
+    description: "The deletion is recorded in the activities of the admin",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}/name",
+  "put",
+  new devkit.Path({
+    summary: "Rename the user",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          name: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The name is invalid or already exists"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description: "The user has been updated by another request"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}/suspend",
+  "post",
+  new devkit.Path({
+    summary: "Suspend the user",
+    description:
+      "All the sessions of the user are revoked, and signin and existing tokens are rejected while suspended",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          reason: devkit.Schema.string(),
+          until: devkit.Schema.string({
+            format: "date-time",
+            description:
+              "The suspension ends automatically at this time if given"
+          })
+        })
+      )
+    )
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}/unsuspend",
+  "post",
+  new devkit.Path({
+    summary: "Unsuspend the user",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}/unlock",
+  "post",
+  new devkit.Path({
+    summary: "Clear the failed password signins of the user",
+    description: "The lock by the source IP is kept",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/users/{id}/sessions",
+  "delete",
+  new devkit.Path({
+    summary: "Revoke all the sessions of the user",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/clients",
+  "get",
+  new devkit.Path({
+    summary: "List the OAuth clients",
+    tags: ["admin"]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the clients"
+      }).addContent("application/json", {
+        type: "array",
+        items: OAuthClient
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/clients",
+  "post",
+  new devkit.Path({
+    summary: "Register an OAuth client",
+    tags: ["admin"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          name: devkit.Schema.string(),
+          redirect_uris: {
+            type: "array",
+            description: "Required for the authorization_code grant",
+            items: devkit.Schema.string({
+              description: "https, or http for localhost"
+            })
+          },
+          scopes: {
+            type: "array",
+            description: "API scopes the client can request",
+            items: devkit.Schema.string()
+          },
+          grant_types: {
+            type: "array",
+            description: "Defaults to authorization_code and refresh_token",
+            items: devkit.Schema.string({
+              enum: [
+                "authorization_code",
+                "refresh_token",
+                "client_credentials"
+              ]
+            })
+          },
+          confidential: {
+            type: "boolean",
+            description: "Issues a secret, required for client_credentials"
+          }
+        })
+      )
+    )
+    .addResponse(
+      "201",
+      new devkit.Response({
+        description: "Created"
+      }).addContent("application/json", {
+        allOf: [
+          OAuthClient,
+          devkit.Schema.object({
+            secret: devkit.Schema.string({
+              description: "Of a confidential client, returned only once"
+            })
+          })
+        ]
+      })
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "The name, a redirect URI, a scope or a grant type is invalid"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/clients/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Delete the OAuth client",
+    description:
+      "The service tokens are rejected right away, the tokens of users are valid until they expire",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The client does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/webhooks",
+  "get",
+  new devkit.Path({
+    summary: "List the webhook endpoints",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "query",
+        name: "client_id",
+        schema: devkit.Schema.string()
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description:
+          "Returns the endpoints, of the client if client_id is given"
+      }).addContent("application/json", {
+        type: "array",
+        items: WebhookEndpoint
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/webhooks",
+  "post",
+  new devkit.Path({
+    summary: "Register a webhook endpoint of the OAuth client",
+    description:
+      "Only the events of the users who have consented to the client are delivered. Deliveries are signed with the secret, see docs/events.md. The secret is returned only once",
+    tags: ["admin"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          client_id: devkit.Schema.string(),
+          url: devkit.Schema.string({
+            format: "url",
+            description: "https only"
+          }),
+          event_types: {
+            type: "array",
+            items: devkit.Schema.string()
+          }
+        })
+      )
+    )
+    .addResponse(
+      "201",
+      new devkit.Response({
+        description: "Created"
+      }).addContent(
+        "application/json",
+        devkit.Schema.object({
+          endpoint: WebhookEndpoint,
+          secret: devkit.Schema.string()
+        })
+      )
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "client_id is empty, url is not https or an event type is unknown"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/webhooks/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Delete the webhook endpoint",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The endpoint does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/webhooks/{id}/enable",
+  "post",
+  new devkit.Path({
+    summary: "Enable the webhook endpoint disabled after failures",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The endpoint does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/webhooks/{id}/deliveries",
+  "get",
+  new devkit.Path({
+    summary: "List the latest deliveries to the webhook endpoint",
+    description: "Each attempt is logged, newest first. Logs expire in 30 days",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the deliveries"
+      }).addContent("application/json", {
+        type: "array",
+        items: WebhookDelivery
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The endpoint does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/scim-tenants",
+  "get",
+  new devkit.Path({
+    summary: "List the SCIM tenants",
+    tags: ["admin"]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the tenants"
+      }).addContent("application/json", {
+        type: "array",
+        items: ScimTenant
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/scim-tenants",
+  "post",
+  new devkit.Path({
+    summary: "Register a SCIM tenant",
+    description: "The token is the bearer token of /scim/v2, see docs/scim.md",
+    tags: ["admin"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          name: devkit.Schema.string({
+            description: "1 to 64 characters"
+          }),
+          saml_entity_id: devkit.Schema.string({
+            description:
+              "The registered SAML provider which the provisioned users sign in by, with the userName as the NameID"
+          })
+        })
+      )
+    )
+    .addResponse(
+      "201",
+      new devkit.Response({
+        description: "Created"
+      }).addContent(
+        "application/json",
+        devkit.Schema.object({
+          tenant: ScimTenant,
+          token: devkit.Schema.string({
+            description: "Returned only once"
+          })
+        })
+      )
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description:
+          "The name is invalid, or the SAML provider is not registered"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/scim-tenants/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Delete the SCIM tenant",
+    description:
+      "The token is revoked, the users provisioned by the tenant are kept",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The tenant does not exist"
+      })
+    )
+);
+
+const scimUserParameters = [
+  {
+    in: "path",
+    required: true,
+    name: "id",
+    schema: devkit.Schema.string({
+      format: "uuid"
+    })
+  }
+];
+
+swagger.addPath(
+  "/scim/v2/Users",
+  "get",
+  new devkit.Path({
+    summary: "List the users provisioned by the tenant",
+    description: "Requires the bearer token of the tenant",
+    tags: ["scim"],
+    parameters: [
+      {
+        in: "query",
+        name: "filter",
+        description: "eq, ne, co, sw, ew and pr joined by and / or",
+        schema: devkit.Schema.string()
+      },
+      {
+        in: "query",
+        name: "startIndex",
+        description: "1-based",
+        schema: { type: "integer" }
+      },
+      {
+        in: "query",
+        name: "count",
+        description: "Up to 100",
+        schema: { type: "integer" }
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns a ListResponse of the users"
+      }).addContent(
+        "application/scim+json",
+        devkit.Schema.object({
+          schemas: {
+            type: "array",
+            items: devkit.Schema.string()
+          },
+          totalResults: { type: "integer" },
+          startIndex: { type: "integer" },
+          itemsPerPage: { type: "integer" },
+          Resources: {
+            type: "array",
+            items: ScimUser
+          }
+        })
+      )
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The filter is invalid"
+      })
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid"
+      })
+    )
+);
+
+swagger.addPath(
+  "/scim/v2/Users",
+  "post",
+  new devkit.Path({
+    summary: "Provision a user",
+    description: "The user signs in by the identity provider of the directory",
+    tags: ["scim"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent("application/scim+json", ScimUser)
+    )
+    .addResponse(
+      "201",
+      new devkit.Response({
+        description: "Created"
+      }).addContent("application/scim+json", ScimUser)
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "A field is invalid"
+      })
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid"
+      })
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description: "userName is already taken"
+      })
+    )
+);
+
+swagger.addPath(
+  "/scim/v2/Users/{id}",
+  "get",
+  new devkit.Path({
+    summary: "Get the user",
+    tags: ["scim"],
+    parameters: scimUserParameters
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the user with ETag"
+      }).addContent("application/scim+json", ScimUser)
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user is not provisioned by the tenant"
+      })
+    )
+);
+
+swagger.addPath(
+  "/scim/v2/Users/{id}",
+  "put",
+  new devkit.Path({
+    summary: "Replace the user",
+    description:
+      "active false suspends the user and revokes the sessions. If-Match is honored",
+    tags: ["scim"],
+    parameters: scimUserParameters
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent("application/scim+json", ScimUser)
+    )
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the user"
+      }).addContent("application/scim+json", ScimUser)
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "A field is invalid"
+      })
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user is not provisioned by the tenant"
+      })
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description: "userName is already taken"
+      })
+    )
+    .addResponse(
+      "412",
+      new devkit.Response({
+        description: "If-Match does not match the version"
+      })
+    )
+);
+
+swagger.addPath(
+  "/scim/v2/Users/{id}",
+  "patch",
+  new devkit.Path({
+    summary: "Patch the user",
+    description: "add, replace and remove of a PatchOp. If-Match is honored",
+    tags: ["scim"],
+    parameters: scimUserParameters
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/scim+json",
+        devkit.Schema.object({
+          schemas: {
+            type: "array",
+            items: devkit.Schema.string()
+          },
+          Operations: {
+            type: "array",
+            items: devkit.Schema.object({
+              op: {
+                enum: ["add", "replace", "remove"],
+                type: "string"
+              },
+              path: devkit.Schema.string(),
+              value: {}
+            })
+          }
+        })
+      )
+    )
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the user"
+      }).addContent("application/scim+json", ScimUser)
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "An operation is invalid"
+      })
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user is not provisioned by the tenant"
+      })
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description: "userName is already taken"
+      })
+    )
+    .addResponse(
+      "412",
+      new devkit.Response({
+        description: "If-Match does not match the version"
+      })
+    )
+);
+
+swagger.addPath(
+  "/scim/v2/Users/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Deprovision the user",
+    description: "The account is deleted",
+    tags: ["scim"],
+    parameters: scimUserParameters
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "401",
+      new devkit.Response({
+        description: "The token is invalid"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The user is not provisioned by the tenant"
+      })
+    )
+);
+
+swagger.addPath(
+  "/scim/v2/ServiceProviderConfig",
+  "get",
+  new devkit.Path({
+    summary: "Get the capabilities of the service provider",
+    description: "Public, no token is required",
+    tags: ["scim"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the ServiceProviderConfig"
+    })
+  )
+);
+
+swagger.addPath(
+  "/scim/v2/Schemas",
+  "get",
+  new devkit.Path({
+    summary: "List the schemas",
+    description: "Public, no token is required",
+    tags: ["scim"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns a ListResponse of the User schema"
+    })
+  )
+);
+
+swagger.addPath(
+  "/scim/v2/Schemas/{id}",
+  "get",
+  new devkit.Path({
+    summary: "Get the schema",
+    description: "Public, no token is required",
+    tags: ["scim"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string()
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the schema"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The schema does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/saml-providers",
+  "get",
+  new devkit.Path({
+    summary: "List the SAML identity providers",
+    tags: ["admin"]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the providers"
+      }).addContent("application/json", {
+        type: "array",
+        items: SamlProvider
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/saml-providers",
+  "post",
+  new devkit.Path({
+    summary: "Register a SAML identity provider",
+    description: "See docs/saml.md",
+    tags: ["admin"]
+  })
+    .addRequestBody(
+      new devkit.RequestBody().addContent(
+        "application/json",
+        devkit.Schema.object({
+          entity_id: devkit.Schema.string(),
+          sso_url: devkit.Schema.string({
+            format: "url",
+            description:
+              "https only, the SingleSignOnService of HTTP-Redirect binding"
+          }),
+          certificate: devkit.Schema.string({
+            description: "The signing certificate, PEM or base64 DER"
+          }),
+          attributes: SamlAttributes
+        })
+      )
+    )
+    .addResponse(
+      "201",
+      new devkit.Response({
+        description: "Created"
+      }).addContent("application/json", SamlProvider)
+    )
+    .addResponse(
+      "400",
+      new devkit.Response({
+        description: "The entity ID, the SSO URL or the certificate is invalid"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "409",
+      new devkit.Response({
+        description: "The entity ID is already registered"
+      })
+    )
+);
+
+swagger.addPath(
+  "/admin/saml-providers/{id}",
+  "delete",
+  new devkit.Path({
+    summary: "Delete the SAML identity provider",
+    description: "The users are kept, but can not sign in by the provider",
+    tags: ["admin"],
+    parameters: [
+      {
+        in: "path",
+        required: true,
+        name: "id",
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      }
+    ]
+  })
+    .addResponse(
+      "204",
+      new devkit.Response({
+        description: "No Content"
+      })
+    )
+    .addResponse(
+      "403",
+      new devkit.Response({
+        description: "The requesting user is not an admin"
+      })
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The provider does not exist"
+      })
+    )
+);
+
+swagger.addPath(
+  "/saml/metadata",
+  "get",
+  new devkit.Path({
+    summary: "Get the metadata of this service provider",
+    tags: ["saml"]
+  }).addResponse(
+    "200",
+    new devkit.Response({
+      description: "Returns the EntityDescriptor"
+    }).addContent("application/samlmetadata+xml", devkit.Schema.string())
+  )
+);
+
+swagger.addPath(
+  "/saml/login",
+  "get",
+  new devkit.Path({
+    summary: "Create an AuthnRequest to the identity provider",
+    description:
+      "The identity provider posts the response to the ACS URL, which signs in with auth_type `saml`",
+    tags: ["saml"],
+    parameters: [
+      {
+        in: "query",
+        name: "provider",
+        required: true,
+        schema: devkit.Schema.string({
+          format: "uuid"
+        })
+      },
+      {
+        in: "query",
+        name: "relay_state",
+        description: "Returned with the response as RelayState",
+        schema: devkit.Schema.string()
+      }
+    ]
+  })
+    .addResponse(
+      "200",
+      new devkit.Response({
+        description: "Returns the URL of the identity provider"
+      }).addContent(
+        "application/json",
+        devkit.Schema.object({
+          redirect_to: devkit.Schema.string({
+            format: "url"
+          })
+        })
+      )
+    )
+    .addResponse(
+      "404",
+      new devkit.Response({
+        description: "The provider does not exist"
+      })
+    )
 );
 
 swagger.addPath(
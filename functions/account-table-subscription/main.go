@@ -2,35 +2,62 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"os"
 
-	"github.com/pkg/errors"
-
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sns"
-	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+
+	"github.com/portals-me/account/lib/event"
+	"github.com/portals-me/account/lib/sink"
 )
 
-var SNS snsiface.SNSAPI
+var authTableName = os.Getenv("authTable")
 var topicArn = os.Getenv("accountTableSubscriptionTopicArn")
 
-func handler(ctx context.Context, event events.DynamoDBEvent) error {
-	for _, record := range event.Records {
-		// Filter only "detail" part (user information)
-		if record.Change.Keys["sort"].String() == "detail" {
-			jsn, _ := json.Marshal(record)
+// JSON of sink.RouterConfig, every event goes to the topic and the webhooks if empty
+var sinkConfig = os.Getenv("eventSinks")
 
-			_, err := SNS.Publish(&sns.PublishInput{
-				Message:  aws.String(string(jsn)),
-				TopicArn: aws.String(topicArn),
-			})
+var router sink.Router
+var deadLetters sink.DeadLetterQueue
+
+// aws-lambda-go in use does not have the response type for the partial batch failure
+type BatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+type BatchResponse struct {
+	BatchItemFailures []BatchItemFailure `json:"batchItemFailures"`
+}
+
+// processRecord publishes the events of the record
+// The events failed to be delivered go to the dead letter queue, an error is returned only if it fails too
+func processRecord(record events.DynamoDBEventRecord) error {
+	accountEvents, err := event.FromStreamRecord(record)
+	if err != nil {
+		deadLetter, err := sink.DeadLetterOfRecord(record, err)
+		if err != nil {
+			return err
+		}
+
+		return deadLetters.Put(deadLetter)
+	}
+
+	for _, accountEvent := range accountEvents {
+		cloudEvent := accountEvent.CloudEvent()
+		for name, sendErr := range router.Deliver(cloudEvent) {
+			fmt.Printf("Send %s to %s failed: %+v\n", cloudEvent.ID, name, sendErr)
+
+			deadLetter, err := sink.DeadLetterOfEvent(name, cloudEvent, router.MaxAttempts, sendErr)
 			if err != nil {
-				return errors.Wrapf(err, "SNS publich failed: %+v", record)
+				return err
+			}
+			if err := deadLetters.Put(deadLetter); err != nil {
+				return err
 			}
 		}
 	}
@@ -38,8 +65,44 @@ func handler(ctx context.Context, event events.DynamoDBEvent) error {
 	return nil
 }
 
+func handler(ctx context.Context, streamEvent events.DynamoDBEvent) (BatchResponse, error) {
+	response := BatchResponse{
+		BatchItemFailures: []BatchItemFailure{},
+	}
+
+	for _, record := range streamEvent.Records {
+		if err := processRecord(record); err != nil {
+			fmt.Printf("Record %s failed: %+v\n", record.EventID, err)
+
+			// The event source mapping has ReportBatchItemFailures, the shard is retried from the failed record, the rest of the batch must not be published before it
+			response.BatchItemFailures = append(response.BatchItemFailures, BatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+	}
+
+	return response, nil
+}
+
 func main() {
-	SNS = sns.New(session.New(), &aws.Config{})
+	config, err := sink.LoadRouterConfig(sinkConfig, topicArn, authTableName)
+	if err != nil {
+		panic(err)
+	}
+
+	sess := session.Must(session.NewSession())
+	router, err = sink.NewRouter(config, sess)
+	if err != nil {
+		panic(err)
+	}
+
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	router.Published = sink.NewTableIdempotencyStore(db.Table(authTableName))
+	deadLetters, err = sink.NewDeadLetterQueue(config.DeadLetter, db.Table(authTableName))
+	if err != nil {
+		panic(err)
+	}
 
 	lambda.Start(handler)
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/audit"
+)
+
+var authTableName = os.Getenv("authTable")
+
+const defaultLimit = 20
+const maxLimit = 100
+
+type Output struct {
+	Activities []audit.Entry `json:"activities"`
+	Cursor     string        `json:"cursor,omitempty"`
+}
+
+/*
+GET /self/activity?limit=<limit>&cursor=<cursor>
+
+returns Output
+*/
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	auditRepo := audit.NewRepository(db.Table(authTableName))
+
+	limit := int64(defaultLimit)
+	if value, err := strconv.ParseInt(request.QueryStringParameters["limit"], 10, 64); err == nil && value > 0 && value <= maxLimit {
+		limit = value
+	}
+
+	entries, cursor, err := auditRepo.List(
+		request.RequestContext.Authorizer["id"].(string),
+		limit,
+		request.QueryStringParameters["cursor"],
+	)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	raw, err := json.Marshal(Output{
+		Activities: entries,
+		Cursor:     cursor,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body: string(raw),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: 200,
+	}, nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
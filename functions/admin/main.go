@@ -0,0 +1,833 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/ddb"
+	"github.com/portals-me/account/lib/event"
+	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/oauth"
+	"github.com/portals-me/account/lib/password"
+	"github.com/portals-me/account/lib/saml"
+	"github.com/portals-me/account/lib/scim"
+	sessionlib "github.com/portals-me/account/lib/session"
+	"github.com/portals-me/account/lib/throttle"
+	"github.com/portals-me/account/lib/user"
+	"github.com/portals-me/account/lib/webhook"
+)
+
+var authTableName = os.Getenv("authTable")
+
+type UserOutput struct {
+	User    user.UserInfo            `json:"user"`
+	Records []map[string]interface{} `json:"records"`
+	// Lockout is the failed password signins by the name, null if there are none
+	Lockout *throttle.Attempt `json:"lockout"`
+}
+
+type RenameInput struct {
+	Name string `json:"name"`
+}
+
+type ClientInput struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// Scopes of the service tokens by the client_credentials grant
+	Scopes     []string `json:"scopes"`
+	GrantTypes []string `json:"grant_types"`
+	// A confidential client is issued a secret
+	Confidential bool `json:"confidential"`
+}
+
+// The secret is returned only once
+type ClientOutput struct {
+	oauth.Client
+	Secret string `json:"secret,omitempty"`
+}
+
+// SAMLEntityID links the tenant to the registered SAML provider which the users sign in by
+type TenantInput struct {
+	Name         string `json:"name"`
+	SAMLEntityID string `json:"saml_entity_id"`
+}
+
+// The token is returned only once
+type TenantOutput struct {
+	Tenant scim.Tenant `json:"tenant"`
+	Token  string      `json:"token"`
+}
+
+type ProviderInput struct {
+	EntityID    string            `json:"entity_id"`
+	SSOURL      string            `json:"sso_url"`
+	Certificate string            `json:"certificate"`
+	Attributes  saml.AttributeMap `json:"attributes"`
+}
+
+type WebhookInput struct {
+	ClientID   string   `json:"client_id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// The secret is returned only once
+type WebhookOutput struct {
+	Endpoint webhook.Endpoint `json:"endpoint"`
+	Secret   string           `json:"secret"`
+}
+
+type SuspendInput struct {
+	Reason string `json:"reason"`
+	// The suspension ends automatically at Until if given
+	Until *time.Time `json:"until"`
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: statusCode,
+	}
+}
+
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(statusCode, string(raw)), nil
+}
+
+/*
+GET /admin/users?id=<id>&name=<name>
+
+returns []user.UserInfo
+*/
+func searchUsers(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	users := []user.UserInfo{}
+
+	if userID := request.QueryStringParameters["id"]; userID != "" {
+		var userInfo user.UserInfo
+		if err := user.NewRepository(authTable).Get(userID, &userInfo); err != nil {
+			if err != dynamo.ErrNotFound {
+				return events.APIGatewayProxyResponse{}, err
+			}
+		} else {
+			users = append(users, userInfo)
+		}
+	} else if name := request.QueryStringParameters["name"]; name != "" {
+		// The name indexes only project the keys
+		// The name is matched case-insensitively, the users from before name_lower are found only by the exact name
+		var keys []user.UserInfo
+		if err := authTable.
+			Get("name_lower", strings.ToLower(name)).
+			Index("name_lower").
+			All(&keys); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		var exactKeys []user.UserInfo
+		if err := authTable.
+			Get("name", name).
+			Index("name").
+			All(&exactKeys); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		found := map[string]bool{}
+		for _, key := range append(keys, exactKeys...) {
+			if found[key.ID] {
+				continue
+			}
+			found[key.ID] = true
+
+			var userInfo user.UserInfo
+			if err := user.NewRepository(authTable).Get(key.ID, &userInfo); err != nil {
+				return events.APIGatewayProxyResponse{}, err
+			}
+
+			users = append(users, userInfo)
+		}
+	} else {
+		return response(400, "id or name is required"), nil
+	}
+
+	return jsonResponse(200, users)
+}
+
+/*
+GET /admin/users/{id}
+
+returns UserOutput, the records except the activities
+*/
+func getUser(authTable dynamo.Table, userInfo user.UserInfo) (events.APIGatewayProxyResponse, error) {
+	var records []map[string]interface{}
+	if err := authTable.
+		Get("id", userInfo.ID).
+		All(&records); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	// The attempts are keyed by the name, they are not among the records of the user
+	lockout, err := throttle.NewRepository(authTable).Lockout(userInfo.Name)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	output := UserOutput{
+		User:    userInfo,
+		Records: []map[string]interface{}{},
+		Lockout: lockout,
+	}
+	for _, record := range records {
+		if sort, _ := record["sort"].(string); strings.HasPrefix(sort, "activity##") {
+			continue
+		}
+
+		// Never show the password hash
+		delete(record, "check_data")
+		output.Records = append(output.Records, record)
+	}
+
+	return jsonResponse(200, output)
+}
+
+/*
+PUT /admin/users/{id}/name
+
+expects RenameInput
+returns 409 if the user is changed meanwhile
+*/
+func renameUser(db *dynamo.DB, authTable dynamo.Table, userInfo user.UserInfo, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input RenameInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	// Password users sign in with the name, the password record is moved in the same transaction
+	tx := db.WriteTx()
+	if err := password.NewRepository(authTable).RenameTx(tx, userInfo.ID, input.Name); err != nil && err != dynamo.ErrNotFound {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	// Only the name is changed, the picture is not checked against the domain
+	renamed := userInfo
+	renamed.Name = input.Name
+	if err := user.NewRepository(authTable).PutWith(tx, &renamed, ""); err != nil {
+		if err == user.ErrVersionConflict {
+			return response(409, err.Error()), nil
+		}
+
+		return response(400, err.Error()), nil
+	}
+
+	recordAction(authTable, request, userInfo.ID, audit.NameChanged, map[string]string{
+		"old_name": userInfo.Name,
+		"new_name": input.Name,
+	})
+
+	return response(204, ""), nil
+}
+
+/*
+POST /admin/users/{id}/suspend
+
+expects SuspendInput
+*/
+func suspendUser(authTable dynamo.Table, userInfo user.UserInfo, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input SuspendInput
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+			return response(400, err.Error()), nil
+		}
+	}
+
+	until := int64(0)
+	detail := map[string]string{
+		"reason": input.Reason,
+	}
+	if input.Until != nil {
+		if input.Until.Before(time.Now()) {
+			return response(400, "until must be in the future"), nil
+		}
+
+		until = input.Until.Unix()
+		detail["until"] = input.Until.UTC().Format(time.RFC3339)
+	}
+
+	if err := user.NewRepository(authTable).SetStatus(userInfo.ID, user.StatusSuspended, input.Reason, until); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if err := sessionlib.NewRepository(authTable).RevokeAll(userInfo.ID); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	recordAction(authTable, request, userInfo.ID, audit.Suspended, detail)
+
+	return response(204, ""), nil
+}
+
+/*	POST /admin/users/{id}/unsuspend
+ */
+func unsuspendUser(authTable dynamo.Table, userInfo user.UserInfo, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := user.NewRepository(authTable).SetStatus(userInfo.ID, user.StatusActive, "", 0); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	recordAction(authTable, request, userInfo.ID, audit.Unsuspended, map[string]string{})
+
+	return response(204, ""), nil
+}
+
+/*
+POST /admin/users/{id}/unlock
+
+clears the failed password signins of the user
+*/
+func unlockUser(authTable dynamo.Table, userInfo user.UserInfo, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := throttle.NewRepository(authTable).Unlock(userInfo.Name); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	recordAction(authTable, request, userInfo.ID, audit.Unlocked, map[string]string{})
+
+	return response(204, ""), nil
+}
+
+/*	DELETE /admin/users/{id}/sessions
+ */
+func revokeSessions(authTable dynamo.Table, userInfo user.UserInfo, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := sessionlib.NewRepository(authTable).RevokeAll(userInfo.ID); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	recordAction(authTable, request, userInfo.ID, audit.TokenRevoked, map[string]string{
+		"scope": "all",
+	})
+
+	return response(204, ""), nil
+}
+
+/*
+DELETE /admin/users/{id}
+
+The log of the user is deleted together, so the deletion is recorded in the log of the admin
+*/
+func deleteUser(authTable dynamo.Table, userInfo user.UserInfo, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := user.NewRepository(authTable).Delete(userInfo.ID); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	if err := audit.NewRepository(authTable).Append(adminID, audit.UserDeleted, "", audit.SourceOf(request), map[string]string{
+		"user_id": userInfo.ID,
+		"name":    userInfo.Name,
+	}); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
+	return response(204, ""), nil
+}
+
+/*
+GET /admin/clients
+
+returns []oauth.Client
+*/
+func listClients(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	clients, err := oauth.NewRepository(authTable).ListClients()
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, clients)
+}
+
+// isRedirectURI accepts https URIs, and http only for the loopback of native apps
+func isRedirectURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" || parsed.Fragment != "" {
+		return false
+	}
+
+	if parsed.Scheme == "http" {
+		return parsed.Hostname() == "localhost" || parsed.Hostname() == "127.0.0.1"
+	}
+
+	return parsed.Scheme == "https"
+}
+
+/*
+POST /admin/clients
+
+expects ClientInput
+returns ClientOutput
+*/
+func createClient(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input ClientInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	if input.Name == "" || len(input.Name) > 64 {
+		return response(400, "name must be 1 to 64 characters"), nil
+	}
+
+	if len(input.GrantTypes) == 0 {
+		input.GrantTypes = []string{oauth.GrantAuthorizationCode, oauth.GrantRefreshToken}
+	}
+	for _, grantType := range input.GrantTypes {
+		if !authz.Has(oauth.GrantTypes, grantType) {
+			return response(400, "Unknown grant type: "+grantType), nil
+		}
+	}
+	if authz.Has(input.GrantTypes, oauth.GrantClientCredentials) && !input.Confidential {
+		return response(400, "client_credentials requires a confidential client"), nil
+	}
+
+	// Redirect URIs are only used by the authorization code flow
+	if authz.Has(input.GrantTypes, oauth.GrantAuthorizationCode) && len(input.RedirectURIs) == 0 {
+		return response(400, "redirect_uris must not be empty"), nil
+	}
+	for _, uri := range input.RedirectURIs {
+		if !isRedirectURI(uri) {
+			return response(400, "Invalid redirect URI: "+uri), nil
+		}
+	}
+
+	for _, scope := range input.Scopes {
+		if !authz.IsKnown(scope) {
+			return response(400, "Unknown scope: "+scope), nil
+		}
+	}
+
+	client, secret, err := oauth.NewRepository(authTable).CreateClient(input.Name, input.RedirectURIs, input.Scopes, input.GrantTypes, input.Confidential)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.ClientCreated, map[string]string{
+		"client_id": client.ClientID,
+	})
+
+	return jsonResponse(201, ClientOutput{
+		Client: client,
+		Secret: secret,
+	})
+}
+
+/*	DELETE /admin/clients/{id}
+ */
+func deleteClient(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	clientID := request.PathParameters["id"]
+	if err := oauth.NewRepository(authTable).DeleteClient(clientID); err != nil {
+		if err == oauth.ErrNotFound {
+			return response(404, err.Error()), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.ClientDeleted, map[string]string{
+		"client_id": clientID,
+	})
+
+	return response(204, ""), nil
+}
+
+/*
+GET /admin/webhooks?client_id=<client_id>
+
+returns []webhook.Endpoint
+*/
+func listWebhooks(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	endpoints, err := webhook.NewRepository(authTable).List(request.QueryStringParameters["client_id"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, endpoints)
+}
+
+/*
+POST /admin/webhooks
+
+expects WebhookInput
+returns WebhookOutput
+*/
+func createWebhook(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input WebhookInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	if input.ClientID == "" {
+		return response(400, "client_id is required"), nil
+	}
+	if parsed, err := url.Parse(input.URL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return response(400, "url must be an https URL"), nil
+	}
+	for _, eventType := range input.EventTypes {
+		if !event.IsType(eventType) {
+			return response(400, "Unknown event type: "+eventType), nil
+		}
+	}
+
+	endpoint, err := webhook.NewRepository(authTable).Create(input.ClientID, input.URL, input.EventTypes)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.WebhookCreated, map[string]string{
+		"endpoint_id": endpoint.EndpointID,
+		"client_id":   endpoint.ClientID,
+	})
+
+	return jsonResponse(201, WebhookOutput{
+		Endpoint: endpoint,
+		Secret:   endpoint.Secret,
+	})
+}
+
+/*	DELETE /admin/webhooks/{id}
+ */
+func deleteWebhook(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	endpointID := request.PathParameters["id"]
+	if err := webhook.NewRepository(authTable).Delete(endpointID); err != nil {
+		if err == webhook.ErrNotFound {
+			return response(404, err.Error()), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.WebhookDeleted, map[string]string{
+		"endpoint_id": endpointID,
+	})
+
+	return response(204, ""), nil
+}
+
+/*
+POST /admin/webhooks/{id}/enable
+
+enables the endpoint disabled after failures
+*/
+func enableWebhook(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	endpointID := request.PathParameters["id"]
+	if err := webhook.NewRepository(authTable).Enable(endpointID); err != nil {
+		if err == webhook.ErrNotFound {
+			return response(404, err.Error()), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.WebhookEnabled, map[string]string{
+		"endpoint_id": endpointID,
+	})
+
+	return response(204, ""), nil
+}
+
+/*
+GET /admin/webhooks/{id}/deliveries
+
+returns []webhook.Delivery, newest first
+*/
+func listDeliveries(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	repo := webhook.NewRepository(authTable)
+	if _, err := repo.Get(request.PathParameters["id"]); err != nil {
+		if err == webhook.ErrNotFound {
+			return response(404, err.Error()), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	deliveries, err := repo.Deliveries(request.PathParameters["id"], 50)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, deliveries)
+}
+
+/*
+GET /admin/scim-tenants
+
+returns []scim.Tenant
+*/
+func listTenants(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenants, err := scim.NewRepository(authTable).ListTenants()
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, tenants)
+}
+
+/*
+POST /admin/scim-tenants
+
+expects TenantInput
+returns TenantOutput, the token is the bearer token of /scim/v2
+*/
+func createTenant(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input TenantInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	if input.Name == "" || len(input.Name) > 64 {
+		return response(400, "name must be 1 to 64 characters"), nil
+	}
+
+	if input.SAMLEntityID != "" {
+		if _, err := saml.NewRepository(authTable).GetProviderByEntityID(input.SAMLEntityID); err != nil {
+			if err == saml.ErrNotFound {
+				return response(400, "Unknown SAML provider: "+input.SAMLEntityID), nil
+			}
+
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
+
+	tenant, token, err := scim.NewRepository(authTable).CreateTenant(input.Name, input.SAMLEntityID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	detail := map[string]string{
+		"tenant_id": tenant.TenantID,
+	}
+	if tenant.SAMLEntityID != "" {
+		detail["saml_entity_id"] = tenant.SAMLEntityID
+	}
+	recordAction(authTable, request, adminID, audit.TenantCreated, detail)
+
+	return jsonResponse(201, TenantOutput{
+		Tenant: tenant,
+		Token:  token,
+	})
+}
+
+/*
+DELETE /admin/scim-tenants/{id}
+
+The token is revoked, the users provisioned by the tenant are kept
+*/
+func deleteTenant(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantID := request.PathParameters["id"]
+	if err := scim.NewRepository(authTable).DeleteTenant(tenantID); err != nil {
+		if err == scim.ErrNotFound {
+			return response(404, "Tenant not found"), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.TenantDeleted, map[string]string{
+		"tenant_id": tenantID,
+	})
+
+	return response(204, ""), nil
+}
+
+/*
+GET /admin/saml-providers
+
+returns []saml.Provider
+*/
+func listProviders(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	providers, err := saml.NewRepository(authTable).ListProviders()
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, providers)
+}
+
+/*
+POST /admin/saml-providers
+
+expects ProviderInput
+returns saml.Provider
+*/
+func createProvider(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input ProviderInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	if input.EntityID == "" {
+		return response(400, "entity_id is required"), nil
+	}
+	if parsed, err := url.Parse(input.SSOURL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return response(400, "sso_url must be an https URL"), nil
+	}
+	if _, err := saml.ParseCertificate(input.Certificate); err != nil {
+		return response(400, "Invalid certificate: "+err.Error()), nil
+	}
+
+	provider, err := saml.NewRepository(authTable).CreateProvider(saml.Provider{
+		EntityID:    input.EntityID,
+		SSOURL:      input.SSOURL,
+		Certificate: input.Certificate,
+		Attributes:  input.Attributes,
+	})
+	if err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return response(409, "The entity_id is already registered"), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.ProviderCreated, map[string]string{
+		"provider_id": provider.ProviderID,
+		"entity_id":   provider.EntityID,
+	})
+
+	return jsonResponse(201, provider)
+}
+
+/*
+DELETE /admin/saml-providers/{id}
+
+The users of the provider are kept, but can not sign in by SAML
+*/
+func deleteProvider(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	providerID := request.PathParameters["id"]
+	if err := saml.NewRepository(authTable).DeleteProvider(providerID); err != nil {
+		if err == saml.ErrNotFound {
+			return response(404, "Provider not found"), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	adminID := request.RequestContext.Authorizer["id"].(string)
+	recordAction(authTable, request, adminID, audit.ProviderDeleted, map[string]string{
+		"provider_id": providerID,
+	})
+
+	return response(204, ""), nil
+}
+
+// recordAction appends the event to the log of the user with the ID of the acting admin
+func recordAction(authTable dynamo.Table, request events.APIGatewayProxyRequest, userID string, event string, detail map[string]string) {
+	detail["admin_id"] = request.RequestContext.Authorizer["id"].(string)
+
+	if err := audit.NewRepository(authTable).Append(userID, event, "", audit.SourceOf(request), detail); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// The route table of the authorizer checks the scopes, this checks the role in addition
+	// Service tokens of confidential clients have no role, their scopes are limited to authz.ServiceScopes
+	role, _ := request.RequestContext.Authorizer["role"].(string)
+	subjectType, _ := request.RequestContext.Authorizer["subject_type"].(string)
+	if role != authz.RoleAdmin && subjectType != jwt.SubjectService {
+		return response(403, "Forbidden"), nil
+	}
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	switch request.HTTPMethod + " " + request.Resource {
+	case "GET /admin/users":
+		return searchUsers(authTable, request)
+	case "GET /admin/clients":
+		return listClients(authTable, request)
+	case "POST /admin/clients":
+		return createClient(authTable, request)
+	case "DELETE /admin/clients/{id}":
+		return deleteClient(authTable, request)
+	case "GET /admin/webhooks":
+		return listWebhooks(authTable, request)
+	case "POST /admin/webhooks":
+		return createWebhook(authTable, request)
+	case "DELETE /admin/webhooks/{id}":
+		return deleteWebhook(authTable, request)
+	case "POST /admin/webhooks/{id}/enable":
+		return enableWebhook(authTable, request)
+	case "GET /admin/webhooks/{id}/deliveries":
+		return listDeliveries(authTable, request)
+	case "GET /admin/scim-tenants":
+		return listTenants(authTable, request)
+	case "POST /admin/scim-tenants":
+		return createTenant(authTable, request)
+	case "DELETE /admin/scim-tenants/{id}":
+		return deleteTenant(authTable, request)
+	case "GET /admin/saml-providers":
+		return listProviders(authTable, request)
+	case "POST /admin/saml-providers":
+		return createProvider(authTable, request)
+	case "DELETE /admin/saml-providers/{id}":
+		return deleteProvider(authTable, request)
+	}
+	if !strings.HasPrefix(request.Resource, "/admin/users/") {
+		return response(404, "Not Found"), nil
+	}
+
+	var userInfo user.UserInfo
+	if err := user.NewRepository(authTable).Get(request.PathParameters["id"], &userInfo); err != nil {
+		if err == dynamo.ErrNotFound {
+			return response(404, "User not found"), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	switch request.HTTPMethod + " " + request.Resource {
+	case "GET /admin/users/{id}":
+		return getUser(authTable, userInfo)
+	case "DELETE /admin/users/{id}":
+		return deleteUser(authTable, userInfo, request)
+	case "PUT /admin/users/{id}/name":
+		return renameUser(db, authTable, userInfo, request)
+	case "POST /admin/users/{id}/suspend":
+		return suspendUser(authTable, userInfo, request)
+	case "POST /admin/users/{id}/unsuspend":
+		return unsuspendUser(authTable, userInfo, request)
+	case "POST /admin/users/{id}/unlock":
+		return unlockUser(authTable, userInfo, request)
+	case "DELETE /admin/users/{id}/sessions":
+		return revokeSessions(authTable, userInfo, request)
+	}
+
+	return response(404, "Not Found"), nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -4,54 +4,290 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
 
+	"github.com/portals-me/account/lib/authz"
 	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/oauth"
+	sessionlib "github.com/portals-me/account/lib/session"
+	"github.com/portals-me/account/lib/token"
+	"github.com/portals-me/account/lib/user"
 )
 
 var jwtPrivateKey = os.Getenv("jwtPrivateKey")
+var authTableName = os.Getenv("authTable")
 
-func generatePolicy(principalID, effect, resource string, context map[string]interface{}) events.APIGatewayCustomAuthorizerResponse {
+// routeArn builds the ARN of the route from the ARN of the requested method
+// methodArn: arn:aws:execute-api:{region}:{account}:{api}/{stage}/{method}/{path}
+// Path parameters are replaced with wildcards
+func routeArn(methodArn string, route authz.Route) string {
+	parts := strings.SplitN(methodArn, "/", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	segments := strings.Split(route.Resource, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			segments[i] = "*"
+		}
+	}
+
+	return parts[0] + "/" + parts[1] + "/" + route.Method + strings.Join(segments, "/")
+}
+
+// generatePolicy allows the routes covered by the scopes and denies the others
+// The policy covers every route, not only methodArn, so that the decision stays correct if caching is enabled
+// Caching is disabled (authorizerResultTtlInSeconds: 0) since revoked sessions and suspensions must take effect at once
+func generatePolicy(principalID string, methodArn string, scopes []string, context map[string]interface{}) events.APIGatewayCustomAuthorizerResponse {
 	authResponse := events.APIGatewayCustomAuthorizerResponse{PrincipalID: principalID}
 
-	if effect != "" && resource != "" {
-		authResponse.PolicyDocument = events.APIGatewayCustomAuthorizerPolicy{
-			Version: "2012-10-17",
-			Statement: []events.IAMPolicyStatement{
-				{
-					Action:   []string{"execute-api:Invoke"},
-					Effect:   effect,
-					Resource: []string{resource},
-				},
-			},
+	allowed := []string{}
+	denied := []string{}
+	for _, route := range authz.Routes {
+		resource := routeArn(methodArn, route)
+		if resource == "" {
+			continue
+		}
+
+		if authz.Has(scopes, route.Scope) {
+			allowed = append(allowed, resource)
+		} else {
+			denied = append(denied, resource)
 		}
 	}
 
+	statements := []events.IAMPolicyStatement{}
+	if len(allowed) != 0 {
+		statements = append(statements, events.IAMPolicyStatement{
+			Action:   []string{"execute-api:Invoke"},
+			Effect:   "Allow",
+			Resource: allowed,
+		})
+	}
+	if len(denied) != 0 {
+		statements = append(statements, events.IAMPolicyStatement{
+			Action:   []string{"execute-api:Invoke"},
+			Effect:   "Deny",
+			Resource: denied,
+		})
+	}
+
+	authResponse.PolicyDocument = events.APIGatewayCustomAuthorizerPolicy{
+		Version:   "2012-10-17",
+		Statement: statements,
+	}
 	authResponse.Context = context
 	return authResponse
 }
 
-func handler(ctx context.Context, request events.APIGatewayCustomAuthorizerRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
-	token := strings.TrimPrefix(request.AuthorizationToken, "Bearer ")
+// ensureActive rejects tokens of suspended or deleted users
+func ensureActive(authTable dynamo.Table, userID string, userInfo *user.UserInfo) error {
+	if userInfo == nil {
+		userInfo = &user.UserInfo{}
+	}
+
+	userRepo := user.NewRepository(authTable)
+	if err := userRepo.Get(userID, userInfo); err != nil {
+		if err == dynamo.ErrNotFound {
+			return errors.New("Unauthorized")
+		}
+
+		return err
+	}
+
+	if err := userRepo.EnsureActive(userInfo); err != nil {
+		if err == user.ErrSuspended || err == user.ErrPendingDeletion {
+			return errors.New("Unauthorized")
+		}
 
+		return err
+	}
+
+	return nil
+}
+
+// authorizeJwt verifies the JWT issued by signin and returns the authorizer context
+func authorizeJwt(authTable dynamo.Table, token string) (map[string]interface{}, error) {
 	signer := jwt.ES256Signer{
 		Key: jwtPrivateKey,
 	}
-	verified, err := signer.Verify([]byte(token))
+	payload, err := signer.VerifyPayload([]byte(token))
+	if err != nil {
+		return nil, errors.New("Unauthorized")
+	}
+
+	// Access tokens revoked by /revoke
+	revoked, err := oauth.NewRepository(authTable).IsAccessTokenRevoked(payload.JWTID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("Unauthorized")
+	}
+
+	if payload.SubjectType == jwt.SubjectService {
+		return authorizeService(authTable, payload)
+	}
+
+	var user map[string]interface{}
+	if err := json.Unmarshal(payload.Data, &user); err != nil {
+		return nil, errors.New("Unauthorized")
+	}
+
+	if err := ensureActive(authTable, user["id"].(string), nil); err != nil {
+		return nil, err
+	}
+
+	sessionRepo := sessionlib.NewRepository(authTable)
+
+	// Tokens issued before the password change (or sign-out from all devices) are rejected,
+	// by the deleted session if the token has sid, otherwise by the revocation marker
+	// Tokens issued before sessions were introduced, and the tokens of OAuth clients, do not have sid
+	if payload.SessionID == "" {
+		revoked, err = sessionRepo.IsRevoked(user["id"].(string), time.Unix(payload.IssuedAt, 0))
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errors.New("Unauthorized")
+		}
+	} else {
+		var current sessionlib.Session
+		if err := sessionRepo.Get(user["id"].(string), payload.SessionID, &current); err != nil {
+			if err == sessionlib.ErrNotFound {
+				return nil, errors.New("Unauthorized")
+			}
+
+			return nil, err
+		}
+
+		if err := sessionRepo.Touch(current); err != nil {
+			fmt.Printf("Touch: %+v\n", err.Error())
+		}
+
+		user["sid"] = payload.SessionID
+	}
+
+	// Tokens issued before roles were introduced do not have role and scope claims
+	scopes := authz.SplitScopes(payload.Scope)
+	if payload.Role == "" {
+		scopes = authz.RoleScopes[authz.RoleUser]
+	}
+	user["role"] = authz.RoleOf(payload.Role)
+	user["scopes"] = authz.JoinScopes(scopes)
+	user["subject_type"] = jwt.SubjectUser
+
+	// Tokens issued to OAuth clients by /oauth/token
+	if payload.ClientID != "" {
+		user["client_id"] = payload.ClientID
+	}
+
+	return user, nil
+}
+
+// authorizePersonalAccessToken verifies the token created via /self/tokens and returns the authorizer context
+func authorizePersonalAccessToken(authTable dynamo.Table, raw string) (map[string]interface{}, error) {
+	tokenRepo := token.NewRepository(authTable)
+
+	var pat token.PersonalAccessToken
+	if err := tokenRepo.Verify(raw, &pat); err != nil {
+		if err == token.ErrInvalidToken {
+			return nil, errors.New("Unauthorized")
+		}
+
+		return nil, err
+	}
+
+	var userInfo user.UserInfo
+	if err := ensureActive(authTable, pat.ID, &userInfo); err != nil {
+		return nil, err
+	}
+
+	// Tokens created before the password change (or sign-out from all devices) are rejected
+	revoked, err := sessionlib.NewRepository(authTable).IsRevoked(pat.ID, pat.CreatedAt)
 	if err != nil {
-		return events.APIGatewayCustomAuthorizerResponse{}, errors.New("Unauthorized")
+		return nil, err
 	}
+	if revoked {
+		return nil, errors.New("Unauthorized")
+	}
+
+	if err := tokenRepo.Touch(pat); err != nil {
+		fmt.Printf("Touch: %+v\n", err.Error())
+	}
+
+	// The token can not exceed the current scopes of the account
+	scopes := authz.Intersect(pat.Scopes, authz.EffectiveScopes(userInfo.Role, userInfo.Scopes))
+
+	// Context values must be primitives, scopes are joined by spaces
+	return map[string]interface{}{
+		"id":           userInfo.ID,
+		"name":         userInfo.Name,
+		"picture":      userInfo.Picture,
+		"display_name": userInfo.DisplayName,
+		"email":        userInfo.Email,
+		"role":         authz.RoleOf(userInfo.Role),
+		"token_id":     pat.TokenID,
+		"subject_type": jwt.SubjectUser,
+		"scopes":       authz.JoinScopes(scopes),
+	}, nil
+}
+
+// authorizeService verifies the token issued to a confidential client by the client_credentials grant
+// The id of the context is the client ID, and the token is rejected once the client is deleted
+func authorizeService(authTable dynamo.Table, payload jwt.JwtPayload) (map[string]interface{}, error) {
+	oauthRepo := oauth.NewRepository(authTable)
+
+	client, err := oauthRepo.GetClient(payload.ClientID)
+	if err != nil {
+		if err == oauth.ErrNotFound {
+			return nil, errors.New("Unauthorized")
+		}
+
+		return nil, err
+	}
+
+	// The token can not exceed the current scopes of the client
+	scopes := authz.Intersect(authz.SplitScopes(payload.Scope), authz.Intersect(client.Scopes, authz.ServiceScopes))
+
+	return map[string]interface{}{
+		"id":           client.ClientID,
+		"name":         client.Name,
+		"client_id":    client.ClientID,
+		"subject_type": jwt.SubjectService,
+		"scopes":       authz.JoinScopes(scopes),
+	}, nil
+}
+
+func handler(ctx context.Context, request events.APIGatewayCustomAuthorizerRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	raw := strings.TrimPrefix(request.AuthorizationToken, "Bearer ")
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
 
 	var user map[string]interface{}
-	if err := json.Unmarshal(verified, &user); err != nil {
-		return events.APIGatewayCustomAuthorizerResponse{}, errors.New("Unauthorized")
+	var err error
+	if token.IsPersonalAccessToken(raw) {
+		user, err = authorizePersonalAccessToken(authTable, raw)
+	} else {
+		user, err = authorizeJwt(authTable, raw)
+	}
+	if err != nil {
+		return events.APIGatewayCustomAuthorizerResponse{}, err
 	}
 
-	return generatePolicy(user["id"].(string), "Allow", request.MethodArn, user), err
+	return generatePolicy(user["id"].(string), request.MethodArn, authz.SplitScopes(user["scopes"].(string)), user), nil
 }
 
 func main() {
@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/oauth"
+	sessionlib "github.com/portals-me/account/lib/session"
+	tokenlib "github.com/portals-me/account/lib/token"
+	"github.com/portals-me/account/lib/user"
+)
+
+var authTableName = os.Getenv("authTable")
+var jwtPrivateKey = os.Getenv("jwtPrivate")
+
+// URL of the provider, derived from the request if empty
+var issuerURL = os.Getenv("oidcIssuer")
+
+// Consent page of the web app, advertised as the authorization endpoint
+var authorizationPage = os.Getenv("oauthAuthorizationPage")
+
+type ConsentOutput struct {
+	Client oauth.Client `json:"client"`
+	Scopes []string     `json:"scopes"`
+	// false if the user has approved the scopes before, the page may skip asking
+	ConsentRequired bool `json:"consent_required"`
+}
+
+type ConsentInput struct {
+	oauth.AuthorizationRequest
+	Approved bool `json:"approved"`
+}
+
+// The web app navigates to RedirectTo to return to the client
+type RedirectOutput struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// AuthorizeError has RedirectTo if the error can be returned to the client
+type AuthorizeError struct {
+	oauth.Error
+	RedirectTo string `json:"redirect_to,omitempty"`
+}
+
+// IntrospectionOutput is the response of RFC 7662, only active is set for the tokens not in use
+// token_type is Bearer for the access tokens (including personal access tokens) and Refresh for the refresh tokens
+type IntrospectionOutput struct {
+	Active      bool           `json:"active"`
+	Scope       string         `json:"scope,omitempty"`
+	ClientID    string         `json:"client_id,omitempty"`
+	Username    string         `json:"username,omitempty"`
+	TokenType   string         `json:"token_type,omitempty"`
+	ExpiresAt   int64          `json:"exp,omitempty"`
+	IssuedAt    int64          `json:"iat,omitempty"`
+	Subject     string         `json:"sub,omitempty"`
+	SubjectType string         `json:"sub_type,omitempty"`
+	TokenID     string         `json:"jti,omitempty"`
+	User        *user.UserInfo `json:"user,omitempty"`
+}
+
+type TokenOutput struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: statusCode,
+	}
+}
+
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(statusCode, string(raw)), nil
+}
+
+// tokenResponse must not be cached, RFC 6749 5.1
+func tokenResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	resp, err := jsonResponse(statusCode, body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	resp.Headers["Cache-Control"] = "no-store"
+	resp.Headers["Pragma"] = "no-cache"
+	return resp, nil
+}
+
+// headerOf finds the header case-insensitively
+func headerOf(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+func issuerOf(request events.APIGatewayProxyRequest) string {
+	if issuerURL != "" {
+		return strings.TrimSuffix(issuerURL, "/")
+	}
+
+	return "https://" + headerOf(request, "Host") + "/" + request.RequestContext.Stage
+}
+
+// getActiveUser returns false if the user does not exist or is not active
+func getActiveUser(authTable dynamo.Table, userID string, userInfo *user.UserInfo) (bool, error) {
+	userRepo := user.NewRepository(authTable)
+	if err := userRepo.Get(userID, userInfo); err != nil {
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if err := userRepo.EnsureActive(userInfo); err != nil {
+		if err == user.ErrSuspended || err == user.ErrPendingDeletion {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// -- Authorization --
+
+// validateAuthorization checks the client and the redirect URI first, the errors of them must not be redirected
+func validateAuthorization(authTable dynamo.Table, authRequest oauth.AuthorizationRequest) (oauth.Client, *AuthorizeError, error) {
+	client, err := oauth.NewRepository(authTable).GetClient(authRequest.ClientID)
+	if err != nil {
+		if err == oauth.ErrNotFound {
+			return oauth.Client{}, &AuthorizeError{
+				Error: *oauth.NewError("invalid_request", "Unknown client_id"),
+			}, nil
+		}
+
+		return oauth.Client{}, nil, err
+	}
+	if !client.AllowsRedirect(authRequest.RedirectURI) {
+		return oauth.Client{}, &AuthorizeError{
+			Error: *oauth.NewError("invalid_request", "redirect_uri is not registered"),
+		}, nil
+	}
+
+	oerr := authRequest.Validate()
+	if oerr == nil && !client.AllowsGrant(oauth.GrantAuthorizationCode) {
+		oerr = oauth.NewError("unauthorized_client", "The client can not use the authorization code")
+	}
+	if oerr == nil && !client.AllowsScopes(authz.SplitScopes(authRequest.Scope)) {
+		oerr = oauth.NewError("invalid_scope", "The scope is not allowed for the client")
+	}
+	if oerr != nil {
+		return oauth.Client{}, &AuthorizeError{
+			Error:      *oerr,
+			RedirectTo: authRequest.RedirectError(oerr),
+		}, nil
+	}
+
+	return client, nil, nil
+}
+
+// isFirstParty rejects personal access tokens and tokens of OAuth clients, only the user can give the consent
+func isFirstParty(request events.APIGatewayProxyRequest) bool {
+	if tokenID, _ := request.RequestContext.Authorizer["token_id"].(string); tokenID != "" {
+		return false
+	}
+	if clientID, _ := request.RequestContext.Authorizer["client_id"].(string); clientID != "" {
+		return false
+	}
+
+	return true
+}
+
+/*
+GET /oauth/authorize?response_type=code&client_id=<client_id>&redirect_uri=<uri>&scope=<scope>&state=<state>&nonce=<nonce>&code_challenge=<challenge>&code_challenge_method=S256
+
+returns ConsentOutput, or AuthorizeError with 400
+*/
+func describeAuthorization(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	params := request.QueryStringParameters
+	authRequest := oauth.AuthorizationRequest{
+		ResponseType:        params["response_type"],
+		ClientID:            params["client_id"],
+		RedirectURI:         params["redirect_uri"],
+		Scope:               params["scope"],
+		State:               params["state"],
+		Nonce:               params["nonce"],
+		CodeChallenge:       params["code_challenge"],
+		CodeChallengeMethod: params["code_challenge_method"],
+	}
+
+	client, authErr, err := validateAuthorization(authTable, authRequest)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if authErr != nil {
+		return jsonResponse(400, authErr)
+	}
+
+	scopes, _ := oauth.ParseScope(authRequest.Scope)
+	consent, err := oauth.NewRepository(authTable).GetConsent(request.RequestContext.Authorizer["id"].(string), client.ClientID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, ConsentOutput{
+		Client:          client,
+		Scopes:          scopes,
+		ConsentRequired: !consent.Covers(scopes),
+	})
+}
+
+/*
+POST /oauth/authorize
+
+expects ConsentInput
+returns RedirectOutput with the code or access_denied, or AuthorizeError with 400
+*/
+func authorize(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input ConsentInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	client, authErr, err := validateAuthorization(authTable, input.AuthorizationRequest)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if authErr != nil {
+		return jsonResponse(400, authErr)
+	}
+
+	if !input.Approved {
+		return jsonResponse(200, RedirectOutput{
+			RedirectTo: input.RedirectError(oauth.NewError("access_denied", "The user denied the request")),
+		})
+	}
+
+	userID := request.RequestContext.Authorizer["id"].(string)
+	scopes, _ := oauth.ParseScope(input.Scope)
+
+	// auth_time of the ID token is when the user signed in
+	authTime := time.Now().UTC()
+	if sid, _ := request.RequestContext.Authorizer["sid"].(string); sid != "" {
+		var current sessionlib.Session
+		if err := sessionlib.NewRepository(authTable).Get(userID, sid, &current); err == nil {
+			authTime = current.CreatedAt
+		}
+	}
+
+	repo := oauth.NewRepository(authTable)
+	if err := repo.GrantConsent(userID, client.ClientID, scopes); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	code, err := repo.IssueCode(oauth.AuthorizationCode{
+		ClientID:      client.ClientID,
+		UserID:        userID,
+		RedirectURI:   input.RedirectURI,
+		Scopes:        scopes,
+		Nonce:         input.Nonce,
+		CodeChallenge: input.CodeChallenge,
+		AuthTime:      authTime,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if err := audit.NewRepository(authTable).Append(userID, audit.ConsentGranted, "", audit.SourceOf(request), map[string]string{
+		"client_id": client.ClientID,
+		"scopes":    authz.JoinScopes(scopes),
+	}); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
+	return jsonResponse(200, RedirectOutput{
+		RedirectTo: input.Redirect(url.Values{"code": {code}}),
+	})
+}
+
+// -- Token --
+
+// issueTokens signs the access token and the ID token, and issues a refresh token for offline_access
+func issueTokens(authTable dynamo.Table, request events.APIGatewayProxyRequest, clientID string, userInfo user.UserInfo, scopes []string, authTime time.Time, nonce string) (TokenOutput, error) {
+	signer := jwt.ES256Signer{
+		Key: jwtPrivateKey,
+	}
+
+	payload, err := json.Marshal(userInfo)
+	if err != nil {
+		return TokenOutput{}, err
+	}
+	accessToken, err := signer.SignWithLifetime(payload, jwt.Claims{
+		Role:     authz.RoleOf(userInfo.Role),
+		Scope:    authz.JoinScopes(scopes),
+		ClientID: clientID,
+	}, oauth.AccessTokenLifetime)
+	if err != nil {
+		return TokenOutput{}, err
+	}
+
+	output := TokenOutput{
+		AccessToken: string(accessToken),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(oauth.AccessTokenLifetime.Seconds()),
+		Scope:       authz.JoinScopes(scopes),
+	}
+
+	if authz.Has(scopes, oauth.ScopeOpenID) {
+		output.IDToken, err = oauth.SignIDToken(signer, issuerOf(request), clientID, userInfo, scopes, authTime, nonce)
+		if err != nil {
+			return TokenOutput{}, err
+		}
+	}
+
+	if authz.Has(scopes, oauth.ScopeOfflineAccess) {
+		output.RefreshToken, err = oauth.NewRepository(authTable).IssueRefreshToken(userInfo.ID, clientID, scopes, authTime)
+		if err != nil {
+			return TokenOutput{}, err
+		}
+	}
+
+	return output, nil
+}
+
+var errInvalidClient = oauth.NewError("invalid_client", "Client authentication failed")
+
+func invalidClient() (events.APIGatewayProxyResponse, error) {
+	resp, err := tokenResponse(401, errInvalidClient)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	resp.Headers["WWW-Authenticate"] = `Basic realm="oauth"`
+	return resp, nil
+}
+
+// parseForm of application/x-www-form-urlencoded, API Gateway may encode the body in base64
+func parseForm(request events.APIGatewayProxyRequest) (url.Values, error) {
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(decoded)
+	}
+
+	return url.ParseQuery(body)
+}
+
+// authenticateClient by client_secret_basic or client_secret_post, public clients only send client_id
+func authenticateClient(authTable dynamo.Table, request events.APIGatewayProxyRequest, form url.Values) (oauth.Client, *oauth.Error, error) {
+	clientID := form.Get("client_id")
+	secret := form.Get("client_secret")
+	if authorization := headerOf(request, "Authorization"); strings.HasPrefix(authorization, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+		credentials := strings.SplitN(string(decoded), ":", 2)
+		if err != nil || len(credentials) != 2 {
+			return oauth.Client{}, errInvalidClient, nil
+		}
+
+		// The credentials are form-encoded in the header, RFC 6749 2.3.1
+		clientID, _ = url.QueryUnescape(credentials[0])
+		secret, _ = url.QueryUnescape(credentials[1])
+	}
+	if clientID == "" {
+		return oauth.Client{}, errInvalidClient, nil
+	}
+
+	client, err := oauth.NewRepository(authTable).GetClient(clientID)
+	if err != nil {
+		if err == oauth.ErrNotFound {
+			// Public clients are only identified by client_id, and no grant is issued to an unknown client
+			grantType := form.Get("grant_type")
+			if secret == "" && (grantType == oauth.GrantAuthorizationCode || grantType == oauth.GrantRefreshToken) {
+				return oauth.Client{}, oauth.ErrInvalidGrant, nil
+			}
+
+			return oauth.Client{}, errInvalidClient, nil
+		}
+
+		return oauth.Client{}, nil, err
+	}
+
+	if client.IsConfidential() != (secret != "") || (client.IsConfidential() && !client.VerifySecret(secret)) {
+		return oauth.Client{}, errInvalidClient, nil
+	}
+
+	return client, nil, nil
+}
+
+// exchangeCode is the authorization_code grant with PKCE
+func exchangeCode(authTable dynamo.Table, request events.APIGatewayProxyRequest, client oauth.Client, form url.Values) (events.APIGatewayProxyResponse, error) {
+	for _, param := range []string{"code", "redirect_uri", "code_verifier"} {
+		if form.Get(param) == "" {
+			return tokenResponse(400, oauth.NewError("invalid_request", param+" is required"))
+		}
+	}
+
+	code, err := oauth.NewRepository(authTable).RedeemCode(form.Get("code"))
+	if err != nil {
+		if err == oauth.ErrInvalidGrant {
+			return tokenResponse(400, oauth.ErrInvalidGrant)
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if code.ClientID != client.ClientID || code.RedirectURI != form.Get("redirect_uri") {
+		return tokenResponse(400, oauth.ErrInvalidGrant)
+	}
+	if !oauth.VerifyCodeVerifier(code.CodeChallenge, form.Get("code_verifier")) {
+		return tokenResponse(400, oauth.NewError("invalid_grant", "code_verifier does not match"))
+	}
+
+	var userInfo user.UserInfo
+	active, err := getActiveUser(authTable, code.UserID, &userInfo)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if !active {
+		return tokenResponse(400, oauth.ErrInvalidGrant)
+	}
+
+	output, err := issueTokens(authTable, request, code.ClientID, userInfo, oauth.GrantedScopes(code.Scopes, userInfo), code.AuthTime, code.Nonce)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return tokenResponse(200, output)
+}
+
+// refresh is the refresh_token grant, the scope can be narrowed but not widened
+func refresh(authTable dynamo.Table, request events.APIGatewayProxyRequest, client oauth.Client, form url.Values) (events.APIGatewayProxyResponse, error) {
+	if form.Get("refresh_token") == "" {
+		return tokenResponse(400, oauth.NewError("invalid_request", "refresh_token is required"))
+	}
+
+	refreshToken, err := oauth.NewRepository(authTable).RedeemRefreshToken(form.Get("refresh_token"))
+	if err != nil {
+		if err == oauth.ErrInvalidGrant {
+			return tokenResponse(400, oauth.ErrInvalidGrant)
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if refreshToken.ClientID != client.ClientID {
+		return tokenResponse(400, oauth.ErrInvalidGrant)
+	}
+
+	// Refresh tokens issued before the password change (or sign-out from all devices) are rejected
+	revoked, err := sessionlib.NewRepository(authTable).IsRevoked(refreshToken.ID, refreshToken.CreatedAt)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if revoked {
+		return tokenResponse(400, oauth.ErrInvalidGrant)
+	}
+
+	scopes := refreshToken.Scopes
+	if form.Get("scope") != "" {
+		requested, oerr := oauth.ParseScope(form.Get("scope"))
+		if oerr != nil {
+			return tokenResponse(400, oerr)
+		}
+		if len(authz.Intersect(requested, scopes)) != len(requested) {
+			return tokenResponse(400, oauth.NewError("invalid_scope", "scope exceeds the original grant"))
+		}
+
+		// The refresh token keeps offline_access to be rotated
+		scopes = authz.Intersect(scopes, append(requested, oauth.ScopeOfflineAccess))
+	}
+
+	var userInfo user.UserInfo
+	active, err := getActiveUser(authTable, refreshToken.ID, &userInfo)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if !active {
+		return tokenResponse(400, oauth.ErrInvalidGrant)
+	}
+
+	output, err := issueTokens(authTable, request, refreshToken.ClientID, userInfo, oauth.GrantedScopes(scopes, userInfo), refreshToken.AuthTime, "")
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return tokenResponse(200, output)
+}
+
+// clientCredentials is the client_credentials grant of a backend service, the token acts as the client itself
+func clientCredentials(client oauth.Client, form url.Values) (events.APIGatewayProxyResponse, error) {
+	if !client.IsConfidential() {
+		return tokenResponse(400, oauth.NewError("unauthorized_client", "Public clients can not use client_credentials"))
+	}
+
+	scopes := authz.Intersect(client.Scopes, authz.ServiceScopes)
+	if form.Get("scope") != "" {
+		requested := authz.SplitScopes(form.Get("scope"))
+		for _, scope := range requested {
+			if !authz.Has(scopes, scope) {
+				return tokenResponse(400, oauth.NewError("invalid_scope", "The scope is not allowed for the client: "+scope))
+			}
+		}
+
+		scopes = authz.Intersect(requested, scopes)
+	}
+
+	payload, err := json.Marshal(client)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	signer := jwt.ES256Signer{
+		Key: jwtPrivateKey,
+	}
+	accessToken, err := signer.SignWithLifetime(payload, jwt.Claims{
+		Scope:       authz.JoinScopes(scopes),
+		ClientID:    client.ClientID,
+		SubjectType: jwt.SubjectService,
+	}, oauth.AccessTokenLifetime)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return tokenResponse(200, TokenOutput{
+		AccessToken: string(accessToken),
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(oauth.AccessTokenLifetime.Seconds()),
+		Scope:       authz.JoinScopes(scopes),
+	})
+}
+
+/*
+POST /oauth/token
+
+expects application/x-www-form-urlencoded of RFC 6749
+returns TokenOutput, or oauth.Error with 400 (401 for the client authentication)
+*/
+func token(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	form, err := parseForm(request)
+	if err != nil {
+		return tokenResponse(400, oauth.NewError("invalid_request", "Invalid body"))
+	}
+
+	grantType := form.Get("grant_type")
+	if !authz.Has(oauth.GrantTypes, grantType) {
+		return tokenResponse(400, oauth.NewError("unsupported_grant_type", "Unsupported grant_type: "+grantType))
+	}
+
+	client, oerr, err := authenticateClient(authTable, request, form)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if oerr == errInvalidClient {
+		return invalidClient()
+	}
+	if oerr != nil {
+		return tokenResponse(400, oerr)
+	}
+	if !client.AllowsGrant(grantType) {
+		return tokenResponse(400, oauth.NewError("unauthorized_client", "The client can not use "+grantType))
+	}
+
+	switch grantType {
+	case oauth.GrantAuthorizationCode:
+		return exchangeCode(authTable, request, client, form)
+	case oauth.GrantRefreshToken:
+		return refresh(authTable, request, client, form)
+	}
+
+	return clientCredentials(client, form)
+}
+
+// -- UserInfo --
+
+func unauthorized(description string) events.APIGatewayProxyResponse {
+	resp := response(401, "")
+	resp.Headers["WWW-Authenticate"] = fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, description)
+	return resp
+}
+
+/*
+GET /userinfo
+POST /userinfo
+
+requires an access token with the openid scope
+returns oauth.UserInfoClaims
+*/
+func userInfo(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	raw := strings.TrimPrefix(headerOf(request, "Authorization"), "Bearer ")
+	if raw == "" {
+		resp := response(401, "")
+		resp.Headers["WWW-Authenticate"] = "Bearer"
+		return resp, nil
+	}
+
+	signer := jwt.ES256Signer{
+		Key: jwtPrivateKey,
+	}
+	payload, err := signer.VerifyPayload([]byte(raw))
+	if err != nil {
+		return unauthorized("Invalid or expired token"), nil
+	}
+
+	scopes := authz.SplitScopes(payload.Scope)
+	if !authz.Has(scopes, oauth.ScopeOpenID) {
+		resp := response(403, "")
+		resp.Headers["WWW-Authenticate"] = `Bearer error="insufficient_scope", scope="openid"`
+		return resp, nil
+	}
+
+	var claims user.UserInfo
+	if err := json.Unmarshal(payload.Data, &claims); err != nil {
+		return unauthorized("Invalid token"), nil
+	}
+
+	revoked, err := oauth.NewRepository(authTable).IsAccessTokenRevoked(payload.JWTID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if !revoked {
+		revoked, err = sessionlib.NewRepository(authTable).IsRevoked(claims.ID, time.Unix(payload.IssuedAt, 0))
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
+	if revoked {
+		return unauthorized("Revoked token"), nil
+	}
+
+	// The claims are read from the current profile, not from the token
+	var current user.UserInfo
+	active, err := getActiveUser(authTable, claims.ID, &current)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if !active {
+		return unauthorized("Inactive account"), nil
+	}
+
+	return jsonResponse(200, oauth.ClaimsOf(current, scopes))
+}
+
+// -- Discovery --
+
+/*
+GET /.well-known/openid-configuration
+
+returns oauth.ProviderMetadata
+*/
+func discovery(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(200, oauth.Discovery(issuerOf(request), authorizationPage))
+}
+
+/*
+GET /.well-known/jwks.json
+
+returns the JWK Set of the signing key
+*/
+func jwks(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	key, err := jwt.ES256Signer{
+		Key: jwtPrivateKey,
+	}.PublicJWK()
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, map[string][]jwt.JWK{
+		"keys": {key},
+	})
+}
+
+// -- Introspection and Revocation --
+
+var inactive = IntrospectionOutput{
+	Active: false,
+}
+
+// withUser fills the subject of the user token
+func withUser(output IntrospectionOutput, userInfo user.UserInfo) IntrospectionOutput {
+	output.Subject = userInfo.ID
+	output.SubjectType = jwt.SubjectUser
+	output.Username = userInfo.Name
+	output.User = &userInfo
+	return output
+}
+
+// introspectJwt checks the signin tokens, the access tokens and the service tokens as the authorizer does
+func introspectJwt(authTable dynamo.Table, raw string) (IntrospectionOutput, error) {
+	signer := jwt.ES256Signer{
+		Key: jwtPrivateKey,
+	}
+	payload, err := signer.VerifyPayload([]byte(raw))
+	if err != nil {
+		return inactive, nil
+	}
+
+	oauthRepo := oauth.NewRepository(authTable)
+	revoked, err := oauthRepo.IsAccessTokenRevoked(payload.JWTID)
+	if err != nil {
+		return IntrospectionOutput{}, err
+	}
+	if revoked {
+		return inactive, nil
+	}
+
+	output := IntrospectionOutput{
+		Active:    true,
+		ClientID:  payload.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: payload.ExpirationTime,
+		IssuedAt:  payload.IssuedAt,
+		TokenID:   payload.JWTID,
+	}
+
+	if payload.SubjectType == jwt.SubjectService {
+		client, err := oauthRepo.GetClient(payload.ClientID)
+		if err != nil {
+			if err == oauth.ErrNotFound {
+				return inactive, nil
+			}
+
+			return IntrospectionOutput{}, err
+		}
+
+		output.Subject = client.ClientID
+		output.SubjectType = jwt.SubjectService
+		output.Scope = authz.JoinScopes(authz.Intersect(authz.SplitScopes(payload.Scope), authz.Intersect(client.Scopes, authz.ServiceScopes)))
+		return output, nil
+	}
+
+	var claims user.UserInfo
+	if err := json.Unmarshal(payload.Data, &claims); err != nil {
+		return inactive, nil
+	}
+
+	// The session of the token is deleted by the revocation, the marker is for the tokens without sid
+	sessionRepo := sessionlib.NewRepository(authTable)
+	if payload.SessionID != "" {
+		var current sessionlib.Session
+		if err := sessionRepo.Get(claims.ID, payload.SessionID, &current); err != nil {
+			if err == sessionlib.ErrNotFound {
+				return inactive, nil
+			}
+
+			return IntrospectionOutput{}, err
+		}
+	} else {
+		revoked, err = sessionRepo.IsRevoked(claims.ID, time.Unix(payload.IssuedAt, 0))
+		if err != nil {
+			return IntrospectionOutput{}, err
+		}
+		if revoked {
+			return inactive, nil
+		}
+	}
+
+	var userInfo user.UserInfo
+	active, err := getActiveUser(authTable, claims.ID, &userInfo)
+	if err != nil {
+		return IntrospectionOutput{}, err
+	}
+	if !active {
+		return inactive, nil
+	}
+
+	// Tokens issued before roles were introduced do not have role and scope claims
+	scopes := authz.SplitScopes(payload.Scope)
+	if payload.Role == "" {
+		scopes = authz.RoleScopes[authz.RoleUser]
+	}
+	output.Scope = authz.JoinScopes(scopes)
+
+	return withUser(output, userInfo), nil
+}
+
+func introspectPersonalAccessToken(authTable dynamo.Table, raw string) (IntrospectionOutput, error) {
+	var pat tokenlib.PersonalAccessToken
+	if err := tokenlib.NewRepository(authTable).Verify(raw, &pat); err != nil {
+		if err == tokenlib.ErrInvalidToken {
+			return inactive, nil
+		}
+
+		return IntrospectionOutput{}, err
+	}
+
+	var userInfo user.UserInfo
+	active, err := getActiveUser(authTable, pat.ID, &userInfo)
+	if err != nil {
+		return IntrospectionOutput{}, err
+	}
+	if !active {
+		return inactive, nil
+	}
+
+	return withUser(IntrospectionOutput{
+		Active:    true,
+		Scope:     authz.JoinScopes(authz.Intersect(pat.Scopes, authz.EffectiveScopes(userInfo.Role, userInfo.Scopes))),
+		TokenType: "Bearer",
+		ExpiresAt: pat.ExpiresAt.Unix(),
+		IssuedAt:  pat.CreatedAt.Unix(),
+		TokenID:   pat.TokenID,
+	}, userInfo), nil
+}
+
+func introspectRefreshToken(authTable dynamo.Table, raw string) (IntrospectionOutput, error) {
+	refreshToken, err := oauth.NewRepository(authTable).GetRefreshToken(raw)
+	if err != nil {
+		if err == oauth.ErrInvalidGrant {
+			return inactive, nil
+		}
+
+		return IntrospectionOutput{}, err
+	}
+
+	revoked, err := sessionlib.NewRepository(authTable).IsRevoked(refreshToken.ID, refreshToken.CreatedAt)
+	if err != nil {
+		return IntrospectionOutput{}, err
+	}
+	if revoked {
+		return inactive, nil
+	}
+
+	var userInfo user.UserInfo
+	active, err := getActiveUser(authTable, refreshToken.ID, &userInfo)
+	if err != nil {
+		return IntrospectionOutput{}, err
+	}
+	if !active {
+		return inactive, nil
+	}
+
+	return withUser(IntrospectionOutput{
+		Active:    true,
+		Scope:     authz.JoinScopes(oauth.GrantedScopes(refreshToken.Scopes, userInfo)),
+		ClientID:  refreshToken.ClientID,
+		TokenType: "Refresh",
+		ExpiresAt: refreshToken.ExpiresAt.Unix(),
+		IssuedAt:  refreshToken.CreatedAt.Unix(),
+		TokenID:   refreshToken.TokenID,
+	}, userInfo), nil
+}
+
+/*
+POST /introspect
+
+expects application/x-www-form-urlencoded of RFC 7662, authenticated as a confidential client
+returns IntrospectionOutput for any token issued by this API
+*/
+func introspect(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	form, err := parseForm(request)
+	if err != nil {
+		return tokenResponse(400, oauth.NewError("invalid_request", "Invalid body"))
+	}
+
+	client, oerr, err := authenticateClient(authTable, request, form)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	// The response reveals the user of the token, public clients have no secret to prove themselves
+	if oerr != nil || !client.IsConfidential() {
+		return invalidClient()
+	}
+
+	raw := form.Get("token")
+	if raw == "" {
+		return tokenResponse(400, oauth.NewError("invalid_request", "token is required"))
+	}
+
+	var output IntrospectionOutput
+	if tokenlib.IsPersonalAccessToken(raw) {
+		output, err = introspectPersonalAccessToken(authTable, raw)
+	} else if strings.HasPrefix(raw, oauth.RefreshTokenPrefix) {
+		output, err = introspectRefreshToken(authTable, raw)
+	} else {
+		output, err = introspectJwt(authTable, raw)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return tokenResponse(200, output)
+}
+
+/*
+POST /revoke
+
+expects application/x-www-form-urlencoded of RFC 7009, authenticated as the client
+Only the tokens issued to the client are revoked, the others are ignored with 200
+*/
+func revoke(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	form, err := parseForm(request)
+	if err != nil {
+		return tokenResponse(400, oauth.NewError("invalid_request", "Invalid body"))
+	}
+
+	client, oerr, err := authenticateClient(authTable, request, form)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if oerr != nil {
+		return invalidClient()
+	}
+
+	raw := form.Get("token")
+	if raw == "" {
+		return tokenResponse(400, oauth.NewError("invalid_request", "token is required"))
+	}
+
+	oauthRepo := oauth.NewRepository(authTable)
+
+	// Personal access tokens are revoked by the user at /self/tokens
+	if tokenlib.IsPersonalAccessToken(raw) {
+		return response(200, ""), nil
+	}
+
+	if strings.HasPrefix(raw, oauth.RefreshTokenPrefix) {
+		refreshToken, err := oauthRepo.GetRefreshToken(raw)
+		if err != nil {
+			if err == oauth.ErrInvalidGrant {
+				return response(200, ""), nil
+			}
+
+			return events.APIGatewayProxyResponse{}, err
+		}
+		if refreshToken.ClientID != client.ClientID {
+			return response(200, ""), nil
+		}
+
+		if err := oauthRepo.RevokeRefreshToken(refreshToken); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		if err := audit.NewRepository(authTable).Append(refreshToken.ID, audit.TokenRevoked, "", audit.SourceOf(request), map[string]string{
+			"client_id": client.ClientID,
+			"token_id":  refreshToken.TokenID,
+		}); err != nil {
+			fmt.Printf("Audit: %+v\n", err.Error())
+		}
+
+		return response(200, ""), nil
+	}
+
+	signer := jwt.ES256Signer{
+		Key: jwtPrivateKey,
+	}
+	payload, err := signer.VerifyPayload([]byte(raw))
+	if err != nil || payload.ClientID != client.ClientID || payload.JWTID == "" {
+		return response(200, ""), nil
+	}
+
+	// The access token is denied until it expires
+	if err := oauthRepo.RevokeAccessToken(payload.JWTID, client.ClientID, payload.ExpirationTime); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(200, ""), nil
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	switch request.HTTPMethod + " " + request.Resource {
+	case "GET /oauth/authorize", "POST /oauth/authorize":
+		if !isFirstParty(request) {
+			return response(403, "The consent must be given with a signin token"), nil
+		}
+		if request.HTTPMethod == "GET" {
+			return describeAuthorization(authTable, request)
+		}
+
+		return authorize(authTable, request)
+	case "POST /oauth/token":
+		return token(authTable, request)
+	case "GET /userinfo", "POST /userinfo":
+		return userInfo(authTable, request)
+	case "POST /introspect":
+		return introspect(authTable, request)
+	case "POST /revoke":
+		return revoke(authTable, request)
+	case "GET /.well-known/openid-configuration":
+		return discovery(request)
+	case "GET /.well-known/jwks.json":
+		return jwks(request)
+	}
+
+	return response(404, "Not Found"), nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/notify"
+	"github.com/portals-me/account/lib/passhash"
+	"github.com/portals-me/account/lib/passpolicy"
+	"github.com/portals-me/account/lib/password"
+	sessionlib "github.com/portals-me/account/lib/session"
+	"github.com/portals-me/account/lib/user"
+)
+
+var authTableName = os.Getenv("authTable")
+var notifierKind = os.Getenv("passwordResetNotifier")
+var resetURL = os.Getenv("passwordResetURL")
+var mailSource = os.Getenv("mailSource")
+var passwordPolicy = passpolicy.FromEnv()
+var notifier notify.Notifier
+
+const resetTokenTTL = time.Hour
+
+type ChangeInput struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ResetRequestInput struct {
+	UserName string `json:"user_name"`
+}
+
+type ResetConfirmInput struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: statusCode,
+	}
+}
+
+// hashPassword checks the policy of the new password and hashes it
+func hashPassword(authTable dynamo.Table, userID string, newPassword string) (string, *events.APIGatewayProxyResponse, error) {
+	var userInfo user.UserInfo
+	if err := user.NewRepository(authTable).Get(userID, &userInfo); err != nil {
+		return "", nil, err
+	}
+
+	if err := passwordPolicy.Check(newPassword, userInfo); err != nil {
+		if policyErr, ok := err.(passpolicy.Error); ok {
+			resp := response(400, policyErr.JSON())
+			return "", &resp, nil
+		}
+
+		return "", nil, err
+	}
+
+	hash, err := passhash.Hash(newPassword)
+	if err != nil {
+		resp := response(400, err.Error())
+		return "", &resp, nil
+	}
+
+	return hash, nil, nil
+}
+
+// setPassword replaces the hash and signs the user out from every device
+// event string: audit.PasswordChanged or audit.PasswordReset
+func setPassword(authTable dynamo.Table, record password.Record, hash string, event string, source audit.Source) error {
+	if err := password.NewRepository(authTable).UpdateHash(record, hash); err != nil {
+		return err
+	}
+
+	if err := sessionlib.NewRepository(authTable).RevokeAll(record.ID); err != nil {
+		return err
+	}
+
+	auditRepo := audit.NewRepository(authTable)
+	if err := auditRepo.Append(record.ID, event, "password", source, nil); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+	if err := auditRepo.Append(record.ID, audit.TokenRevoked, "", source, map[string]string{
+		"scope": "all",
+	}); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
+	return nil
+}
+
+/*
+POST /self/password
+
+expects ChangeInput
+*/
+func changePassword(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input ChangeInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	var record password.Record
+	if err := password.NewRepository(authTable).Get(request.RequestContext.Authorizer["id"].(string), &record); err != nil {
+		return response(400, "Password is not set for this account"), nil
+	}
+
+	if err := passhash.Verify(record.CheckData, input.CurrentPassword); err != nil {
+		return response(403, "Invalid Password"), nil
+	}
+
+	hash, resp, err := hashPassword(authTable, record.ID, input.NewPassword)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if resp != nil {
+		return *resp, nil
+	}
+
+	if err := setPassword(authTable, record, hash, audit.PasswordChanged, audit.SourceOf(request)); err != nil {
+		fmt.Printf("SetPassword: %+v\n", err.Error())
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(204, ""), nil
+}
+
+/*
+POST /password/reset
+
+expects ResetRequestInput
+always returns 202 so that the existence of the user is not revealed
+*/
+func requestReset(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input ResetRequestInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	passwordRepo := password.NewRepository(authTable)
+
+	var record password.Record
+	if err := passwordRepo.GetByName(input.UserName, &record); err != nil {
+		return response(202, ""), nil
+	}
+
+	var userInfo user.UserInfo
+	if err := user.NewRepository(authTable).Get(record.ID, &userInfo); err != nil {
+		fmt.Printf("Dynamo Get: %+v\n", err.Error())
+		return response(202, ""), nil
+	}
+
+	token, err := passwordRepo.CreateResetToken(record.ID, resetTokenTTL)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if err := notifier.NotifyPasswordReset(userInfo, token); err != nil {
+		fmt.Printf("NotifyPasswordReset: %+v\n", err.Error())
+	}
+
+	return response(202, ""), nil
+}
+
+/*
+POST /password/reset/confirm
+
+expects ResetConfirmInput
+*/
+func confirmReset(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input ResetConfirmInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	passwordRepo := password.NewRepository(authTable)
+
+	userID, err := passwordRepo.GetResetToken(input.Token)
+	if err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	// Validate the new password before the token is consumed
+	hash, resp, err := hashPassword(authTable, userID, input.NewPassword)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if resp != nil {
+		return *resp, nil
+	}
+
+	if _, err := passwordRepo.ConsumeResetToken(input.Token); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	var record password.Record
+	if err := passwordRepo.Get(userID, &record); err != nil {
+		return response(400, "Password is not set for this account"), nil
+	}
+
+	if err := setPassword(authTable, record, hash, audit.PasswordReset, audit.SourceOf(request)); err != nil {
+		fmt.Printf("SetPassword: %+v\n", err.Error())
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(204, ""), nil
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	if request.Resource == "/self/password" {
+		return changePassword(authTable, request)
+	} else if request.Resource == "/password/reset" {
+		return requestReset(authTable, request)
+	} else if request.Resource == "/password/reset/confirm" {
+		return confirmReset(authTable, request)
+	}
+
+	return response(404, "Not Found"), nil
+}
+
+func main() {
+	var err error
+	notifier, err = notify.New(notifierKind, resetURL, mailSource)
+	if err != nil {
+		panic(err)
+	}
+
+	lambda.Start(handler)
+}
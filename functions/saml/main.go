@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/saml"
+)
+
+var authTableName = os.Getenv("authTable")
+var serviceProvider = saml.ServiceProvider{
+	EntityID: os.Getenv("samlEntityID"),
+	ACSURL:   os.Getenv("samlACSURL"),
+}
+
+// The web app navigates to RedirectTo to sign in at the identity provider
+type RedirectOutput struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: statusCode,
+	}
+}
+
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(statusCode, string(raw)), nil
+}
+
+/*
+GET /saml/metadata
+
+returns the metadata of this service provider (XML)
+*/
+func metadata(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	raw, err := serviceProvider.Metadata()
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	resp := response(200, string(raw))
+	resp.Headers["Content-Type"] = "application/samlmetadata+xml"
+	return resp, nil
+}
+
+/*
+GET /saml/login?provider=<id>&relay_state=<state>
+
+returns RedirectOutput, the URL of the identity provider with the AuthnRequest
+The identity provider posts the response to the ACS URL, which signs in with auth_type saml
+*/
+func login(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	provider, err := saml.NewRepository(authTable).GetProvider(request.QueryStringParameters["provider"])
+	if err != nil {
+		if err == saml.ErrNotFound {
+			return response(404, "Provider not found"), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	redirectTo, err := serviceProvider.AuthnRequestURL(provider, request.QueryStringParameters["relay_state"], time.Now())
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return jsonResponse(200, RedirectOutput{
+		RedirectTo: redirectTo,
+	})
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	switch request.HTTPMethod + " " + request.Resource {
+	case "GET /saml/metadata":
+		return metadata(request)
+	case "GET /saml/login":
+		return login(authTable, request)
+	}
+
+	return response(404, "Not Found"), nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/password"
+	"github.com/portals-me/account/lib/saml"
+	"github.com/portals-me/account/lib/scim"
+	sessionlib "github.com/portals-me/account/lib/session"
+	"github.com/portals-me/account/lib/user"
+)
+
+var authTableName = os.Getenv("authTable")
+var allowedDomainPrefix = os.Getenv("domain")
+
+// AuthMethod recorded in the audit log for the changes by the directory
+const AuthMethod = "scim"
+
+// deactivatedReason is the status reason of the users deactivated by the directory
+const deactivatedReason = "Deactivated by the directory"
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+			"Content-Type":                scim.ContentType,
+		},
+		StatusCode: statusCode,
+	}
+}
+
+func jsonResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(statusCode, string(raw)), nil
+}
+
+// errorResponse returns scim.Error as the response, the other errors fail the request
+func errorResponse(err error) (events.APIGatewayProxyResponse, error) {
+	if scimErr, ok := err.(scim.Error); ok {
+		return jsonResponse(scimErr.StatusCode(), scimErr)
+	}
+
+	return events.APIGatewayProxyResponse{}, err
+}
+
+// userResponse with the location and the version of the user
+func userResponse(statusCode int, resource scim.User) (events.APIGatewayProxyResponse, error) {
+	resp, err := jsonResponse(statusCode, resource)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	resp.Headers["Location"] = resource.Meta.Location
+	resp.Headers["ETag"] = resource.Meta.Version
+	return resp, nil
+}
+
+func headerOf(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// baseURL of the SCIM endpoint, for meta.location
+func baseURL(request events.APIGatewayProxyRequest) string {
+	return "https://" + headerOf(request, "Host") + "/" + request.RequestContext.Stage + "/scim/v2"
+}
+
+func locationOf(request events.APIGatewayProxyRequest, userID string) string {
+	return baseURL(request) + "/Users/" + userID
+}
+
+// authenticate the tenant by the bearer token
+func authenticate(authTable dynamo.Table, request events.APIGatewayProxyRequest) (scim.Tenant, error) {
+	raw := strings.TrimPrefix(headerOf(request, "Authorization"), "Bearer ")
+	if !strings.HasPrefix(raw, scim.TokenPrefix) {
+		return scim.Tenant{}, scim.NewError(401, "", "Unauthorized")
+	}
+
+	tenant, err := scim.NewRepository(authTable).Authenticate(raw)
+	if err != nil {
+		if err == scim.ErrInvalidToken {
+			return scim.Tenant{}, scim.NewError(401, "", "Unauthorized")
+		}
+
+		return scim.Tenant{}, err
+	}
+
+	return tenant, nil
+}
+
+// getMember returns the user only if it is provisioned by the tenant, the users of the others are not found
+func getMember(authTable dynamo.Table, tenant scim.Tenant, userID string) (user.UserInfo, scim.Member, error) {
+	member, err := scim.NewRepository(authTable).GetMember(tenant.TenantID, userID)
+	if err != nil {
+		if err == scim.ErrNotFound {
+			return user.UserInfo{}, scim.Member{}, scim.NewError(404, "", "User not found: "+userID)
+		}
+
+		return user.UserInfo{}, scim.Member{}, err
+	}
+
+	var userInfo user.UserInfo
+	if err := user.NewRepository(authTable).Get(userID, &userInfo); err != nil {
+		if err == dynamo.ErrNotFound {
+			return user.UserInfo{}, scim.Member{}, scim.NewError(404, "", "User not found: "+userID)
+		}
+
+		return user.UserInfo{}, scim.Member{}, err
+	}
+
+	return userInfo, member, nil
+}
+
+// validateUser reports the taken userName as uniqueness, and the other invalid fields as invalidValue
+func validateUser(authTable dynamo.Table, userInfo user.UserInfo) error {
+	fieldErrors, err := user.ValidateFields(authTable, userInfo)
+	if err != nil {
+		return err
+	}
+
+	for _, fieldError := range fieldErrors {
+		if fieldError.Code == "already_exists" {
+			return scim.NewError(409, "uniqueness", fieldError.Message)
+		}
+	}
+	if len(fieldErrors) != 0 {
+		return scim.NewError(400, "invalidValue", fieldErrors[0].Message)
+	}
+	if !strings.HasPrefix(userInfo.Picture, allowedDomainPrefix) {
+		return scim.NewError(400, "invalidValue", "Unexpected domain of photos: "+userInfo.Picture)
+	}
+
+	return nil
+}
+
+func recordAction(authTable dynamo.Table, request events.APIGatewayProxyRequest, tenant scim.Tenant, userID string, event string, detail map[string]string) {
+	if detail == nil {
+		detail = map[string]string{}
+	}
+	detail["tenant_id"] = tenant.TenantID
+
+	if err := audit.NewRepository(authTable).Append(userID, event, AuthMethod, audit.SourceOf(request), detail); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+}
+
+// ----------------
+
+/*
+GET /scim/v2/ServiceProviderConfig
+
+returns scim.ServiceProviderConfig
+*/
+func serviceProviderConfig(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(200, scim.Config(baseURL(request)+"/ServiceProviderConfig"))
+}
+
+/*
+GET /scim/v2/Schemas
+
+returns scim.ListResponse of scim.Schema
+*/
+func listSchemas(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return jsonResponse(200, scim.ListResponse{
+		Schemas:      []string{scim.SchemaListResponse},
+		TotalResults: 1,
+		StartIndex:   1,
+		ItemsPerPage: 1,
+		Resources:    []scim.Schema{scim.UserSchema(baseURL(request) + "/Schemas/" + scim.SchemaUser)},
+	})
+}
+
+/*
+GET /scim/v2/Schemas/{id}
+
+returns scim.Schema
+*/
+func getSchema(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.PathParameters["id"] != scim.SchemaUser {
+		return errorResponse(scim.NewError(404, "", "Schema not found: "+request.PathParameters["id"]))
+	}
+
+	return jsonResponse(200, scim.UserSchema(baseURL(request)+"/Schemas/"+scim.SchemaUser))
+}
+
+// -- Users --
+
+// queryInt of the parameter, or the default value if it is not given
+func queryInt(request events.APIGatewayProxyRequest, name string, defaultValue int) (int, error) {
+	raw := request.QueryStringParameters[name]
+	if raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, scim.NewError(400, "invalidValue", "Invalid "+name+": "+raw)
+	}
+
+	return value, nil
+}
+
+/*
+GET /scim/v2/Users?filter=<filter>&startIndex=<startIndex>&count=<count>
+
+returns scim.ListResponse of scim.User, up to scim.MaxResults per page
+*/
+func listUsers(authTable dynamo.Table, tenant scim.Tenant, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	filter, err := scim.ParseFilter(request.QueryStringParameters["filter"])
+	if err != nil {
+		return errorResponse(err)
+	}
+	startIndex, err := queryInt(request, "startIndex", 1)
+	if err != nil {
+		return errorResponse(err)
+	}
+	count, err := queryInt(request, "count", scim.MaxResults)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scim.MaxResults {
+		count = scim.MaxResults
+	}
+
+	members, err := scim.NewRepository(authTable).ListMembers(tenant.TenantID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	// The filter is evaluated on the resources, a tenant is expected to have a moderate number of users
+	resources := []scim.User{}
+	for _, member := range members {
+		var userInfo user.UserInfo
+		if err := user.NewRepository(authTable).Get(member.ID, &userInfo); err != nil {
+			if err == dynamo.ErrNotFound {
+				continue
+			}
+
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		resource := scim.UserOf(userInfo, member, locationOf(request, userInfo.ID))
+		if filter.Match(resource) {
+			resources = append(resources, resource)
+		}
+	}
+
+	page := []scim.User{}
+	if startIndex-1 < len(resources) {
+		page = resources[startIndex-1:]
+	}
+	if len(page) > count {
+		page = page[:count]
+	}
+
+	return jsonResponse(200, scim.ListResponse{
+		Schemas:      []string{scim.SchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+/*
+GET /scim/v2/Users/{id}
+
+returns scim.User
+*/
+func getUser(authTable dynamo.Table, tenant scim.Tenant, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userInfo, member, err := getMember(authTable, tenant, request.PathParameters["id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return userResponse(200, scim.UserOf(userInfo, member, locationOf(request, userInfo.ID)))
+}
+
+/*
+POST /scim/v2/Users
+
+expects scim.User
+returns scim.User with 201
+
+The user has no password, and signs in by the identity provider of the directory
+The picture is <domain>/avatar/default unless photos is given
+*/
+func createUser(authTable dynamo.Table, tenant scim.Tenant, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var resource scim.User
+	if err := json.Unmarshal([]byte(request.Body), &resource); err != nil {
+		return errorResponse(scim.NewError(400, "invalidSyntax", err.Error()))
+	}
+	if err := resource.Validate(); err != nil {
+		return errorResponse(err)
+	}
+
+	userInfo := resource.Apply(user.UserInfo{
+		ID:      uuid.NewV4().String(),
+		Picture: allowedDomainPrefix + "/avatar/default",
+		Role:    authz.RoleUser,
+	})
+	if err := validateUser(authTable, userInfo); err != nil {
+		return errorResponse(err)
+	}
+	if resource.Active != nil && !*resource.Active {
+		userInfo.Status = user.StatusSuspended
+		userInfo.StatusReason = deactivatedReason
+	}
+
+	// The user signs in by the SAML provider of the tenant, the NameID must be free
+	samlRepo := saml.NewRepository(authTable)
+	if tenant.SAMLEntityID != "" {
+		if _, err := samlRepo.LinkedUserID(tenant.SAMLEntityID, userInfo.Name); err != saml.ErrNotFound {
+			if err == nil {
+				return errorResponse(scim.NewError(409, "uniqueness", saml.ErrAlreadyLinked.Error()))
+			}
+
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
+
+	created, err := user.NewRepository(authTable).Create(userInfo)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	member, err := scim.NewRepository(authTable).AddMember(tenant.TenantID, created.ID, resource.ExternalID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if tenant.SAMLEntityID != "" {
+		if err := samlRepo.Link(created.ID, tenant.SAMLEntityID, created.Name); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
+
+	recordAction(authTable, request, tenant, created.ID, audit.Signup, nil)
+
+	return userResponse(201, scim.UserOf(created, member, locationOf(request, created.ID)))
+}
+
+// saveUser replaces the user with the resource
+// The name and the status are changed as the admin API does, the name is the key of the password record
+func saveUser(authTable dynamo.Table, tenant scim.Tenant, userInfo user.UserInfo, member scim.Member, resource scim.User, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := resource.Validate(); err != nil {
+		return errorResponse(err)
+	}
+
+	ifMatch := headerOf(request, "If-Match")
+	if ifMatch != "" && ifMatch != "*" && ifMatch != scim.VersionOf(userInfo) {
+		return errorResponse(scim.NewError(412, "", "The user has been updated"))
+	}
+
+	newUser := resource.Apply(userInfo)
+	if err := validateUser(authTable, newUser); err != nil {
+		return errorResponse(err)
+	}
+
+	// The status is only switched between active and suspended, an account pending deletion is kept
+	suspend := resource.Active != nil && !*resource.Active && userInfo.IsActive()
+	unsuspend := resource.Active != nil && *resource.Active && userInfo.CurrentStatus(time.Now()) == user.StatusSuspended
+	if suspend {
+		newUser.Status = user.StatusSuspended
+		newUser.StatusReason = deactivatedReason
+		newUser.StatusUntil = 0
+	}
+	if unsuspend {
+		newUser.Status = user.StatusActive
+		newUser.StatusReason = ""
+		newUser.StatusUntil = 0
+	}
+
+	userRepo := user.NewRepository(authTable)
+	newName := newUser.Name
+	newUser.Name = userInfo.Name
+	if err := userRepo.Put(&newUser, allowedDomainPrefix); err != nil {
+		if err == user.ErrVersionConflict {
+			return errorResponse(scim.NewError(412, "", "The user has been updated"))
+		}
+
+		return errorResponse(scim.NewError(400, "invalidValue", err.Error()))
+	}
+
+	if newName != userInfo.Name {
+		if err := userRepo.Rename(newUser, newName); err != nil {
+			return errorResponse(scim.NewError(400, "invalidValue", err.Error()))
+		}
+
+		// Password users sign in with the name, and the users of the SAML provider with the name as the NameID
+		if err := password.NewRepository(authTable).Rename(userInfo.ID, newName); err != nil && err != dynamo.ErrNotFound {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		if tenant.SAMLEntityID != "" {
+			if err := saml.NewRepository(authTable).Relink(userInfo.ID, tenant.SAMLEntityID, userInfo.Name, newName); err != nil {
+				if err == saml.ErrAlreadyLinked {
+					return errorResponse(scim.NewError(409, "uniqueness", err.Error()))
+				}
+
+				return events.APIGatewayProxyResponse{}, err
+			}
+		}
+
+		recordAction(authTable, request, tenant, userInfo.ID, audit.NameChanged, map[string]string{
+			"old_name": userInfo.Name,
+			"new_name": newName,
+		})
+	}
+
+	if resource.ExternalID != member.ExternalID {
+		if err := scim.NewRepository(authTable).SetExternalID(member, resource.ExternalID); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		member.ExternalID = resource.ExternalID
+	}
+
+	if newUser.DisplayName != userInfo.DisplayName || newUser.Email != userInfo.Email || newUser.Picture != userInfo.Picture {
+		recordAction(authTable, request, tenant, userInfo.ID, audit.ProfileUpdated, nil)
+	}
+	if suspend {
+		if err := sessionlib.NewRepository(authTable).RevokeAll(userInfo.ID); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		recordAction(authTable, request, tenant, userInfo.ID, audit.Suspended, map[string]string{
+			"reason": deactivatedReason,
+		})
+	}
+	if unsuspend {
+		recordAction(authTable, request, tenant, userInfo.ID, audit.Unsuspended, nil)
+	}
+
+	var saved user.UserInfo
+	if err := userRepo.Get(userInfo.ID, &saved); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return userResponse(200, scim.UserOf(saved, member, locationOf(request, saved.ID)))
+}
+
+/*
+PUT /scim/v2/Users/{id}
+
+expects scim.User
+returns scim.User
+*/
+func replaceUser(authTable dynamo.Table, tenant scim.Tenant, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userInfo, member, err := getMember(authTable, tenant, request.PathParameters["id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	var resource scim.User
+	if err := json.Unmarshal([]byte(request.Body), &resource); err != nil {
+		return errorResponse(scim.NewError(400, "invalidSyntax", err.Error()))
+	}
+
+	return saveUser(authTable, tenant, userInfo, member, resource, request)
+}
+
+/*
+PATCH /scim/v2/Users/{id}
+
+expects scim.PatchOp
+returns scim.User
+*/
+func patchUser(authTable dynamo.Table, tenant scim.Tenant, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userInfo, member, err := getMember(authTable, tenant, request.PathParameters["id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	var patch scim.PatchOp
+	if err := json.Unmarshal([]byte(request.Body), &patch); err != nil {
+		return errorResponse(scim.NewError(400, "invalidSyntax", err.Error()))
+	}
+
+	resource, err := patch.Apply(scim.UserOf(userInfo, member, locationOf(request, userInfo.ID)))
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	return saveUser(authTable, tenant, userInfo, member, resource, request)
+}
+
+/*
+DELETE /scim/v2/Users/{id}
+
+Deprovisions the user, every record of the user is deleted
+The log of the user is deleted together, so the deletion is recorded in the log of the tenant
+*/
+func deleteUser(authTable dynamo.Table, tenant scim.Tenant, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userInfo, _, err := getMember(authTable, tenant, request.PathParameters["id"])
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	if err := user.NewRepository(authTable).Delete(userInfo.ID); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	recordAction(authTable, request, tenant, tenant.TenantID, audit.UserDeleted, map[string]string{
+		"user_id": userInfo.ID,
+		"name":    userInfo.Name,
+	})
+
+	return events.APIGatewayProxyResponse{
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: 204,
+	}, nil
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// The discovery resources do not require the token
+	switch request.HTTPMethod + " " + request.Resource {
+	case "GET /scim/v2/ServiceProviderConfig":
+		return serviceProviderConfig(request)
+	case "GET /scim/v2/Schemas":
+		return listSchemas(request)
+	case "GET /scim/v2/Schemas/{id}":
+		return getSchema(request)
+	}
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	tenant, err := authenticate(authTable, request)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	switch request.HTTPMethod + " " + request.Resource {
+	case "GET /scim/v2/Users":
+		return listUsers(authTable, tenant, request)
+	case "POST /scim/v2/Users":
+		return createUser(authTable, tenant, request)
+	case "GET /scim/v2/Users/{id}":
+		return getUser(authTable, tenant, request)
+	case "PUT /scim/v2/Users/{id}":
+		return replaceUser(authTable, tenant, request)
+	case "PATCH /scim/v2/Users/{id}":
+		return patchUser(authTable, tenant, request)
+	case "DELETE /scim/v2/Users/{id}":
+		return deleteUser(authTable, tenant, request)
+	}
+
+	return errorResponse(scim.NewError(404, "", "Not Found"))
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -12,6 +16,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/guregu/dynamo"
 
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/password"
 	"github.com/portals-me/account/lib/user"
 )
 
@@ -19,10 +25,38 @@ var authTableName = os.Getenv("authTable")
 var allowedDomainPrefix = os.Getenv("domain")
 var userRepo user.Repository
 
-func updateUser(authTable dynamo.Table, oldUser user.UserInfo, newUser user.UserInfo) error {
-	fmt.Printf("%+v\n", oldUser)
-	fmt.Printf("%+v\n", newUser)
+// Fields of PATCH /self, true if the field can be cleared with null
+var patchableFields = map[string]bool{
+	"name":         false,
+	"picture":      false,
+	"display_name": false,
+	"email":        true,
+}
+
+// Fields of the user which can not be changed by the user
+var readOnlyFields = map[string]bool{
+	"id":            true,
+	"role":          true,
+	"scopes":        true,
+	"status":        true,
+	"status_reason": true,
+	"status_until":  true,
+	"created_at":    true,
+	"updated_at":    true,
+	"version":       true,
+}
+
+type FieldErrorsOutput struct {
+	Message string            `json:"message"`
+	Errors  []user.FieldError `json:"errors"`
+}
 
+/*
+PUT /self
+
+Empty fields of newUser are filled with oldUser
+*/
+func updateUser(oldUser user.UserInfo, newUser user.UserInfo) user.UserInfo {
 	newUser.ID = oldUser.ID
 	if newUser.Name == "" {
 		newUser.Name = oldUser.Name
@@ -33,9 +67,161 @@ func updateUser(authTable dynamo.Table, oldUser user.UserInfo, newUser user.User
 	if newUser.DisplayName == "" {
 		newUser.DisplayName = oldUser.DisplayName
 	}
+	if newUser.Email == "" {
+		newUser.Email = oldUser.Email
+	}
+	newUser.Role = oldUser.Role
+	newUser.Scopes = oldUser.Scopes
+	newUser.Status = oldUser.Status
+	newUser.StatusReason = oldUser.StatusReason
+	newUser.StatusUntil = oldUser.StatusUntil
+	newUser.CreatedAt = oldUser.CreatedAt
+
+	return newUser
+}
+
+/*
+PATCH /self
+
+expects JSON Merge Patch (RFC 7396) of the user
+Unknown, read-only and mistyped fields are reported as user.FieldError, the values are validated by Put
+*/
+func patchUser(oldUser user.UserInfo, body string) (user.UserInfo, []user.FieldError, error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &patch); err != nil {
+		return user.UserInfo{}, nil, err
+	}
+	// null is valid JSON but not a patch document of the user
+	if patch == nil {
+		return user.UserInfo{}, nil, errors.New("The patch must be a JSON object")
+	}
+
+	keys := []string{}
+	for key := range patch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	newUser := oldUser
+	fieldErrors := []user.FieldError{}
+	for _, key := range keys {
+		clearable, ok := patchableFields[key]
+		if !ok {
+			if readOnlyFields[key] {
+				fieldErrors = append(fieldErrors, user.FieldError{Field: key, Code: "read_only", Message: "The field can not be changed"})
+			} else {
+				fieldErrors = append(fieldErrors, user.FieldError{Field: key, Code: "unknown_field", Message: "Unknown field"})
+			}
+			continue
+		}
+
+		var value *string
+		if err := json.Unmarshal(patch[key], &value); err != nil {
+			fieldErrors = append(fieldErrors, user.FieldError{Field: key, Code: "invalid_type", Message: "The field must be a string"})
+			continue
+		}
+		if value == nil {
+			if !clearable {
+				fieldErrors = append(fieldErrors, user.FieldError{Field: key, Code: "required", Message: "The field can not be cleared"})
+				continue
+			}
+
+			value = new(string)
+		}
+
+		switch key {
+		case "name":
+			newUser.Name = *value
+		case "picture":
+			newUser.Picture = *value
+		case "display_name":
+			newUser.DisplayName = *value
+		case "email":
+			newUser.Email = *value
+		}
+	}
+
+	return newUser, fieldErrors, nil
+}
+
+// profileChanged reports whether the fields the user can change differ
+func profileChanged(oldUser user.UserInfo, newUser user.UserInfo) bool {
+	return oldUser.Name != newUser.Name ||
+		oldUser.Picture != newUser.Picture ||
+		oldUser.DisplayName != newUser.DisplayName ||
+		oldUser.Email != newUser.Email
+}
+
+func fieldErrorsResponse(fieldErrors []user.FieldError) events.APIGatewayProxyResponse {
+	raw, _ := json.Marshal(FieldErrorsOutput{
+		Message: "Invalid fields",
+		Errors:  fieldErrors,
+	})
+
+	return events.APIGatewayProxyResponse{
+		Body: string(raw),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: 400,
+	}
+}
+
+func etagOf(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETag accepts both strong and weak ETags
+func parseETag(etag string) (int64, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	version, err := strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid If-Match: " + etag)
+	}
+
+	return version, nil
+}
+
+// headerOf finds the header case-insensitively
+func headerOf(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
 
-	if err := userRepo.Put(newUser, allowedDomainPrefix); err != nil {
-		return err
+	return ""
+}
+
+// recordChanges writes the audit log for the profile update
+func recordChanges(authTable dynamo.Table, source audit.Source, oldUser user.UserInfo, newUser user.UserInfo) error {
+	auditRepo := audit.NewRepository(authTable)
+
+	if oldUser.Name != newUser.Name {
+		if err := auditRepo.Append(newUser.ID, audit.NameChanged, "", source, map[string]string{
+			"old_name": oldUser.Name,
+			"new_name": newUser.Name,
+		}); err != nil {
+			return err
+		}
+	}
+
+	fields := []string{}
+	if oldUser.Picture != newUser.Picture {
+		fields = append(fields, "picture")
+	}
+	if oldUser.DisplayName != newUser.DisplayName {
+		fields = append(fields, "display_name")
+	}
+	if oldUser.Email != newUser.Email {
+		fields = append(fields, "email")
+	}
+	if len(fields) != 0 {
+		if err := auditRepo.Append(newUser.ID, audit.ProfileUpdated, "", source, map[string]string{
+			"fields": strings.Join(fields, ","),
+		}); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -48,24 +234,117 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	authTable := db.Table(authTableName)
 	userRepo = user.NewRepository(authTable)
 
-	var userInput user.UserInfo
-	if err := json.Unmarshal([]byte(request.Body), &userInput); err != nil {
+	var oldUser user.UserInfo
+	if err := userRepo.Get(request.RequestContext.Authorizer["id"].(string), &oldUser); err != nil {
+		fmt.Println(err.Error())
+		panic("unreachable")
+	}
+
+	// If-Match is the version (ETag) the client has read, the version just read is expected otherwise
+	version := oldUser.Version
+	ifMatch := headerOf(request, "If-Match")
+	if ifMatch != "" {
+		parsed, err := parseETag(ifMatch)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				Body: err.Error(),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+				StatusCode: 400,
+			}, nil
+		}
+
+		version = parsed
+	}
+
+	var newUser user.UserInfo
+	if request.HTTPMethod == "PATCH" {
+		contentType := headerOf(request, "Content-Type")
+		if contentType != "" && !strings.HasPrefix(contentType, "application/merge-patch+json") && !strings.HasPrefix(contentType, "application/json") {
+			return events.APIGatewayProxyResponse{
+				Body: "Unsupported Content-Type: " + contentType,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+				StatusCode: 415,
+			}, nil
+		}
+
+		patched, fieldErrors, err := patchUser(oldUser, request.Body)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				Body: err.Error(),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+				StatusCode: 400,
+			}, nil
+		}
+		if len(fieldErrors) != 0 {
+			return fieldErrorsResponse(fieldErrors), nil
+		}
+
+		newUser = patched
+	} else {
+		var userInput user.UserInfo
+		if err := json.Unmarshal([]byte(request.Body), &userInput); err != nil {
+			return events.APIGatewayProxyResponse{
+				Body: err.Error(),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+				StatusCode: 400,
+			}, nil
+		}
+
+		newUser = updateUser(oldUser, userInput)
+	}
+
+	// Nothing to write, the version (ETag) is kept
+	if version == oldUser.Version && !profileChanged(oldUser, newUser) {
 		return events.APIGatewayProxyResponse{
-			Body: err.Error(),
 			Headers: map[string]string{
-				"Access-Control-Allow-Origin": "*",
+				"Access-Control-Allow-Origin":   "*",
+				"Access-Control-Expose-Headers": "ETag",
+				"ETag":                          etagOf(oldUser.Version),
 			},
-			StatusCode: 400,
+			StatusCode: 204,
 		}, nil
 	}
 
-	var oldUser user.UserInfo
-	if err := userRepo.Get(request.RequestContext.Authorizer["id"].(string), &oldUser); err != nil {
-		fmt.Println(err.Error())
-		panic("unreachable")
+	// Password users sign in with the name, the password record is moved in the same transaction
+	var tx *dynamo.WriteTx
+	if newUser.Name != oldUser.Name {
+		tx = db.WriteTx()
+		if err := password.NewRepository(authTable).RenameTx(tx, oldUser.ID, newUser.Name); err != nil && err != dynamo.ErrNotFound {
+			return events.APIGatewayProxyResponse{}, err
+		}
 	}
 
-	if err := updateUser(authTable, oldUser, userInput); err != nil {
+	// Put writes newUser only if the record is still at version
+	newUser.Version = version
+	err := userRepo.PutWith(tx, &newUser, allowedDomainPrefix)
+	if err == user.ErrVersionConflict {
+		statusCode := 409
+		if ifMatch != "" {
+			statusCode = 412
+		}
+
+		return events.APIGatewayProxyResponse{
+			Body: err.Error(),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":   "*",
+				"Access-Control-Expose-Headers": "ETag",
+				"ETag":                          etagOf(oldUser.Version),
+			},
+			StatusCode: statusCode,
+		}, nil
+	}
+	if fieldErrors, ok := err.(user.FieldErrors); ok && request.HTTPMethod == "PATCH" {
+		return fieldErrorsResponse(fieldErrors), nil
+	}
+	if err != nil {
 		fmt.Println(err.Error())
 
 		return events.APIGatewayProxyResponse{
@@ -77,9 +356,15 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}, nil
 	}
 
+	if err := recordChanges(authTable, audit.SourceOf(request), oldUser, newUser); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
 	return events.APIGatewayProxyResponse{
 		Headers: map[string]string{
-			"Access-Control-Allow-Origin": "*",
+			"Access-Control-Allow-Origin":   "*",
+			"Access-Control-Expose-Headers": "ETag",
+			"ETag":                          etagOf(newUser.Version),
 		},
 		StatusCode: 204,
 	}, nil
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/audit"
+	sessionlib "github.com/portals-me/account/lib/session"
+)
+
+var authTableName = os.Getenv("authTable")
+
+type SessionOutput struct {
+	sessionlib.Session
+	Current bool `json:"current"`
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: statusCode,
+	}
+}
+
+/*
+GET /self/sessions
+
+returns []SessionOutput
+*/
+func listSessions(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := request.RequestContext.Authorizer["id"].(string)
+	currentID, _ := request.RequestContext.Authorizer["sid"].(string)
+
+	sessions, err := sessionlib.NewRepository(authTable).List(userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	outputs := []SessionOutput{}
+	for _, session := range sessions {
+		outputs = append(outputs, SessionOutput{
+			Session: session,
+			Current: session.SessionID == currentID,
+		})
+	}
+
+	raw, err := json.Marshal(outputs)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(200, string(raw)), nil
+}
+
+/*	DELETE /self/sessions/{id}
+ */
+func revokeSession(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := request.RequestContext.Authorizer["id"].(string)
+	sessionID := request.PathParameters["id"]
+
+	if err := sessionlib.NewRepository(authTable).Revoke(userID, sessionID); err != nil {
+		if err == sessionlib.ErrNotFound {
+			return response(404, err.Error()), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if err := audit.NewRepository(authTable).Append(userID, audit.TokenRevoked, "", audit.SourceOf(request), map[string]string{
+		"session_id": sessionID,
+	}); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
+	return response(204, ""), nil
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	if request.HTTPMethod == "GET" {
+		return listSessions(authTable, request)
+	} else if request.HTTPMethod == "DELETE" {
+		return revokeSession(authTable, request)
+	}
+
+	return response(400, ""), nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/github"
+	"github.com/portals-me/account/lib/user"
+)
+
+// GitHubClient is a pointer since the code can be exchanged only once in a request
+type GitHubClient struct {
+	github.Config
+	user *github.User
+}
+
+// getUser fetches the user on the first call, and returns the same user after that
+func (client *GitHubClient) getUser() (github.User, error) {
+	if client.user != nil {
+		return *client.user, nil
+	}
+
+	var githubUser github.User
+	if err := client.GetGitHubUser(&githubUser); err != nil {
+		return github.User{}, err
+	}
+
+	client.user = &githubUser
+	return githubUser, nil
+}
+
+func (client *GitHubClient) ObtainUserID(table dynamo.Table) (string, error) {
+	githubUser, err := client.getUser()
+	if err != nil {
+		return "", err
+	}
+
+	var record Record
+	if err := table.
+		Get("sort", "github##"+githubUser.IDString()).
+		Index("auth").
+		One(&record); err != nil {
+		return "", errors.New("GitHub user not found: " + githubUser.IDString())
+	}
+
+	return record.ID, nil
+}
+
+// GitHub logins may have hyphens, which are not allowed in the name
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Prefill fills the empty fields of the profile with the login, the name, the avatar and the verified email
+func (client *GitHubClient) Prefill(table dynamo.Table, userInfo *user.UserInfo) error {
+	githubUser, err := client.getUser()
+	if err != nil {
+		return err
+	}
+
+	displayName := githubUser.Name
+	if displayName == "" {
+		displayName = githubUser.Login
+	}
+
+	prefillUser(userInfo, user.UserInfo{
+		Name:        invalidNameChars.ReplaceAllString(githubUser.Login, "_"),
+		DisplayName: displayName,
+		Email:       githubUser.Email,
+		Picture:     githubUser.AvatarURL,
+	})
+	return nil
+}
+
+func (client *GitHubClient) CreateUser(table dynamo.Table, user user.UserInfo) error {
+	githubUser, err := client.getUser()
+	if err != nil {
+		return err
+	}
+
+	// Check if the account already exists
+	var records []Record
+	if err := table.
+		Get("sort", "github##"+githubUser.IDString()).
+		Index("auth").
+		All(&records); err != nil {
+		return err
+	}
+
+	if len(records) != 0 {
+		return errors.New("The account already exists")
+	}
+
+	// Check if the name is unique
+	var selectName []interface{}
+	if err := table.
+		Get("name", user.Name).
+		Index("name").
+		All(&selectName); err != nil {
+		return err
+	}
+
+	if len(selectName) != 0 {
+		return errors.New("Name already exists")
+	}
+
+	if err := table.
+		Put(map[string]interface{}{
+			"id":   user.ID,
+			"sort": "github##" + githubUser.IDString(),
+		}).
+		If("attribute_not_exists(id)").
+		Run(); err != nil {
+		return err
+	}
+
+	if err := table.Put(user.ToDDB()).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/guregu/dynamo"
 	"github.com/pkg/errors"
 
+	"github.com/portals-me/account/lib/authz"
 	"github.com/portals-me/account/lib/jwt"
 	"github.com/portals-me/account/lib/user"
 )
@@ -18,6 +19,46 @@ type AuthMethod interface {
 	CreateUser(table dynamo.Table, user user.UserInfo) error
 }
 
+// Prefiller is an AuthMethod which fills the profile of signup from the identity provider
+type Prefiller interface {
+	// Fill the empty fields of the user
+	Prefill(table dynamo.Table, user *user.UserInfo) error
+}
+
+// prefillUser keeps the fields given by the user
+func prefillUser(userInfo *user.UserInfo, profile user.UserInfo) {
+	if userInfo.Name == "" {
+		userInfo.Name = profile.Name
+	}
+	if userInfo.DisplayName == "" {
+		userInfo.DisplayName = profile.DisplayName
+	}
+	if userInfo.Email == "" {
+		userInfo.Email = profile.Email
+	}
+	if userInfo.Picture == "" {
+		userInfo.Picture = profile.Picture
+	}
+}
+
+// MethodName returns the auth_type of the method
+func MethodName(method AuthMethod) string {
+	switch method.(type) {
+	case Password:
+		return "password"
+	case TwitterClient:
+		return "twitter"
+	case GoogleClient:
+		return "google"
+	case *SAMLClient:
+		return "saml"
+	case *GitHubClient:
+		return "github"
+	}
+
+	return "unknown"
+}
+
 // ---------------
 // DynamoDB Record
 
@@ -27,7 +68,11 @@ type Record struct {
 	CheckData string `dynamo:"check_data"`
 }
 
-func CreateJwt(jwtPrivateKey string, userInfo user.UserInfo) (string, error) {
+// CreateJwt signs the user data, the role and the scopes of the user are added to the claims
+func CreateJwt(jwtPrivateKey string, userInfo user.UserInfo, claims jwt.Claims) (string, error) {
+	claims.Role = authz.RoleOf(userInfo.Role)
+	claims.Scope = authz.JoinScopes(authz.EffectiveScopes(userInfo.Role, userInfo.Scopes))
+
 	payload, err := json.Marshal(userInfo)
 	if err != nil {
 		panic(err)
@@ -36,7 +81,7 @@ func CreateJwt(jwtPrivateKey string, userInfo user.UserInfo) (string, error) {
 	signer := jwt.ES256Signer{
 		Key: jwtPrivateKey,
 	}
-	token, err := signer.Sign(payload)
+	token, err := signer.SignWithClaims(payload, claims)
 	if err != nil {
 		return "", errors.Wrap(err, "sign failed")
 	}
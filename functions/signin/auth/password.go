@@ -1,37 +1,124 @@
 package auth
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/guregu/dynamo"
 	"github.com/pkg/errors"
 
-	"github.com/portals-me/account/lib/bcrypt"
+	"github.com/portals-me/account/lib/passhash"
+	"github.com/portals-me/account/lib/password"
 	"github.com/portals-me/account/lib/user"
 )
 
 // ----------------
 // User account with password implementation
 
+// ErrInvalidCredentials is returned both for unknown user_name and wrong password
+// so that the response does not reveal which user_name exists
+var ErrInvalidCredentials = errors.New("Invalid user_name or password")
+
+// dummyHash is compared against when the user does not exist, to take the same time as a real comparison
+var dummyHash, _ = passhash.Hash("dummy-password-for-constant-time")
+
 type Password struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
 }
 
-func (password Password) ObtainUserID(table dynamo.Table) (string, error) {
+func (input Password) ObtainUserID(table dynamo.Table) (string, error) {
 	var record Record
 	if err := table.
-		Get("sort", "name-pass##"+password.UserName).
+		Get("sort", "name-pass##"+input.UserName).
 		Index("auth").
 		One(&record); err != nil {
-		return "", errors.New("UserName not found: " + password.UserName)
+		passhash.Verify(dummyHash, input.Password)
+		return "", ErrInvalidCredentials
 	}
 
-	if err := bcrypt.VerifyPassword(record.CheckData, password.Password); err != nil {
-		return "", errors.Wrap(err, "Invalid Password")
+	if err := passhash.Verify(record.CheckData, input.Password); err != nil {
+		return "", ErrInvalidCredentials
+	}
+
+	// Upgrade the hash to the current policy, the password is only available here
+	if passhash.NeedsRehash(record.CheckData) {
+		hash, err := passhash.Hash(input.Password)
+		if err == nil {
+			err = password.NewRepository(table).UpdateHash(password.Record{
+				ID:        record.ID,
+				Sort:      record.Sort,
+				CheckData: record.CheckData,
+			}, hash)
+		}
+		if err != nil {
+			fmt.Printf("Rehash: %+v\n", err.Error())
+		}
 	}
 
 	return record.ID, nil
 }
 
-func (password Password) CreateUser(table dynamo.Table, user user.UserInfo) error {
-	return errors.New("Not implemented yet")
+func (input Password) CreateUser(table dynamo.Table, user user.UserInfo) error {
+	// user_name for signin is the same as the name of the user
+	if input.UserName != "" && input.UserName != user.Name {
+		return errors.New("user_name must be the same as the name of the user")
+	}
+
+	// Check if the account already exists
+	var records []Record
+	if err := table.
+		Get("sort", "name-pass##"+user.Name).
+		Index("auth").
+		All(&records); err != nil {
+		return err
+	}
+
+	if len(records) != 0 {
+		return errors.New("The account already exists")
+	}
+
+	// Check if the name is unique, case-insensitively as user.Validate does
+	// The users from before name_lower are found only by the exact name
+	var selectName []interface{}
+	if err := table.
+		Get("name", user.Name).
+		Index("name").
+		All(&selectName); err != nil {
+		return err
+	}
+
+	var selectNameLower []interface{}
+	if err := table.
+		Get("name_lower", strings.ToLower(user.Name)).
+		Index("name_lower").
+		All(&selectNameLower); err != nil {
+		return err
+	}
+
+	if len(selectName) != 0 || len(selectNameLower) != 0 {
+		return errors.New("Name already exists")
+	}
+
+	hash, err := passhash.Hash(input.Password)
+	if err != nil {
+		return err
+	}
+
+	if err := table.
+		Put(Record{
+			ID:        user.ID,
+			Sort:      "name-pass##" + user.Name,
+			CheckData: hash,
+		}).
+		If("attribute_not_exists(id)").
+		Run(); err != nil {
+		return err
+	}
+
+	if err := table.Put(user.ToDDB()).Run(); err != nil {
+		return err
+	}
+
+	return nil
 }
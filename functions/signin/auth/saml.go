@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/saml"
+	"github.com/portals-me/account/lib/user"
+)
+
+// SAMLClient is a pointer since the assertion can be consumed only once in a request
+type SAMLClient struct {
+	saml.Config
+	assertion *saml.Assertion
+	provider  saml.Provider
+}
+
+// obtainAssertion validates the response on the first call, and returns the same assertion after that
+func (client *SAMLClient) obtainAssertion(table dynamo.Table) (saml.Assertion, error) {
+	if client.assertion != nil {
+		return *client.assertion, nil
+	}
+
+	assertion, provider, err := client.GetAssertion(saml.NewRepository(table))
+	if err != nil {
+		return saml.Assertion{}, err
+	}
+
+	client.assertion = &assertion
+	client.provider = provider
+	return assertion, nil
+}
+
+func (client *SAMLClient) ObtainUserID(table dynamo.Table) (string, error) {
+	assertion, err := client.obtainAssertion(table)
+	if err != nil {
+		return "", err
+	}
+
+	var record Record
+	if err := table.
+		Get("sort", saml.RecordKey(assertion.EntityID, assertion.NameID)).
+		Index("auth").
+		One(&record); err != nil {
+		return "", errors.New("SAML user not found: " + assertion.NameID)
+	}
+
+	return record.ID, nil
+}
+
+// Prefill fills the empty fields of the profile with the attributes of the assertion
+func (client *SAMLClient) Prefill(table dynamo.Table, userInfo *user.UserInfo) error {
+	assertion, err := client.obtainAssertion(table)
+	if err != nil {
+		return err
+	}
+
+	prefillUser(userInfo, assertion.UserInfo(client.provider.Attributes))
+	return nil
+}
+
+func (client *SAMLClient) CreateUser(table dynamo.Table, user user.UserInfo) error {
+	assertion, err := client.obtainAssertion(table)
+	if err != nil {
+		return err
+	}
+	recordKey := saml.RecordKey(assertion.EntityID, assertion.NameID)
+
+	// Check if the account already exists
+	var records []Record
+	if err := table.
+		Get("sort", recordKey).
+		Index("auth").
+		All(&records); err != nil {
+		return err
+	}
+
+	if len(records) != 0 {
+		return errors.New("The account already exists")
+	}
+
+	// Check if the name is unique
+	var selectName []interface{}
+	if err := table.
+		Get("name", user.Name).
+		Index("name").
+		All(&selectName); err != nil {
+		return err
+	}
+
+	if len(selectName) != 0 {
+		return errors.New("Name already exists")
+	}
+
+	if err := table.
+		Put(map[string]interface{}{
+			"id":   user.ID,
+			"sort": recordKey,
+		}).
+		If("attribute_not_exists(id)").
+		Run(); err != nil {
+		return err
+	}
+
+	if err := table.Put(user.ToDDB()).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
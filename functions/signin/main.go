@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -17,8 +19,14 @@ import (
 	"github.com/guregu/dynamo"
 
 	"github.com/portals-me/account/functions/signin/auth"
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/github"
 	"github.com/portals-me/account/lib/google"
 	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/password"
+	"github.com/portals-me/account/lib/saml"
+	sessionlib "github.com/portals-me/account/lib/session"
+	"github.com/portals-me/account/lib/throttle"
 	"github.com/portals-me/account/lib/twitter"
 	"github.com/portals-me/account/lib/user"
 )
@@ -28,18 +36,25 @@ var jwtPrivateKey = os.Getenv("jwtPrivate")
 var twitterClientKey = os.Getenv("twitterClientKey")
 var twitterClientSecret = os.Getenv("twitterClientSecret")
 var googleClientId = os.Getenv("googleClientId")
+var githubClientId = os.Getenv("githubClientId")
+var githubClientSecret = os.Getenv("githubClientSecret")
+var samlServiceProvider = saml.ServiceProvider{
+	EntityID: os.Getenv("samlEntityID"),
+	ACSURL:   os.Getenv("samlACSURL"),
+}
 
 type Input struct {
-	AuthType string      `json:"auth_type"`
-	Data     interface{} `json:"data"`
+	AuthType    string      `json:"auth_type"`
+	Data        interface{} `json:"data"`
+	DeviceLabel string      `json:"device_label"`
 }
 
 // Crate an Auth method from requestBody
 // This function should an instance constructing function
-func createAuthMethod(body string) (auth.AuthMethod, error) {
+func createAuthMethod(body string) (auth.AuthMethod, Input, error) {
 	var input Input
 	if err := json.Unmarshal([]byte(body), &input); err != nil {
-		return nil, errors.Wrap(err, "Unmarshal failed")
+		return nil, Input{}, errors.Wrap(err, "Unmarshal failed")
 	}
 
 	if input.AuthType == "password" {
@@ -47,16 +62,16 @@ func createAuthMethod(body string) (auth.AuthMethod, error) {
 
 		data, _ := json.Marshal(input.Data)
 		if err := json.Unmarshal([]byte(data), &password); err != nil {
-			return nil, errors.Wrap(err, "Unmarshal password failed")
+			return nil, Input{}, errors.Wrap(err, "Unmarshal password failed")
 		}
 
-		return password, nil
+		return password, input, nil
 	} else if input.AuthType == "twitter" {
 		var credentials twitter.Credentials
 
 		data, _ := json.Marshal(input.Data)
 		if err := json.Unmarshal([]byte(data), &credentials); err != nil {
-			return nil, errors.Wrap(err, "Unmarshal twitter failed")
+			return nil, Input{}, errors.Wrap(err, "Unmarshal twitter failed")
 		}
 
 		return auth.TwitterClient{
@@ -65,13 +80,13 @@ func createAuthMethod(body string) (auth.AuthMethod, error) {
 				ClientKey:    twitterClientKey,
 				ClientSecret: twitterClientSecret,
 			},
-		}, nil
+		}, input, nil
 	} else if input.AuthType == "google" {
 		var client google.Token
 
 		data, _ := json.Marshal(input.Data)
 		if err := json.Unmarshal([]byte(data), &client); err != nil {
-			return nil, errors.Wrap(err, "Unmarshal google failed")
+			return nil, Input{}, errors.Wrap(err, "Unmarshal google failed")
 		}
 
 		return auth.GoogleClient{
@@ -79,10 +94,39 @@ func createAuthMethod(body string) (auth.AuthMethod, error) {
 				Token:    client,
 				ClientId: googleClientId,
 			},
-		}, nil
+		}, input, nil
+	} else if input.AuthType == "saml" {
+		var response saml.Response
+
+		data, _ := json.Marshal(input.Data)
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			return nil, Input{}, errors.Wrap(err, "Unmarshal saml failed")
+		}
+
+		return &auth.SAMLClient{
+			Config: saml.Config{
+				Response:        response,
+				ServiceProvider: samlServiceProvider,
+			},
+		}, input, nil
+	} else if input.AuthType == "github" {
+		var code github.Code
+
+		data, _ := json.Marshal(input.Data)
+		if err := json.Unmarshal([]byte(data), &code); err != nil {
+			return nil, Input{}, errors.Wrap(err, "Unmarshal github failed")
+		}
+
+		return &auth.GitHubClient{
+			Config: github.Config{
+				Code:         code,
+				ClientID:     githubClientId,
+				ClientSecret: githubClientSecret,
+			},
+		}, input, nil
 	}
 
-	return nil, errors.New("Unsupported auth_type: " + input.AuthType)
+	return nil, Input{}, errors.New("Unsupported auth_type: " + input.AuthType)
 }
 
 func tryDecodeBase64(s string) string {
@@ -94,34 +138,30 @@ func tryDecodeBase64(s string) string {
 	return string(decoded)
 }
 
-func createJwt(userInfo user.UserInfo) (string, error) {
-	payload, err := json.Marshal(userInfo)
-	if err != nil {
-		panic(err)
-	}
-
-	signer := jwt.ES256Signer{
-		Key: jwtPrivateKey,
-	}
-	token, err := signer.Sign(payload)
-	if err != nil {
-		return "", errors.Wrap(err, "sign failed")
-	}
+// StatusError is returned when the account is not active
+type StatusError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// unix time when the suspension ends, omitted for indefinite suspension
+	Until int64 `json:"until,omitempty"`
+}
 
-	return string(token), nil
+var statusErrorCodes = map[error]string{
+	user.ErrSuspended:       "account_suspended",
+	user.ErrPendingDeletion: "account_pending_deletion",
 }
 
-/*	POST /authenticate
+/*
+POST /authenticate
 
-	expects Input
-	returns String (jwt)
+expects Input
+returns String (jwt)
 */
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// try base64 decoding
 	body := tryDecodeBase64(request.Body)
-	fmt.Println(body)
 
-	method, err := createAuthMethod(body)
+	method, input, err := createAuthMethod(body)
 	if err != nil {
 		fmt.Printf("CreateAuthMethod: %+v\n", err.Error())
 		return events.APIGatewayProxyResponse{Body: "Invalid Input", StatusCode: 400}, nil
@@ -132,13 +172,68 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	db := dynamo.NewFromIface(dynamodb.New(sess))
 	authTable := db.Table(authTableName)
 
+	// Failed attempts are counted by user_name and source IP for password signin
+	throttleRepo := throttle.NewRepository(authTable)
+	throttlePolicies := map[string]throttle.Policy{}
+	userKey := ""
+	if password, ok := method.(auth.Password); ok {
+		userKey = throttle.UserKey(password.UserName)
+		throttlePolicies[userKey] = throttle.UserPolicy
+		throttlePolicies[throttle.IPKey(request.RequestContext.Identity.SourceIP)] = throttle.IPPolicy
+	}
+
+	for key := range throttlePolicies {
+		lockedUntil, err := throttleRepo.LockedUntil(key)
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		if !lockedUntil.IsZero() {
+			return events.APIGatewayProxyResponse{
+				Body: "Too Many Requests",
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+					"Retry-After":                 strconv.FormatInt(int64(time.Until(lockedUntil).Seconds())+1, 10),
+				},
+				StatusCode: 429,
+			}, nil
+		}
+	}
+
+	auditRepo := audit.NewRepository(authTable)
+	methodName := auth.MethodName(method)
+
 	// Get Idp ID
 	idpID, err := method.ObtainUserID(authTable)
 	if err != nil {
 		fmt.Printf("ObtainUserID: %+v\n", err.Error())
+
+		for key, policy := range throttlePolicies {
+			if err := throttleRepo.RecordFailure(key, policy); err != nil {
+				fmt.Printf("RecordFailure: %+v\n", err.Error())
+			}
+		}
+
+		// Failures are recorded to the user only when the user_name exists
+		if input, ok := method.(auth.Password); ok {
+			var record password.Record
+			if err := password.NewRepository(authTable).GetByName(input.UserName, &record); err == nil {
+				if err := auditRepo.Append(record.ID, audit.SigninFailed, methodName, audit.SourceOf(request), nil); err != nil {
+					fmt.Printf("Audit: %+v\n", err.Error())
+				}
+			}
+		}
+
 		return events.APIGatewayProxyResponse{Body: "Invalid Input", StatusCode: 400}, nil
 	}
 
+	// Only the counter of the user is reset, the counter of the source IP keeps counting
+	if userKey != "" {
+		if err := throttleRepo.Reset(userKey); err != nil {
+			fmt.Printf("Reset: %+v\n", err.Error())
+		}
+	}
+
 	// Get UserInfo from "detail" part
 	var record user.UserInfoDDB
 	if err := authTable.
@@ -149,15 +244,58 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		return events.APIGatewayProxyResponse{Body: "User not found", StatusCode: 404}, nil
 	}
 
+	if err := user.NewRepository(authTable).EnsureActive(&record.UserInfo); err != nil {
+		code, ok := statusErrorCodes[err]
+		if !ok {
+			return events.APIGatewayProxyResponse{}, err
+		}
+
+		if err := auditRepo.Append(idpID, audit.SigninFailed, methodName, audit.SourceOf(request), map[string]string{
+			"reason": code,
+		}); err != nil {
+			fmt.Printf("Audit: %+v\n", err.Error())
+		}
+
+		raw, _ := json.Marshal(StatusError{
+			Code:    code,
+			Message: err.Error(),
+			Until:   record.StatusUntil,
+		})
+		return events.APIGatewayProxyResponse{
+			Body: string(raw),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+			},
+			StatusCode: 403,
+		}, nil
+	}
+
+	newSession, err := sessionlib.NewRepository(authTable).Create(
+		idpID,
+		methodName,
+		input.DeviceLabel,
+		request.RequestContext.Identity.UserAgent,
+		request.RequestContext.Identity.SourceIP,
+	)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
 	// Create JWT
-	jwt, err := createJwt(record.UserInfo)
+	token, err := auth.CreateJwt(jwtPrivateKey, record.UserInfo, jwt.Claims{
+		SessionID: newSession.SessionID,
+	})
 	if err != nil {
 		fmt.Printf("CreateJWT: %+v\n", err.Error())
 		return events.APIGatewayProxyResponse{Body: "Failed to createJWT", StatusCode: 400}, nil
 	}
 
+	if err := auditRepo.Append(idpID, audit.SigninSucceeded, methodName, audit.SourceOf(request), nil); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
 	return events.APIGatewayProxyResponse{
-		Body: jwt,
+		Body: token,
 		Headers: map[string]string{
 			"Access-Control-Allow-Origin": "*",
 		},
@@ -16,7 +16,14 @@ import (
 	"github.com/satori/go.uuid"
 
 	"github.com/portals-me/account/functions/signin/auth"
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/github"
 	"github.com/portals-me/account/lib/google"
+	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/passpolicy"
+	"github.com/portals-me/account/lib/saml"
+	sessionlib "github.com/portals-me/account/lib/session"
 	"github.com/portals-me/account/lib/twitter"
 	"github.com/portals-me/account/lib/user"
 )
@@ -26,26 +33,43 @@ var jwtPrivateKey = os.Getenv("jwtPrivate")
 var twitterClientKey = os.Getenv("twitterClientKey")
 var twitterClientSecret = os.Getenv("twitterClientSecret")
 var googleClientId = os.Getenv("googleClientId")
+var githubClientId = os.Getenv("githubClientId")
+var githubClientSecret = os.Getenv("githubClientSecret")
+var samlServiceProvider = saml.ServiceProvider{
+	EntityID: os.Getenv("samlEntityID"),
+	ACSURL:   os.Getenv("samlACSURL"),
+}
+var passwordPolicy = passpolicy.FromEnv()
 
 type Input struct {
-	AuthType string        `json:"auth_type"`
-	Data     interface{}   `json:"data"`
-	User     user.UserInfo `json:"user"`
+	AuthType    string        `json:"auth_type"`
+	Data        interface{}   `json:"data"`
+	User        user.UserInfo `json:"user"`
+	DeviceLabel string        `json:"device_label"`
 }
 
 // Similar to `createAuthMethod` function from signin
-func createAuthMethod(body string) (auth.AuthMethod, user.UserInfo, error) {
+func createAuthMethod(body string) (auth.AuthMethod, Input, error) {
 	var input Input
 	if err := json.Unmarshal([]byte(body), &input); err != nil {
-		return nil, user.UserInfo{}, errors.Wrap(err, "Unmarshal failed")
+		return nil, Input{}, errors.Wrap(err, "Unmarshal failed")
 	}
 
-	if input.AuthType == "twitter" {
+	if input.AuthType == "password" {
+		var password auth.Password
+
+		data, _ := json.Marshal(input.Data)
+		if err := json.Unmarshal([]byte(data), &password); err != nil {
+			return nil, Input{}, errors.Wrap(err, "Unmarshal password failed")
+		}
+
+		return password, input, nil
+	} else if input.AuthType == "twitter" {
 		var credentials twitter.Credentials
 
 		data, _ := json.Marshal(input.Data)
 		if err := json.Unmarshal([]byte(data), &credentials); err != nil {
-			return nil, user.UserInfo{}, errors.Wrap(err, "Unmarshal twitter failed")
+			return nil, Input{}, errors.Wrap(err, "Unmarshal twitter failed")
 		}
 
 		return auth.TwitterClient{
@@ -54,13 +78,13 @@ func createAuthMethod(body string) (auth.AuthMethod, user.UserInfo, error) {
 				ClientKey:    twitterClientKey,
 				ClientSecret: twitterClientSecret,
 			},
-		}, input.User, nil
+		}, input, nil
 	} else if input.AuthType == "google" {
 		var client google.Token
 
 		data, _ := json.Marshal(input.Data)
 		if err := json.Unmarshal([]byte(data), &client); err != nil {
-			return nil, user.UserInfo{}, errors.Wrap(err, "Unmarshal google failed")
+			return nil, Input{}, errors.Wrap(err, "Unmarshal google failed")
 		}
 
 		return auth.GoogleClient{
@@ -68,10 +92,39 @@ func createAuthMethod(body string) (auth.AuthMethod, user.UserInfo, error) {
 				Token:    client,
 				ClientId: googleClientId,
 			},
-		}, input.User, nil
+		}, input, nil
+	} else if input.AuthType == "saml" {
+		var response saml.Response
+
+		data, _ := json.Marshal(input.Data)
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			return nil, Input{}, errors.Wrap(err, "Unmarshal saml failed")
+		}
+
+		return &auth.SAMLClient{
+			Config: saml.Config{
+				Response:        response,
+				ServiceProvider: samlServiceProvider,
+			},
+		}, input, nil
+	} else if input.AuthType == "github" {
+		var code github.Code
+
+		data, _ := json.Marshal(input.Data)
+		if err := json.Unmarshal([]byte(data), &code); err != nil {
+			return nil, Input{}, errors.Wrap(err, "Unmarshal github failed")
+		}
+
+		return &auth.GitHubClient{
+			Config: github.Config{
+				Code:         code,
+				ClientID:     githubClientId,
+				ClientSecret: githubClientSecret,
+			},
+		}, input, nil
 	}
 
-	return nil, user.UserInfo{}, errors.New("Unsupported auth_type: " + input.AuthType)
+	return nil, Input{}, errors.New("Unsupported auth_type: " + input.AuthType)
 }
 
 func tryDecodeBase64(s string) string {
@@ -83,17 +136,17 @@ func tryDecodeBase64(s string) string {
 	return string(decoded)
 }
 
-/*	POST /authenticate
+/*
+POST /authenticate
 
-	expects Input
-	returns String (jwt)
+expects Input
+returns String (jwt)
 */
 func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// try base64 decoding
 	body := tryDecodeBase64(request.Body)
-	fmt.Println(body)
 
-	method, userInfo, err := createAuthMethod(body)
+	method, input, err := createAuthMethod(body)
 	if err != nil {
 		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
 	}
@@ -103,18 +156,51 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	db := dynamo.NewFromIface(dynamodb.New(sess))
 	authTable := db.Table(authTableName)
 
+	// Only the profile is taken from the input, the status, the timestamps and the version are set by the server
 	idpID := uuid.NewV4().String()
-	userInfo.ID = idpID
+	userInfo := user.UserInfo{
+		ID:          idpID,
+		Name:        input.User.Name,
+		Picture:     input.User.Picture,
+		DisplayName: input.User.DisplayName,
+		Email:       input.User.Email,
+		Role:        authz.RoleUser,
+	}
+
+	if prefiller, ok := method.(auth.Prefiller); ok {
+		if err := prefiller.Prefill(authTable, &userInfo); err != nil {
+			return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
+		}
+	}
 
 	if err := user.Validate(authTable, userInfo); err != nil {
 		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
 	}
 
+	if password, ok := method.(auth.Password); ok {
+		if err := passwordPolicy.Check(password.Password, userInfo); err != nil {
+			if policyErr, ok := err.(passpolicy.Error); ok {
+				return events.APIGatewayProxyResponse{Body: policyErr.JSON(), StatusCode: 400}, nil
+			}
+
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
+
 	// Create a new user
 	if err := method.CreateUser(authTable, userInfo); err != nil {
 		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
 	}
 
+	auditRepo := audit.NewRepository(authTable)
+	methodName := auth.MethodName(method)
+	if err := auditRepo.Append(idpID, audit.Signup, methodName, audit.SourceOf(request), nil); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+	if err := auditRepo.Append(idpID, audit.IdentityLinked, methodName, audit.SourceOf(request), nil); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
 	// Get UserInfo from "detail" part
 	var record user.UserInfoDDB
 	if err := authTable.
@@ -124,14 +210,27 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 404}, nil
 	}
 
+	newSession, err := sessionlib.NewRepository(authTable).Create(
+		idpID,
+		methodName,
+		input.DeviceLabel,
+		request.RequestContext.Identity.UserAgent,
+		request.RequestContext.Identity.SourceIP,
+	)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
 	// Create JWT
-	jwt, err := auth.CreateJwt(jwtPrivateKey, record.UserInfo)
+	token, err := auth.CreateJwt(jwtPrivateKey, record.UserInfo, jwt.Claims{
+		SessionID: newSession.SessionID,
+	})
 	if err != nil {
 		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: 400}, nil
 	}
 
 	return events.APIGatewayProxyResponse{
-		Body: jwt,
+		Body: token,
 		Headers: map[string]string{
 			"Access-Control-Allow-Origin": "*",
 		},
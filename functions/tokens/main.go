@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/audit"
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/token"
+)
+
+var authTableName = os.Getenv("authTable")
+
+const defaultLifetimeDays = 30
+const maxLifetimeDays = 365
+
+type CreateInput struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type CreateOutput struct {
+	token.PersonalAccessToken
+	Token string `json:"token"`
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		},
+		StatusCode: statusCode,
+	}
+}
+
+// isFirstParty rejects personal access tokens and tokens of OAuth clients, only the signin session can create tokens
+func isFirstParty(request events.APIGatewayProxyRequest) bool {
+	if tokenID, _ := request.RequestContext.Authorizer["token_id"].(string); tokenID != "" {
+		return false
+	}
+	if clientID, _ := request.RequestContext.Authorizer["client_id"].(string); clientID != "" {
+		return false
+	}
+
+	return true
+}
+
+/*
+GET /self/tokens
+
+returns []token.PersonalAccessToken
+*/
+func listTokens(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	pats, err := token.NewRepository(authTable).List(request.RequestContext.Authorizer["id"].(string))
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	raw, err := json.Marshal(pats)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(200, string(raw)), nil
+}
+
+/*
+POST /self/tokens
+
+expects CreateInput
+returns CreateOutput, the token is never shown again
+only with the token of signin, not with a personal access token or a token of an OAuth client
+*/
+func createToken(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if !isFirstParty(request) {
+		return response(403, "Tokens can only be created by the signin session"), nil
+	}
+
+	var input CreateInput
+	if err := json.Unmarshal([]byte(request.Body), &input); err != nil {
+		return response(400, err.Error()), nil
+	}
+
+	if input.Name == "" || len(input.Name) > 64 {
+		return response(400, "name must be 1 to 64 characters"), nil
+	}
+	if len(input.Scopes) == 0 {
+		return response(400, "scopes must not be empty"), nil
+	}
+	// A token can not have scopes the caller does not have
+	callerScopes, _ := request.RequestContext.Authorizer["scopes"].(string)
+	for _, scope := range input.Scopes {
+		if !authz.IsKnown(scope) {
+			return response(400, "Unknown scope: "+scope), nil
+		}
+		if !authz.Has(authz.SplitScopes(callerScopes), scope) {
+			return response(403, "Scope not granted: "+scope), nil
+		}
+	}
+	if input.ExpiresInDays == 0 {
+		input.ExpiresInDays = defaultLifetimeDays
+	}
+	if input.ExpiresInDays < 0 || input.ExpiresInDays > maxLifetimeDays {
+		return response(400, fmt.Sprintf("expires_in_days must be 1 to %d", maxLifetimeDays)), nil
+	}
+
+	userID := request.RequestContext.Authorizer["id"].(string)
+	pat, raw, err := token.NewRepository(authTable).Create(
+		userID,
+		input.Name,
+		input.Scopes,
+		time.Duration(input.ExpiresInDays)*24*time.Hour,
+	)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if err := audit.NewRepository(authTable).Append(userID, audit.TokenCreated, "", audit.SourceOf(request), map[string]string{
+		"token_id": pat.TokenID,
+		"scopes":   authz.JoinScopes(pat.Scopes),
+	}); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
+	body, err := json.Marshal(CreateOutput{
+		PersonalAccessToken: pat,
+		Token:               raw,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	return response(201, string(body)), nil
+}
+
+/*	DELETE /self/tokens/{id}
+ */
+func revokeToken(authTable dynamo.Table, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := request.RequestContext.Authorizer["id"].(string)
+	tokenID := request.PathParameters["id"]
+
+	if err := token.NewRepository(authTable).Revoke(userID, tokenID); err != nil {
+		if err == token.ErrNotFound {
+			return response(404, err.Error()), nil
+		}
+
+		return events.APIGatewayProxyResponse{}, err
+	}
+
+	if err := audit.NewRepository(authTable).Append(userID, audit.TokenRevoked, "", audit.SourceOf(request), map[string]string{
+		"token_id": tokenID,
+	}); err != nil {
+		fmt.Printf("Audit: %+v\n", err.Error())
+	}
+
+	return response(204, ""), nil
+}
+
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+	authTable := db.Table(authTableName)
+
+	if request.Resource == "/self/tokens" && request.HTTPMethod == "GET" {
+		return listTokens(authTable, request)
+	} else if request.Resource == "/self/tokens" && request.HTTPMethod == "POST" {
+		return createToken(authTable, request)
+	} else if request.Resource == "/self/tokens/{id}" && request.HTTPMethod == "DELETE" {
+		return revokeToken(authTable, request)
+	}
+
+	return response(404, "Not Found"), nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/webhook"
+)
+
+var authTableName = os.Getenv("authTable")
+
+// handler is invoked by the schedule to retry the failed webhook deliveries
+func handler(ctx context.Context, event events.CloudWatchEvent) error {
+	sess := session.Must(session.NewSession())
+	db := dynamo.NewFromIface(dynamodb.New(sess))
+
+	attempted, err := webhook.NewDispatcher(db.Table(authTableName)).RetryDue(time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Retried %d deliveries\n", attempted)
+	return nil
+}
+
+func main() {
+	lambda.Start(handler)
+}
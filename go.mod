@@ -5,12 +5,14 @@ go 1.12
 require (
 	github.com/GoogleIdTokenVerifier/GoogleIdTokenVerifier v0.0.0-20161220031521-f9aca297807f
 	github.com/aws/aws-lambda-go v1.11.1
-	github.com/aws/aws-sdk-go v1.19.49
+	github.com/aws/aws-sdk-go v1.35.37
+	github.com/beevik/etree v1.1.0
 	github.com/gbrlsnchs/jwt/v2 v2.0.0
 	github.com/gbrlsnchs/jwt/v3 v3.0.0-beta.0
 	github.com/gomodule/oauth1 v0.0.0-20181215000758-9a59ed3b0a84
 	github.com/guregu/dynamo v1.2.1
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/russellhaering/goxmldsig v1.4.0
 	github.com/satori/go.uuid v1.2.0
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 )
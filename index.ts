@@ -6,12 +6,44 @@ import {
 } from "./infrastructure/apigateway";
 import { createLambdaFunction } from "./infrastructure/lambda";
 
+const stackConfig = new pulumi.Config();
+
 const config = {
-  service: new pulumi.Config().name,
+  service: stackConfig.name,
   stage: pulumi.getStack(),
-  region: "ap-northeast-1"
+  region: "ap-northeast-1",
+  passwordReset: {
+    notifier: stackConfig.get("passwordResetNotifier") || "ses",
+    url: stackConfig.get("passwordResetURL") || "https://portals.me/password-reset",
+    mailSource: stackConfig.get("mailSource") || "noreply@portals.me"
+  },
+  passwordPolicy: {
+    minLength: stackConfig.get("passwordMinLength") || "10",
+    minEntropyBits: stackConfig.get("passwordMinEntropyBits") || "40",
+    breachedPasswordDir: stackConfig.get("breachedPasswordDir") || ""
+  },
+  oauth: {
+    issuer: stackConfig.get("oidcIssuer") || "",
+    authorizationPage:
+      stackConfig.get("oauthAuthorizationPage") ||
+      "https://portals.me/oauth/authorize"
+  },
+  saml: {
+    entityID: stackConfig.get("samlEntityID") || "https://portals.me/saml",
+    acsURL: stackConfig.get("samlACSURL") || "https://portals.me/saml/acs"
+  }
 };
 
+// The log notifier writes the reset links to the logs, only for the development stages
+if (
+  config.passwordReset.notifier === "log" &&
+  !(config.stage.startsWith("dev") || config.stage.startsWith("test"))
+) {
+  throw new Error(
+    `passwordResetNotifier "log" is only for the dev and test stages, not ${config.stage}`
+  );
+}
+
 const parameter = {
   jwtPrivate: aws.ssm
     .getParameter({
@@ -43,6 +75,20 @@ const parameter = {
       })
       .then(result => result.value)
   },
+  github: {
+    clientId: aws.ssm
+      .getParameter({
+        name: `${config.service}-github-clientId`,
+        withDecryption: true
+      })
+      .then(result => result.value),
+    clientSecret: aws.ssm
+      .getParameter({
+        name: `${config.service}-github-clientSecret`,
+        withDecryption: true
+      })
+      .then(result => result.value)
+  },
   domain: aws.ssm
     .getParameter({
       name: config.stage.startsWith("test")
@@ -72,7 +118,7 @@ const lambdaRole = new aws.iam.Role("auth-lambda-role", {
 });
 new aws.iam.RolePolicyAttachment("auth-lambda-role-lambdafull", {
   role: lambdaRole,
-  policyArn: aws.iam.AWSLambdaFullAccess
+  policyArn: aws.iam.ManagedPolicy.AWSLambdaFullAccess
 });
 
 const accountTable = new aws.dynamodb.Table("account-table", {
@@ -88,6 +134,10 @@ const accountTable = new aws.dynamodb.Table("account-table", {
     {
       name: "name",
       type: "S"
+    },
+    {
+      name: "name_lower",
+      type: "S"
     }
   ],
   hashKey: "id",
@@ -104,15 +154,26 @@ const accountTable = new aws.dynamodb.Table("account-table", {
       name: "name",
       hashKey: "name",
       projectionType: "KEYS_ONLY"
+    },
+    {
+      name: "name_lower",
+      hashKey: "name_lower",
+      projectionType: "KEYS_ONLY"
     }
   ],
+  ttl: {
+    attributeName: "ttl",
+    enabled: true
+  },
   streamEnabled: true,
-  streamViewType: "NEW_IMAGE",
+  streamViewType: "NEW_AND_OLD_IMAGES",
   name: `${config.service}-${config.stage}-accounts`
 });
 
+// FIFO keeps the events of a user in order, the sink gives the deduplication id
 const accountTableEventTopic = new aws.sns.Topic("account-table-event-topic", {
-  name: `${config.service}-${config.stage}-account-table-event-topic`
+  name: `${config.service}-${config.stage}-account-table-event-topic.fifo`,
+  fifoTopic: true
 });
 
 const accountTableEventSubscription = createLambdaFunction(
@@ -127,6 +188,7 @@ const accountTableEventSubscription = createLambdaFunction(
       environment: {
         variables: {
           timestamp: new Date().toLocaleString(),
+          authTable: accountTable.name,
           accountTableSubscriptionTopicArn: accountTableEventTopic.arn
         }
       }
@@ -134,12 +196,14 @@ const accountTableEventSubscription = createLambdaFunction(
   }
 );
 
-const accountTableSubscription = new aws.dynamodb.TableEventSubscription(
+// The function reports the failed record by batchItemFailures, the shard is retried from it
+const accountTableSubscription = new aws.lambda.EventSourceMapping(
   "account-table-subscription",
-  accountTable,
-  accountTableEventSubscription,
   {
-    startingPosition: "TRIM_HORIZON"
+    eventSourceArn: accountTable.streamArn,
+    functionName: accountTableEventSubscription.arn,
+    startingPosition: "TRIM_HORIZON",
+    functionResponseTypes: ["ReportBatchItemFailures"]
   }
 );
 
@@ -186,7 +250,11 @@ const signinLambdaIntegration = createLambdaMethod("signin", {
           jwtPrivate: parameter.jwtPrivate,
           twitterClientKey: parameter.twitter.client,
           twitterClientSecret: parameter.twitter.secret,
-          googleClientId: parameter.google.clientId
+          googleClientId: parameter.google.clientId,
+          githubClientId: parameter.github.clientId,
+          githubClientSecret: parameter.github.clientSecret,
+          samlEntityID: config.saml.entityID,
+          samlACSURL: config.saml.acsURL
         }
       }
     }
@@ -217,7 +285,14 @@ const signupLambdaIntegration = createLambdaMethod("signup", {
           jwtPrivate: parameter.jwtPrivate,
           twitterClientKey: parameter.twitter.client,
           twitterClientSecret: parameter.twitter.secret,
-          googleClientId: parameter.google.clientId
+          googleClientId: parameter.google.clientId,
+          githubClientId: parameter.github.clientId,
+          githubClientSecret: parameter.github.clientSecret,
+          samlEntityID: config.saml.entityID,
+          samlACSURL: config.saml.acsURL,
+          passwordMinLength: config.passwordPolicy.minLength,
+          passwordMinEntropyBits: config.passwordPolicy.minEntropyBits,
+          breachedPasswordDir: config.passwordPolicy.breachedPasswordDir
         }
       }
     }
@@ -306,6 +381,7 @@ const authorizerFunction = createLambdaFunction("authorizer", {
     environment: {
       variables: {
         timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name,
         jwtPrivateKey: parameter.jwtPrivate
       }
     }
@@ -354,7 +430,11 @@ const authorizer = new aws.apigateway.Authorizer("authorizer", {
   authorizerUri: pulumi.interpolate`arn:aws:apigateway:${
     config.region
   }:lambda:path/2015-03-31/functions/${authorizerFunction.arn}/invocations`,
-  authorizerCredentials: authorizerRole.arn
+  authorizerCredentials: authorizerRole.arn,
+  // Revoked sessions and tokens, and suspended users must be rejected immediately,
+  // a cached Allow would keep them working for the TTL, so the result is not cached
+  // The policies still use wildcard resources, so a TTL can be set if a delay is acceptable
+  authorizerResultTtlInSeconds: 0
 });
 
 const selfFunction = createLambdaFunction("self-function", {
@@ -392,6 +472,1219 @@ const putSelfIntegration = createLambdaMethod("get-self-integration", {
   }
 });
 
+const patchSelfIntegration = createLambdaMethod("patch-self-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "PATCH",
+  resource: selfResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: selfFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const passwordFunction = createLambdaFunction("password-function", {
+  filepath: "password",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-password`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name,
+        passwordResetNotifier: config.passwordReset.notifier,
+        passwordResetURL: config.passwordReset.url,
+        mailSource: config.passwordReset.mailSource,
+        passwordMinLength: config.passwordPolicy.minLength,
+        passwordMinEntropyBits: config.passwordPolicy.minEntropyBits,
+        breachedPasswordDir: config.passwordPolicy.breachedPasswordDir
+      }
+    }
+  }
+});
+
+const selfPasswordResource = createCORSResource("self-password", {
+  parentId: selfResource.id,
+  pathPart: "password",
+  restApi: accountAPI
+});
+
+const changePasswordIntegration = createLambdaMethod(
+  "change-password-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: selfPasswordResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: passwordFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const passwordResource = new aws.apigateway.Resource("password", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "password",
+  restApi: accountAPI
+});
+
+const passwordResetResource = createCORSResource("password-reset", {
+  parentId: passwordResource.id,
+  pathPart: "reset",
+  restApi: accountAPI
+});
+
+const passwordResetIntegration = createLambdaMethod(
+  "password-reset-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "POST",
+    resource: passwordResetResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: passwordFunction
+  }
+);
+
+const passwordResetConfirmResource = createCORSResource(
+  "password-reset-confirm",
+  {
+    parentId: passwordResetResource.id,
+    pathPart: "confirm",
+    restApi: accountAPI
+  }
+);
+
+const passwordResetConfirmIntegration = createLambdaMethod(
+  "password-reset-confirm-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "POST",
+    resource: passwordResetConfirmResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: passwordFunction
+  }
+);
+
+const activityFunction = createLambdaFunction("activity-function", {
+  filepath: "activity",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-activity`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name
+      }
+    }
+  }
+});
+
+const selfActivityResource = createCORSResource("self-activity", {
+  parentId: selfResource.id,
+  pathPart: "activity",
+  restApi: accountAPI
+});
+
+const getActivityIntegration = createLambdaMethod(
+  "get-activity-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: selfActivityResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: activityFunction,
+    method: {
+      authorizerId: authorizer.id,
+      requestParameters: {
+        "method.request.querystring.limit": false,
+        "method.request.querystring.cursor": false
+      }
+    }
+  }
+);
+
+const sessionsFunction = createLambdaFunction("sessions-function", {
+  filepath: "sessions",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-sessions`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name
+      }
+    }
+  }
+});
+
+const selfSessionsResource = createCORSResource("self-sessions", {
+  parentId: selfResource.id,
+  pathPart: "sessions",
+  restApi: accountAPI
+});
+
+const listSessionsIntegration = createLambdaMethod(
+  "list-sessions-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: selfSessionsResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: sessionsFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const selfSessionResource = createCORSResource("self-session", {
+  parentId: selfSessionsResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const revokeSessionIntegration = createLambdaMethod(
+  "revoke-session-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "DELETE",
+    resource: selfSessionResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: sessionsFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const tokensFunction = createLambdaFunction("tokens-function", {
+  filepath: "tokens",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-tokens`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name
+      }
+    }
+  }
+});
+
+const selfTokensResource = createCORSResource("self-tokens", {
+  parentId: selfResource.id,
+  pathPart: "tokens",
+  restApi: accountAPI
+});
+
+const listTokensIntegration = createLambdaMethod("list-tokens-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "GET",
+  resource: selfTokensResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: tokensFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const createTokenIntegration = createLambdaMethod("create-token-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "POST",
+  resource: selfTokensResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: tokensFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const selfTokenResource = createCORSResource("self-token", {
+  parentId: selfTokensResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const revokeTokenIntegration = createLambdaMethod("revoke-token-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "DELETE",
+  resource: selfTokenResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: tokensFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const oauthFunction = createLambdaFunction("oauth-function", {
+  filepath: "oauth",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-oauth`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name,
+        jwtPrivate: parameter.jwtPrivate,
+        oidcIssuer: config.oauth.issuer,
+        oauthAuthorizationPage: config.oauth.authorizationPage
+      }
+    }
+  }
+});
+
+const oauthResource = new aws.apigateway.Resource("oauth", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "oauth",
+  restApi: accountAPI
+});
+
+const oauthAuthorizeResource = createCORSResource("oauth-authorize", {
+  parentId: oauthResource.id,
+  pathPart: "authorize",
+  restApi: accountAPI
+});
+
+const describeAuthorizationIntegration = createLambdaMethod(
+  "describe-authorization-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: oauthAuthorizeResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: oauthFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const authorizeIntegration = createLambdaMethod("authorize-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "POST",
+  resource: oauthAuthorizeResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: oauthFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const oauthTokenResource = createCORSResource("oauth-token", {
+  parentId: oauthResource.id,
+  pathPart: "token",
+  restApi: accountAPI
+});
+
+const oauthTokenIntegration = createLambdaMethod("oauth-token-integration", {
+  authorization: "NONE",
+  httpMethod: "POST",
+  resource: oauthTokenResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: oauthFunction
+});
+
+const userInfoResource = createCORSResource("userinfo", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "userinfo",
+  restApi: accountAPI
+});
+
+const getUserInfoIntegration = createLambdaMethod("get-userinfo-integration", {
+  authorization: "NONE",
+  httpMethod: "GET",
+  resource: userInfoResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: oauthFunction
+});
+
+const postUserInfoIntegration = createLambdaMethod(
+  "post-userinfo-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "POST",
+    resource: userInfoResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: oauthFunction
+  }
+);
+
+const introspectResource = createCORSResource("introspect", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "introspect",
+  restApi: accountAPI
+});
+
+const introspectIntegration = createLambdaMethod("introspect-integration", {
+  authorization: "NONE",
+  httpMethod: "POST",
+  resource: introspectResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: oauthFunction
+});
+
+const revokeResource = createCORSResource("revoke", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "revoke",
+  restApi: accountAPI
+});
+
+const revokeIntegration = createLambdaMethod("revoke-integration", {
+  authorization: "NONE",
+  httpMethod: "POST",
+  resource: revokeResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: oauthFunction
+});
+
+const wellKnownResource = new aws.apigateway.Resource("well-known", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: ".well-known",
+  restApi: accountAPI
+});
+
+const openIDConfigurationResource = createCORSResource("openid-configuration", {
+  parentId: wellKnownResource.id,
+  pathPart: "openid-configuration",
+  restApi: accountAPI
+});
+
+const openIDConfigurationIntegration = createLambdaMethod(
+  "openid-configuration-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "GET",
+    resource: openIDConfigurationResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: oauthFunction
+  }
+);
+
+const jwksResource = createCORSResource("jwks", {
+  parentId: wellKnownResource.id,
+  pathPart: "jwks.json",
+  restApi: accountAPI
+});
+
+const jwksIntegration = createLambdaMethod("jwks-integration", {
+  authorization: "NONE",
+  httpMethod: "GET",
+  resource: jwksResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: oauthFunction
+});
+
+const adminFunction = createLambdaFunction("admin-function", {
+  filepath: "admin",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-admin`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name
+      }
+    }
+  }
+});
+
+const adminResource = new aws.apigateway.Resource("admin", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "admin",
+  restApi: accountAPI
+});
+
+const adminUsersResource = createCORSResource("admin-users", {
+  parentId: adminResource.id,
+  pathPart: "users",
+  restApi: accountAPI
+});
+
+const searchUsersIntegration = createLambdaMethod("search-users-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "GET",
+  resource: adminUsersResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const adminUserResource = createCORSResource("admin-user", {
+  parentId: adminUsersResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const getUserIntegration = createLambdaMethod("admin-get-user-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "GET",
+  resource: adminUserResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const deleteUserIntegration = createLambdaMethod("delete-user-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "DELETE",
+  resource: adminUserResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const adminUserNameResource = createCORSResource("admin-user-name", {
+  parentId: adminUserResource.id,
+  pathPart: "name",
+  restApi: accountAPI
+});
+
+const renameUserIntegration = createLambdaMethod("rename-user-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "PUT",
+  resource: adminUserNameResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const adminUserSuspendResource = createCORSResource("admin-user-suspend", {
+  parentId: adminUserResource.id,
+  pathPart: "suspend",
+  restApi: accountAPI
+});
+
+const suspendUserIntegration = createLambdaMethod("suspend-user-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "POST",
+  resource: adminUserSuspendResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const adminUserUnsuspendResource = createCORSResource("admin-user-unsuspend", {
+  parentId: adminUserResource.id,
+  pathPart: "unsuspend",
+  restApi: accountAPI
+});
+
+const unsuspendUserIntegration = createLambdaMethod(
+  "unsuspend-user-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: adminUserUnsuspendResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminUserUnlockResource = createCORSResource("admin-user-unlock", {
+  parentId: adminUserResource.id,
+  pathPart: "unlock",
+  restApi: accountAPI
+});
+
+const unlockUserIntegration = createLambdaMethod("unlock-user-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "POST",
+  resource: adminUserUnlockResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const adminUserSessionsResource = createCORSResource("admin-user-sessions", {
+  parentId: adminUserResource.id,
+  pathPart: "sessions",
+  restApi: accountAPI
+});
+
+const revokeUserSessionsIntegration = createLambdaMethod(
+  "revoke-user-sessions-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "DELETE",
+    resource: adminUserSessionsResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminClientsResource = createCORSResource("admin-clients", {
+  parentId: adminResource.id,
+  pathPart: "clients",
+  restApi: accountAPI
+});
+
+const listClientsIntegration = createLambdaMethod("list-clients-integration", {
+  authorization: "CUSTOM",
+  httpMethod: "GET",
+  resource: adminClientsResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: adminFunction,
+  method: {
+    authorizerId: authorizer.id
+  }
+});
+
+const createClientIntegration = createLambdaMethod(
+  "create-client-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: adminClientsResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminClientResource = createCORSResource("admin-client", {
+  parentId: adminClientsResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const deleteClientIntegration = createLambdaMethod(
+  "delete-client-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "DELETE",
+    resource: adminClientResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminWebhooksResource = createCORSResource("admin-webhooks", {
+  parentId: adminResource.id,
+  pathPart: "webhooks",
+  restApi: accountAPI
+});
+
+const listWebhooksIntegration = createLambdaMethod(
+  "list-webhooks-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: adminWebhooksResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const createWebhookIntegration = createLambdaMethod(
+  "create-webhook-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: adminWebhooksResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminWebhookResource = createCORSResource("admin-webhook", {
+  parentId: adminWebhooksResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const deleteWebhookIntegration = createLambdaMethod(
+  "delete-webhook-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "DELETE",
+    resource: adminWebhookResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminWebhookEnableResource = createCORSResource("admin-webhook-enable", {
+  parentId: adminWebhookResource.id,
+  pathPart: "enable",
+  restApi: accountAPI
+});
+
+const enableWebhookIntegration = createLambdaMethod(
+  "enable-webhook-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: adminWebhookEnableResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminWebhookDeliveriesResource = createCORSResource(
+  "admin-webhook-deliveries",
+  {
+    parentId: adminWebhookResource.id,
+    pathPart: "deliveries",
+    restApi: accountAPI
+  }
+);
+
+const listDeliveriesIntegration = createLambdaMethod(
+  "list-deliveries-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: adminWebhookDeliveriesResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminTenantsResource = createCORSResource("admin-scim-tenants", {
+  parentId: adminResource.id,
+  pathPart: "scim-tenants",
+  restApi: accountAPI
+});
+
+const listTenantsIntegration = createLambdaMethod(
+  "list-scim-tenants-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: adminTenantsResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const createTenantIntegration = createLambdaMethod(
+  "create-scim-tenant-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: adminTenantsResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminTenantResource = createCORSResource("admin-scim-tenant", {
+  parentId: adminTenantsResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const deleteTenantIntegration = createLambdaMethod(
+  "delete-scim-tenant-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "DELETE",
+    resource: adminTenantResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const scimFunction = createLambdaFunction("scim-function", {
+  filepath: "scim",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-scim`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name,
+        domain: parameter.domain
+      }
+    }
+  }
+});
+
+const scimResource = new aws.apigateway.Resource("scim", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "scim",
+  restApi: accountAPI
+});
+
+const scimV2Resource = new aws.apigateway.Resource("scim-v2", {
+  parentId: scimResource.id,
+  pathPart: "v2",
+  restApi: accountAPI
+});
+
+const scimUsersResource = createCORSResource("scim-users", {
+  parentId: scimV2Resource.id,
+  pathPart: "Users",
+  restApi: accountAPI
+});
+
+const listScimUsersIntegration = createLambdaMethod(
+  "list-scim-users-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "GET",
+    resource: scimUsersResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const createScimUserIntegration = createLambdaMethod(
+  "create-scim-user-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "POST",
+    resource: scimUsersResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const scimUserResource = createCORSResource("scim-user", {
+  parentId: scimUsersResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const getScimUserIntegration = createLambdaMethod("get-scim-user-integration", {
+  authorization: "NONE",
+  httpMethod: "GET",
+  resource: scimUserResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: scimFunction
+});
+
+const replaceScimUserIntegration = createLambdaMethod(
+  "replace-scim-user-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "PUT",
+    resource: scimUserResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const patchScimUserIntegration = createLambdaMethod(
+  "patch-scim-user-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "PATCH",
+    resource: scimUserResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const deleteScimUserIntegration = createLambdaMethod(
+  "delete-scim-user-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "DELETE",
+    resource: scimUserResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const scimServiceProviderConfigResource = createCORSResource(
+  "scim-service-provider-config",
+  {
+    parentId: scimV2Resource.id,
+    pathPart: "ServiceProviderConfig",
+    restApi: accountAPI
+  }
+);
+
+const scimServiceProviderConfigIntegration = createLambdaMethod(
+  "scim-service-provider-config-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "GET",
+    resource: scimServiceProviderConfigResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const scimSchemasResource = createCORSResource("scim-schemas", {
+  parentId: scimV2Resource.id,
+  pathPart: "Schemas",
+  restApi: accountAPI
+});
+
+const listScimSchemasIntegration = createLambdaMethod(
+  "list-scim-schemas-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "GET",
+    resource: scimSchemasResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const scimSchemaResource = createCORSResource("scim-schema", {
+  parentId: scimSchemasResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const getScimSchemaIntegration = createLambdaMethod(
+  "get-scim-schema-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "GET",
+    resource: scimSchemaResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: scimFunction
+  }
+);
+
+const adminProvidersResource = createCORSResource("admin-saml-providers", {
+  parentId: adminResource.id,
+  pathPart: "saml-providers",
+  restApi: accountAPI
+});
+
+const listProvidersIntegration = createLambdaMethod(
+  "list-saml-providers-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "GET",
+    resource: adminProvidersResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const createProviderIntegration = createLambdaMethod(
+  "create-saml-provider-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "POST",
+    resource: adminProvidersResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const adminProviderResource = createCORSResource("admin-saml-provider", {
+  parentId: adminProvidersResource.id,
+  pathPart: "{id}",
+  restApi: accountAPI
+});
+
+const deleteProviderIntegration = createLambdaMethod(
+  "delete-saml-provider-integration",
+  {
+    authorization: "CUSTOM",
+    httpMethod: "DELETE",
+    resource: adminProviderResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: adminFunction,
+    method: {
+      authorizerId: authorizer.id
+    }
+  }
+);
+
+const samlFunction = createLambdaFunction("saml-function", {
+  filepath: "saml",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-saml`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name,
+        samlEntityID: config.saml.entityID,
+        samlACSURL: config.saml.acsURL
+      }
+    }
+  }
+});
+
+const samlResource = new aws.apigateway.Resource("saml", {
+  parentId: accountAPI.rootResourceId,
+  pathPart: "saml",
+  restApi: accountAPI
+});
+
+const samlMetadataResource = createCORSResource("saml-metadata", {
+  parentId: samlResource.id,
+  pathPart: "metadata",
+  restApi: accountAPI
+});
+
+const samlMetadataIntegration = createLambdaMethod(
+  "saml-metadata-integration",
+  {
+    authorization: "NONE",
+    httpMethod: "GET",
+    resource: samlMetadataResource,
+    restApi: accountAPI,
+    integration: {
+      type: "AWS_PROXY"
+    },
+    handler: samlFunction
+  }
+);
+
+const samlLoginResource = createCORSResource("saml-login", {
+  parentId: samlResource.id,
+  pathPart: "login",
+  restApi: accountAPI
+});
+
+const samlLoginIntegration = createLambdaMethod("saml-login-integration", {
+  authorization: "NONE",
+  httpMethod: "GET",
+  resource: samlLoginResource,
+  restApi: accountAPI,
+  integration: {
+    type: "AWS_PROXY"
+  },
+  handler: samlFunction
+});
+
+const webhookRetryFunction = createLambdaFunction("webhook-retry-function", {
+  filepath: "webhook-retry",
+  role: lambdaRole,
+  handlerName: `${config.service}-${config.stage}-webhook-retry`,
+  lambdaOptions: {
+    environment: {
+      variables: {
+        timestamp: new Date().toLocaleString(),
+        authTable: accountTable.name
+      }
+    }
+  }
+});
+
+const webhookRetrySchedule = new aws.cloudwatch.EventRule(
+  "webhook-retry-schedule",
+  {
+    scheduleExpression: "rate(1 minute)"
+  }
+);
+
+new aws.cloudwatch.EventTarget("webhook-retry-target", {
+  rule: webhookRetrySchedule.name,
+  arn: webhookRetryFunction.arn
+});
+
+new aws.lambda.Permission("webhook-retry-permission", {
+  action: "lambda:InvokeFunction",
+  function: webhookRetryFunction.name,
+  principal: "events.amazonaws.com",
+  sourceArn: webhookRetrySchedule.arn
+});
+
 const accountAPIDeployment = new aws.apigateway.Deployment(
   "account-api-deployment",
   {
@@ -406,7 +1699,59 @@ const accountAPIDeployment = new aws.apigateway.Deployment(
       twitterPostIntegration,
       twitterGetIntegration,
       getUserByNameIntegration,
-      putSelfIntegration
+      putSelfIntegration,
+      patchSelfIntegration,
+      changePasswordIntegration,
+      passwordResetIntegration,
+      passwordResetConfirmIntegration,
+      getActivityIntegration,
+      listSessionsIntegration,
+      revokeSessionIntegration,
+      listTokensIntegration,
+      createTokenIntegration,
+      revokeTokenIntegration,
+      describeAuthorizationIntegration,
+      authorizeIntegration,
+      oauthTokenIntegration,
+      getUserInfoIntegration,
+      postUserInfoIntegration,
+      introspectIntegration,
+      revokeIntegration,
+      openIDConfigurationIntegration,
+      jwksIntegration,
+      searchUsersIntegration,
+      getUserIntegration,
+      deleteUserIntegration,
+      renameUserIntegration,
+      suspendUserIntegration,
+      unsuspendUserIntegration,
+      unlockUserIntegration,
+      revokeUserSessionsIntegration,
+      listClientsIntegration,
+      createClientIntegration,
+      deleteClientIntegration,
+      listWebhooksIntegration,
+      createWebhookIntegration,
+      deleteWebhookIntegration,
+      enableWebhookIntegration,
+      listDeliveriesIntegration,
+      listTenantsIntegration,
+      createTenantIntegration,
+      deleteTenantIntegration,
+      listScimUsersIntegration,
+      createScimUserIntegration,
+      getScimUserIntegration,
+      replaceScimUserIntegration,
+      patchScimUserIntegration,
+      deleteScimUserIntegration,
+      scimServiceProviderConfigIntegration,
+      listScimSchemasIntegration,
+      getScimSchemaIntegration,
+      listProvidersIntegration,
+      createProviderIntegration,
+      deleteProviderIntegration,
+      samlMetadataIntegration,
+      samlLoginIntegration
     ]
   }
 );
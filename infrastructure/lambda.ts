@@ -24,7 +24,7 @@ export const createLambdaFunction = (
   }
 ) =>
   new aws.lambda.Function(name, {
-    runtime: aws.lambda.Go1dxRuntime,
+    runtime: aws.lambda.Runtime.Go1dx,
     code: new pulumi.asset.FileArchive(
       (async () => {
         await chpExec(
@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/ddb"
+)
+
+// Event types of the audit log
+const (
+	SigninSucceeded = "signin_succeeded"
+	SigninFailed    = "signin_failed"
+	Signup          = "signup"
+	NameChanged     = "name_changed"
+	ProfileUpdated  = "profile_updated"
+	PasswordChanged = "password_changed"
+	PasswordReset   = "password_reset"
+	IdentityLinked  = "identity_linked"
+	TokenCreated    = "token_created"
+	TokenRevoked    = "token_revoked"
+	Suspended       = "account_suspended"
+	Unsuspended     = "account_unsuspended"
+	Unlocked        = "account_unlocked"
+	UserDeleted     = "user_deleted"
+	WebhookCreated  = "webhook_created"
+	WebhookDeleted  = "webhook_deleted"
+	WebhookEnabled  = "webhook_enabled"
+	ConsentGranted  = "consent_granted"
+	ClientCreated   = "client_created"
+	ClientDeleted   = "client_deleted"
+	TenantCreated   = "scim_tenant_created"
+	TenantDeleted   = "scim_tenant_deleted"
+	ProviderCreated = "saml_provider_created"
+	ProviderDeleted = "saml_provider_deleted"
+)
+
+// Entry is an append-only record of a security-relevant event
+// Never put request bodies or secrets into Detail
+type Entry struct {
+	ID        string            `json:"-" dynamo:"id"`
+	Sort      string            `json:"-" dynamo:"sort"`
+	EntryID   string            `json:"id" dynamo:"entry_id"`
+	UserID    string            `json:"user_id" dynamo:"user_id"`
+	Event     string            `json:"event" dynamo:"event"`
+	Method    string            `json:"method,omitempty" dynamo:"method"`
+	SourceIP  string            `json:"source_ip" dynamo:"source_ip"`
+	UserAgent string            `json:"user_agent" dynamo:"user_agent"`
+	Detail    map[string]string `json:"detail,omitempty" dynamo:"detail"`
+	CreatedAt time.Time         `json:"created_at" dynamo:"created_at"`
+}
+
+// Source is where the request came from
+type Source struct {
+	SourceIP  string
+	UserAgent string
+}
+
+func SourceOf(request events.APIGatewayProxyRequest) Source {
+	return Source{
+		SourceIP:  request.RequestContext.Identity.SourceIP,
+		UserAgent: request.RequestContext.Identity.UserAgent,
+	}
+}
+
+// -- Audit Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// Append writes a new entry, existing entries are never overwritten
+func (repo Repository) Append(userID string, event string, method string, source Source, detail map[string]string) error {
+	now := time.Now().UTC()
+	entryID := uuid.NewV4().String()
+
+	return repo.table.
+		Put(Entry{
+			ID:        userID,
+			Sort:      "activity##" + now.Format(ddb.SortTimeFormat) + "##" + entryID,
+			EntryID:   entryID,
+			UserID:    userID,
+			Event:     event,
+			Method:    method,
+			SourceIP:  source.SourceIP,
+			UserAgent: source.UserAgent,
+			Detail:    detail,
+			CreatedAt: now,
+		}).
+		If("attribute_not_exists(id)").
+		Run()
+}
+
+// List entries of the user, newest first
+// cursor string: the cursor returned by the previous call, or empty string for the first page
+func (repo Repository) List(userID string, limit int64, cursor string) ([]Entry, string, error) {
+	query := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.BeginsWith, "activity##").
+		Order(dynamo.Descending).
+		Limit(limit)
+	if cursor != "" {
+		query = query.StartFrom(dynamo.PagingKey{
+			"id":   {S: &userID},
+			"sort": {S: &cursor},
+		})
+	}
+
+	entries := []Entry{}
+	lastKey, err := query.AllWithLastEvaluatedKey(&entries)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if lastKey != nil && lastKey["sort"] != nil && lastKey["sort"].S != nil {
+		next = *lastKey["sort"].S
+	}
+
+	return entries, next, nil
+}
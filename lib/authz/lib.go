@@ -0,0 +1,192 @@
+package authz
+
+import "strings"
+
+// Roles of the account
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Scopes limit what a credential can do
+const (
+	ProfileWrite  = "profile:write"
+	PasswordWrite = "password:write"
+	ActivityRead  = "activity:read"
+	SessionsRead  = "sessions:read"
+	SessionsWrite = "sessions:write"
+	TokensRead    = "tokens:read"
+	TokensWrite   = "tokens:write"
+	ConsentsWrite = "consents:write"
+	UsersRead     = "users:read"
+	UsersWrite    = "users:write"
+	ClientsRead   = "clients:read"
+	ClientsWrite  = "clients:write"
+	// The identity providers are trusted for signin, the scopes are not granted to backend services
+	ProvidersRead  = "providers:read"
+	ProvidersWrite = "providers:write"
+)
+
+// KnownScopes can be granted to accounts and personal access tokens
+var KnownScopes = []string{
+	ProfileWrite,
+	PasswordWrite,
+	ActivityRead,
+	SessionsRead,
+	SessionsWrite,
+	TokensRead,
+	TokensWrite,
+	ConsentsWrite,
+	UsersRead,
+	UsersWrite,
+	ClientsRead,
+	ClientsWrite,
+	ProvidersRead,
+	ProvidersWrite,
+}
+
+var selfScopes = []string{
+	ProfileWrite,
+	PasswordWrite,
+	ActivityRead,
+	SessionsRead,
+	SessionsWrite,
+	TokensRead,
+	TokensWrite,
+	ConsentsWrite,
+}
+
+// RoleScopes are granted to every account of the role
+var RoleScopes = map[string][]string{
+	RoleUser:      selfScopes,
+	RoleModerator: union(selfScopes, []string{UsersRead}),
+	RoleAdmin:     union(selfScopes, []string{UsersRead, UsersWrite, ClientsRead, ClientsWrite, ProvidersRead, ProvidersWrite}),
+}
+
+// ServiceScopes can be granted to the tokens of backend services, the other scopes act on the user of the token
+var ServiceScopes = []string{
+	UsersRead,
+	UsersWrite,
+	ClientsRead,
+	ClientsWrite,
+}
+
+// Route requires Scope for the method of the API Gateway resource
+// Path parameters are written as {name} like in the resource definition
+type Route struct {
+	Method   string
+	Resource string
+	Scope    string
+}
+
+// Routes protected by the authorizer, any route missing here is denied
+var Routes = []Route{
+	{Method: "PUT", Resource: "/self", Scope: ProfileWrite},
+	{Method: "PATCH", Resource: "/self", Scope: ProfileWrite},
+	{Method: "POST", Resource: "/self/password", Scope: PasswordWrite},
+	{Method: "GET", Resource: "/self/activity", Scope: ActivityRead},
+	{Method: "GET", Resource: "/self/sessions", Scope: SessionsRead},
+	{Method: "DELETE", Resource: "/self/sessions/{id}", Scope: SessionsWrite},
+	{Method: "GET", Resource: "/self/tokens", Scope: TokensRead},
+	{Method: "POST", Resource: "/self/tokens", Scope: TokensWrite},
+	{Method: "DELETE", Resource: "/self/tokens/{id}", Scope: TokensWrite},
+	{Method: "GET", Resource: "/oauth/authorize", Scope: ConsentsWrite},
+	{Method: "POST", Resource: "/oauth/authorize", Scope: ConsentsWrite},
+	{Method: "GET", Resource: "/admin/users", Scope: UsersRead},
+	{Method: "GET", Resource: "/admin/users/{id}", Scope: UsersRead},
+	{Method: "DELETE", Resource: "/admin/users/{id}", Scope: UsersWrite},
+	{Method: "PUT", Resource: "/admin/users/{id}/name", Scope: UsersWrite},
+	{Method: "POST", Resource: "/admin/users/{id}/suspend", Scope: UsersWrite},
+	{Method: "POST", Resource: "/admin/users/{id}/unsuspend", Scope: UsersWrite},
+	{Method: "POST", Resource: "/admin/users/{id}/unlock", Scope: UsersWrite},
+	{Method: "DELETE", Resource: "/admin/users/{id}/sessions", Scope: UsersWrite},
+	{Method: "GET", Resource: "/admin/clients", Scope: ClientsRead},
+	{Method: "POST", Resource: "/admin/clients", Scope: ClientsWrite},
+	{Method: "DELETE", Resource: "/admin/clients/{id}", Scope: ClientsWrite},
+	{Method: "GET", Resource: "/admin/webhooks", Scope: ClientsRead},
+	{Method: "POST", Resource: "/admin/webhooks", Scope: ClientsWrite},
+	{Method: "DELETE", Resource: "/admin/webhooks/{id}", Scope: ClientsWrite},
+	{Method: "POST", Resource: "/admin/webhooks/{id}/enable", Scope: ClientsWrite},
+	{Method: "GET", Resource: "/admin/webhooks/{id}/deliveries", Scope: ClientsRead},
+	{Method: "GET", Resource: "/admin/scim-tenants", Scope: ClientsRead},
+	{Method: "POST", Resource: "/admin/scim-tenants", Scope: ClientsWrite},
+	{Method: "DELETE", Resource: "/admin/scim-tenants/{id}", Scope: ClientsWrite},
+	{Method: "GET", Resource: "/admin/saml-providers", Scope: ProvidersRead},
+	{Method: "POST", Resource: "/admin/saml-providers", Scope: ProvidersWrite},
+	{Method: "DELETE", Resource: "/admin/saml-providers/{id}", Scope: ProvidersWrite},
+}
+
+func IsKnown(scope string) bool {
+	return Has(KnownScopes, scope)
+}
+
+func IsRole(role string) bool {
+	_, ok := RoleScopes[role]
+	return ok
+}
+
+// RoleOf treats an empty or unknown role as RoleUser, accounts created before roles have no role
+func RoleOf(role string) string {
+	if !IsRole(role) {
+		return RoleUser
+	}
+
+	return role
+}
+
+func Has(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EffectiveScopes are the scopes of the role and the ones granted to the account individually
+func EffectiveScopes(role string, granted []string) []string {
+	known := []string{}
+	for _, scope := range granted {
+		if IsKnown(scope) {
+			known = append(known, scope)
+		}
+	}
+
+	return union(RoleScopes[RoleOf(role)], known)
+}
+
+// Intersect returns the scopes in both, used to keep tokens within the scopes of the account
+func Intersect(scopes []string, allowed []string) []string {
+	result := []string{}
+	for _, scope := range scopes {
+		if Has(allowed, scope) && !Has(result, scope) {
+			result = append(result, scope)
+		}
+	}
+
+	return result
+}
+
+func union(a []string, b []string) []string {
+	result := []string{}
+	for _, scopes := range [][]string{a, b} {
+		for _, scope := range scopes {
+			if !Has(result, scope) {
+				result = append(result, scope)
+			}
+		}
+	}
+
+	return result
+}
+
+// JoinScopes encodes scopes for the authorizer context, which only accepts primitive values
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+func SplitScopes(scopes string) []string {
+	return strings.Fields(scopes)
+}
@@ -1,22 +0,0 @@
-package bcrypt
-
-import (
-	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
-)
-
-func HashPassword(pw string) (string, error) {
-	if len(pw) >= 73 {
-		return "", errors.New("Password length must be less than 72")
-	}
-
-	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-	return string(hash), err
-}
-
-func VerifyPassword(hash, pw string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw))
-}
@@ -0,0 +1,25 @@
+package ddb
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SortTimeFormat is a timestamp for sort keys which sorts in time order, RFC3339Nano trims trailing zeros
+const SortTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// IsCondCheckFailed reports whether the error is caused by the condition expression of the write
+// A transaction canceled by the condition of any of the writes is reported as well
+func IsCondCheckFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == dynamodb.ErrCodeTransactionCanceledException {
+			return strings.Contains(aerr.Message(), "ConditionalCheckFailed")
+		}
+
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+
+	return false
+}
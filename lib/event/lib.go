@@ -0,0 +1,351 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+// SchemaVersion is incremented on breaking changes of the event schema
+const SchemaVersion = "1"
+
+// Type of the account events, published as the event_type message attribute
+const (
+	UserCreated    = "user.created"
+	UserUpdated    = "user.updated"
+	UserRenamed    = "user.renamed"
+	UserDeleted    = "user.deleted"
+	IdentityLinked = "identity.linked"
+)
+
+var Types = []string{UserCreated, UserUpdated, UserRenamed, UserDeleted, IdentityLinked}
+
+// MatchType matches the exact event type, a prefix such as "user.*" or "*" for every type
+func MatchType(pattern string, eventType string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, ".*") {
+		return strings.HasPrefix(eventType, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return pattern == eventType
+}
+
+// IsType accepts a pattern matching some event type
+func IsType(pattern string) bool {
+	for _, eventType := range Types {
+		if MatchType(pattern, eventType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Event is the account event, published as the data of a CloudEvent
+type Event struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	SchemaVersion string          `json:"schema_version"`
+	UserID        string          `json:"user_id"`
+	Time          time.Time       `json:"time"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// User is the public part of the user record
+type User struct {
+	ID          string    `json:"id" dynamo:"id"`
+	Name        string    `json:"name" dynamo:"name"`
+	Picture     string    `json:"picture" dynamo:"picture"`
+	DisplayName string    `json:"display_name" dynamo:"display_name"`
+	Email       string    `json:"email" dynamo:"email"`
+	Role        string    `json:"role,omitempty" dynamo:"role"`
+	Status      string    `json:"status,omitempty" dynamo:"status"`
+	CreatedAt   time.Time `json:"created_at" dynamo:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" dynamo:"updated_at"`
+	Version     int64     `json:"version" dynamo:"version"`
+}
+
+type UserCreatedData struct {
+	User User `json:"user"`
+}
+
+// UserUpdatedData is published for changes other than the name, which is UserRenamed
+type UserUpdatedData struct {
+	User          User     `json:"user"`
+	ChangedFields []string `json:"changed_fields"`
+}
+
+type UserRenamedData struct {
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
+}
+
+type UserDeletedData struct {
+	User User `json:"user"`
+}
+
+type IdentityLinkedData struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+}
+
+var ErrUnsupportedVersion = errors.New("Unsupported schema version")
+
+func New(id string, eventType string, userID string, at time.Time, data interface{}) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:            id,
+		Type:          eventType,
+		SchemaVersion: SchemaVersion,
+		UserID:        userID,
+		Time:          at.UTC(),
+		Data:          raw,
+	}, nil
+}
+
+// Parse the published CloudEvent, the data is decoded by DecodeData
+func Parse(message []byte) (Event, error) {
+	var cloudEvent CloudEvent
+	if err := json.Unmarshal(message, &cloudEvent); err != nil {
+		return Event{}, err
+	}
+	if cloudEvent.SpecVersion != CloudEventsVersion || cloudEvent.SchemaVersion != SchemaVersion {
+		return Event{}, ErrUnsupportedVersion
+	}
+
+	return Event{
+		ID:            cloudEvent.ID,
+		Type:          strings.TrimPrefix(cloudEvent.Type, TypePrefix),
+		SchemaVersion: cloudEvent.SchemaVersion,
+		UserID:        cloudEvent.Subject,
+		Time:          cloudEvent.Time,
+		Data:          cloudEvent.Data,
+	}, nil
+}
+
+// DecodeData decodes the data into the struct for the type, e.g. *UserRenamedData for UserRenamed
+func (event Event) DecodeData(data interface{}) error {
+	return json.Unmarshal(event.Data, data)
+}
+
+// -- CloudEvents --
+
+const CloudEventsVersion = "1.0"
+
+// Source of the CloudEvents
+const Source = "portals-me.com/account"
+
+// TypePrefix makes the type of the CloudEvent in reverse-DNS, e.g. me.portals.account.user.created
+const TypePrefix = "me.portals.account."
+
+// CloudEvent is the CloudEvents 1.0 JSON format of the event
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	// extension attribute for SchemaVersion of the data
+	SchemaVersion string          `json:"schemaversion"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// CloudEvent wraps the event, the subject is the user ID
+func (event Event) CloudEvent() CloudEvent {
+	return CloudEvent{
+		SpecVersion:     CloudEventsVersion,
+		ID:              event.ID,
+		Source:          Source,
+		Type:            TypePrefix + event.Type,
+		Subject:         event.UserID,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		SchemaVersion:   event.SchemaVersion,
+		Data:            event.Data,
+	}
+}
+
+// EventType is the type without TypePrefix, as the constants of this package
+func (cloudEvent CloudEvent) EventType() string {
+	return strings.TrimPrefix(cloudEvent.Type, TypePrefix)
+}
+
+// -- DynamoDB Stream --
+
+// Auth records of the external identity providers, keyed by sort prefix
+// The password record is keyed by the name and moved on rename, so it is covered by UserCreated
+var identityProviders = map[string]string{
+	"twitter##": "twitter",
+	"google##":  "google",
+	"saml##":    "saml",
+	"github##":  "github",
+}
+
+// fields compared for UserUpdated, the name is published as UserRenamed
+var updatableFields = []string{"picture", "display_name", "email", "role", "scopes", "status", "status_reason", "status_until"}
+
+// FromStreamRecord derives the events of the record
+// The stream must have NEW_AND_OLD_IMAGES, records of no interest result in no events
+func FromStreamRecord(record events.DynamoDBEventRecord) ([]Event, error) {
+	// The IDs are deterministic, a record delivered again by the stream results in the same IDs
+	nextID := eventIDs(record.Change.SequenceNumber)
+	keys := record.Change.Keys
+	userID := keys["id"].String()
+	sort := keys["sort"].String()
+	at := record.Change.ApproximateCreationDateTime.Time
+
+	if sort == "detail" {
+		return fromUserRecord(nextID, record.EventName, userID, at, record.Change.OldImage, record.Change.NewImage)
+	}
+
+	for prefix, provider := range identityProviders {
+		if strings.HasPrefix(sort, prefix) && record.EventName == string(events.DynamoDBOperationTypeInsert) {
+			event, err := New(nextID(), IdentityLinked, userID, at, IdentityLinkedData{
+				Provider: provider,
+				Subject:  strings.TrimPrefix(sort, prefix),
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return []Event{event}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// eventIDs numbers the events of the record after the sequence number, which is unique in the stream
+func eventIDs(sequenceNumber string) func() string {
+	index := 0
+	return func() string {
+		index++
+		return fmt.Sprintf("%s-%d", sequenceNumber, index)
+	}
+}
+
+func fromUserRecord(nextID func() string, eventName string, userID string, at time.Time, oldImage map[string]events.DynamoDBAttributeValue, newImage map[string]events.DynamoDBAttributeValue) ([]Event, error) {
+	switch events.DynamoDBOperationType(eventName) {
+	case events.DynamoDBOperationTypeInsert:
+		var user User
+		if err := unmarshalImage(newImage, &user); err != nil {
+			return nil, err
+		}
+
+		event, err := New(nextID(), UserCreated, userID, at, UserCreatedData{User: user})
+		if err != nil {
+			return nil, err
+		}
+
+		return []Event{event}, nil
+	case events.DynamoDBOperationTypeModify:
+		if oldImage == nil {
+			return nil, errors.New("OldImage is missing, the stream must have NEW_AND_OLD_IMAGES")
+		}
+
+		var user User
+		if err := unmarshalImage(newImage, &user); err != nil {
+			return nil, err
+		}
+
+		result := []Event{}
+		oldName, newName := stringOf(oldImage, "name"), stringOf(newImage, "name")
+		if oldName != newName {
+			event, err := New(nextID(), UserRenamed, userID, at, UserRenamedData{
+				OldName: oldName,
+				NewName: newName,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, event)
+		}
+
+		changedFields := []string{}
+		for _, field := range updatableFields {
+			if !equalAttribute(oldImage, newImage, field) {
+				changedFields = append(changedFields, field)
+			}
+		}
+		if len(changedFields) != 0 {
+			event, err := New(nextID(), UserUpdated, userID, at, UserUpdatedData{
+				User:          user,
+				ChangedFields: changedFields,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, event)
+		}
+
+		return result, nil
+	case events.DynamoDBOperationTypeRemove:
+		var user User
+		if err := unmarshalImage(oldImage, &user); err != nil {
+			return nil, err
+		}
+
+		event, err := New(nextID(), UserDeleted, userID, at, UserDeletedData{User: user})
+		if err != nil {
+			return nil, err
+		}
+
+		return []Event{event}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown event name: %s", eventName)
+}
+
+// unmarshalImage decodes the stream image as a table item, both share the attribute value encoding
+func unmarshalImage(image map[string]events.DynamoDBAttributeValue, out interface{}) error {
+	raw, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+
+	var item map[string]*dynamodb.AttributeValue
+	if err := json.Unmarshal(raw, &item); err != nil {
+		return err
+	}
+
+	return dynamo.UnmarshalItem(item, out)
+}
+
+// zero values of events.DynamoDBAttributeValue can not be used, missing attributes must be checked first
+func stringOf(image map[string]events.DynamoDBAttributeValue, field string) string {
+	value, ok := image[field]
+	if !ok || value.DataType() != events.DataTypeString {
+		return ""
+	}
+
+	return value.String()
+}
+
+func equalAttribute(oldImage map[string]events.DynamoDBAttributeValue, newImage map[string]events.DynamoDBAttributeValue, field string) bool {
+	oldValue, oldOk := oldImage[field]
+	newValue, newOk := newImage[field]
+	if !oldOk || !newOk {
+		return oldOk == newOk
+	}
+
+	rawOld, _ := json.Marshal(oldValue)
+	rawNew, _ := json.Marshal(newValue)
+
+	return string(rawOld) == string(rawNew)
+}
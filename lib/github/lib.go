@@ -0,0 +1,138 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tokenURL = "https://github.com/login/oauth/access_token"
+const apiURL = "https://api.github.com"
+
+// Code is the authorization code the web app received at the callback
+// RedirectURI must be the same as the one of the authorization request, if it was given
+type Code struct {
+	Code        string `json:"code"`
+	RedirectURI string `json:"redirect_uri"`
+}
+
+type Config struct {
+	Code
+	ClientID     string
+	ClientSecret string
+}
+
+// User is the GitHub user, Email is the verified primary email or empty
+type User struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url"`
+	Email     string `json:"-"`
+}
+
+// IDString is the ID used in the auth record
+func (user User) IDString() string {
+	return strconv.FormatInt(user.ID, 10)
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type email struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// The Lambda times out in 10 seconds, both requests must finish within it
+var client = &http.Client{Timeout: 4 * time.Second}
+
+// exchangeCode for the access token, the code can be exchanged only once
+func (config Config) exchangeCode() (string, error) {
+	form := url.Values{}
+	form.Set("client_id", config.ClientID)
+	form.Set("client_secret", config.ClientSecret)
+	form.Set("code", config.Code.Code)
+	if config.RedirectURI != "" {
+		form.Set("redirect_uri", config.RedirectURI)
+	}
+
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// GitHub returns 200 with error for an invalid code
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("Invalid GitHub code: " + token.Error)
+	}
+
+	return token.AccessToken, nil
+}
+
+func get(accessToken string, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.New("GitHub API " + path + " failed: " + resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GetGitHubUser exchanges the code, and fetches the user and the verified primary email
+// The email is left empty unless the user:email scope is granted and the primary email is verified
+func (config Config) GetGitHubUser(user *User) error {
+	accessToken, err := config.exchangeCode()
+	if err != nil {
+		return err
+	}
+
+	if err := get(accessToken, "/user", user); err != nil {
+		return err
+	}
+
+	// The emails are not available without the user:email scope, the signin goes on without the email
+	var emails []email
+	if err := get(accessToken, "/user/emails", &emails); err != nil {
+		return nil
+	}
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			user.Email = email.Email
+		}
+	}
+
+	return nil
+}
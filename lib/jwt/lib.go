@@ -1,15 +1,45 @@
 package jwt
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"time"
 
 	jwt "github.com/gbrlsnchs/jwt/v3"
+	uuid "github.com/satori/go.uuid"
 )
 
+// Lifetime of tokens
+const Lifetime = 24 * 30 * time.Hour
+
+// Issuer of the tokens for this API
+const Issuer = "portals-me.com"
+
+// Subject types of the tokens, tokens without sub_type are of users
+const (
+	SubjectUser    = "user"
+	SubjectService = "service"
+)
+
+// Claims are private claims besides the user data
+type Claims struct {
+	SessionID string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+	// space-separated like OAuth 2.0 scope
+	Scope string `json:"scope,omitempty"`
+	// OAuth client the token is issued to, empty for the tokens of signin
+	ClientID string `json:"client_id,omitempty"`
+	// SubjectService for the client credentials grant, Data is the client then
+	SubjectType string `json:"sub_type,omitempty"`
+}
+
 type JwtPayload struct {
 	jwt.Payload
+	Claims
 	Data []byte `json:"data"`
 }
 
@@ -22,33 +52,53 @@ type ES256Signer struct {
 }
 
 func (signer ES256Signer) Sign(payload []byte) ([]byte, error) {
-	now := time.Now()
-	block, _ := pem.Decode([]byte(signer.Key))
-	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
-	es256 := jwt.NewECDSA(jwt.SHA256, privateKey, &privateKey.PublicKey)
+	return signer.SignWithClaims(payload, Claims{})
+}
+
+func (signer ES256Signer) SignWithClaims(payload []byte, claims Claims) ([]byte, error) {
+	return signer.SignWithLifetime(payload, claims, Lifetime)
+}
 
+// SignWithLifetime signs the token expiring after lifetime instead of Lifetime
+func (signer ES256Signer) SignWithLifetime(payload []byte, claims Claims, lifetime time.Duration) ([]byte, error) {
+	now := time.Now()
+	privateKey, err := signer.privateKey()
 	if err != nil {
 		return nil, err
 	}
+	es256 := jwt.NewECDSA(jwt.SHA256, privateKey, &privateKey.PublicKey)
 
 	h := jwt.Header{
-		KeyID:     "kid",
+		KeyID:     publicJWK(&privateKey.PublicKey).KeyID,
 		Algorithm: "ES256",
 		Type:      "JWT",
 	}
 	p := JwtPayload{
 		Payload: jwt.Payload{
-			Issuer:         "portals-me.com",
-			ExpirationTime: now.Add(24 * 30 * time.Hour).Unix(),
+			Issuer:         Issuer,
+			ExpirationTime: now.Add(lifetime).Unix(),
 			IssuedAt:       now.Unix(),
+			// jti identifies the token to be revoked by /revoke
+			JWTID: uuid.NewV4().String(),
 		},
-		Data: payload,
+		Claims: claims,
+		Data:   payload,
 	}
 
 	return jwt.Sign(h, p, es256)
 }
 
 func (signer ES256Signer) Verify(token []byte) ([]byte, error) {
+	p, err := signer.VerifyPayload(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Data, nil
+}
+
+// VerifyPayload verifies the token and returns the whole payload including registered claims
+func (signer ES256Signer) VerifyPayload(token []byte) (JwtPayload, error) {
 	now := time.Now()
 	block, _ := pem.Decode([]byte(signer.Key))
 	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
@@ -56,23 +106,114 @@ func (signer ES256Signer) Verify(token []byte) ([]byte, error) {
 
 	raw, err := jwt.Parse(token)
 	if err != nil {
-		return nil, err
+		return JwtPayload{}, err
 	}
 	if err = raw.Verify(es256); err != nil {
-		return nil, err
+		return JwtPayload{}, err
 	}
 
 	var p JwtPayload
 	if _, err = raw.Decode(&p); err != nil {
-		return nil, err
+		return JwtPayload{}, err
 	}
 
-	issValidator := jwt.IssuerValidator("portals-me.com")
+	issValidator := jwt.IssuerValidator(Issuer)
 	iatValidator := jwt.IssuedAtValidator(now)
 	expValidator := jwt.ExpirationTimeValidator(now, true)
 	if err := p.Validate(issValidator, iatValidator, expValidator); err != nil {
+		return JwtPayload{}, err
+	}
+
+	return p, nil
+}
+
+// SignPayload signs the payload as is, for the tokens of other formats such as OpenID Connect ID tokens
+func (signer ES256Signer) SignPayload(payload interface{}) ([]byte, error) {
+	privateKey, err := signer.privateKey()
+	if err != nil {
 		return nil, err
 	}
 
-	return p.Data, nil
+	h := jwt.Header{
+		KeyID:     publicJWK(&privateKey.PublicKey).KeyID,
+		Algorithm: "ES256",
+		Type:      "JWT",
+	}
+
+	return jwt.Sign(h, payload, jwt.NewECDSA(jwt.SHA256, privateKey, &privateKey.PublicKey))
+}
+
+// JWK is the public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// PublicJWK returns the public key for the clients verifying the tokens
+func (signer ES256Signer) PublicJWK() (JWK, error) {
+	privateKey, err := signer.privateKey()
+	if err != nil {
+		return JWK{}, err
+	}
+
+	return publicJWK(&privateKey.PublicKey), nil
+}
+
+// Thumbprint of the key by RFC 7638, base64url of SHA-256 of the required members in lexicographic order
+func (jwk JWK) Thumbprint() string {
+	sum := sha256.Sum256([]byte(`{"crv":"` + jwk.Curve + `","kty":"` + jwk.KeyType + `","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// publicJWK of the P-256 key, identified by the thumbprint
+func publicJWK(publicKey *ecdsa.PublicKey) JWK {
+	// P-256 coordinates are 32 bytes, padded with zeros
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	xBytes := publicKey.X.Bytes()
+	yBytes := publicKey.Y.Bytes()
+	copy(x[32-len(xBytes):], xBytes)
+	copy(y[32-len(yBytes):], yBytes)
+
+	jwk := JWK{
+		KeyType:   "EC",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(x),
+		Y:         base64.RawURLEncoding.EncodeToString(y),
+		Use:       "sig",
+		Algorithm: "ES256",
+	}
+	jwk.KeyID = jwk.Thumbprint()
+
+	return jwk
+}
+
+func (signer ES256Signer) privateKey() (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(signer.Key))
+	if block == nil {
+		return nil, errors.New("Invalid private key")
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// Decode the token without verification, only for debugging
+func Decode(token []byte) (JwtPayload, error) {
+	raw, err := jwt.Parse(token)
+	if err != nil {
+		return JwtPayload{}, err
+	}
+
+	var p JwtPayload
+	if _, err = raw.Decode(&p); err != nil {
+		return JwtPayload{}, err
+	}
+
+	return p, nil
 }
@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+// Status of a migration
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusApplied = "applied"
+)
+
+// Migration rewrites the items of the table matching Filter one by one
+// Apply must be idempotent, since a page can be processed again when the migration is resumed
+type Migration struct {
+	ID          string
+	Description string
+	// Filter is a filter expression for the scan, every item is passed to Apply if empty
+	Filter     string
+	FilterArgs []interface{}
+	// Apply rewrites the item and returns whether the item has been changed
+	// The item must not be written when dryRun is true
+	Apply func(table dynamo.Table, item map[string]interface{}, dryRun bool) (bool, error)
+}
+
+// State is recorded in the table for each migration, with the checkpoint to resume from
+type State struct {
+	ID             string    `json:"-" dynamo:"id"`
+	Sort           string    `json:"-" dynamo:"sort"`
+	MigrationID    string    `json:"id" dynamo:"migration_id"`
+	Status         string    `json:"status" dynamo:"status"`
+	CheckpointID   string    `json:"checkpoint_id,omitempty" dynamo:"checkpoint_id"`
+	CheckpointSort string    `json:"checkpoint_sort,omitempty" dynamo:"checkpoint_sort"`
+	Scanned        int64     `json:"scanned" dynamo:"scanned"`
+	Updated        int64     `json:"updated" dynamo:"updated"`
+	StartedAt      time.Time `json:"started_at,omitempty" dynamo:"started_at"`
+	AppliedAt      time.Time `json:"applied_at,omitempty" dynamo:"applied_at"`
+}
+
+func sortKey(migrationID string) string {
+	return "migration##" + migrationID
+}
+
+// -- Migration Runner --
+
+type Runner struct {
+	table    dynamo.Table
+	PageSize int64
+	DryRun   bool
+	Log      io.Writer
+}
+
+func NewRunner(table dynamo.Table, log io.Writer) Runner {
+	return Runner{
+		table:    table,
+		PageSize: 100,
+		Log:      log,
+	}
+}
+
+// State of the migration, StatusPending if it has never been run
+func (runner Runner) State(migration Migration) (State, error) {
+	var state State
+	if err := runner.table.
+		Get("id", "migration").
+		Range("sort", dynamo.Equal, sortKey(migration.ID)).
+		Consistent(true).
+		One(&state); err != nil {
+		if err == dynamo.ErrNotFound {
+			return State{
+				ID:          "migration",
+				Sort:        sortKey(migration.ID),
+				MigrationID: migration.ID,
+				Status:      StatusPending,
+			}, nil
+		}
+
+		return State{}, err
+	}
+
+	return state, nil
+}
+
+// Run applies the migrations in order, skipping the applied ones
+// An interrupted migration is resumed from the last checkpoint
+func (runner Runner) Run(migrations []Migration) error {
+	for _, migration := range migrations {
+		state, err := runner.State(migration)
+		if err != nil {
+			return err
+		}
+
+		if state.Status == StatusApplied {
+			fmt.Fprintf(runner.Log, "%s: already applied\n", migration.ID)
+			continue
+		}
+
+		if err := runner.run(migration, state); err != nil {
+			return fmt.Errorf("%s: %v", migration.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (runner Runner) run(migration Migration, state State) error {
+	if state.Status == StatusRunning {
+		fmt.Fprintf(runner.Log, "%s: resuming after %s/%s\n", migration.ID, state.CheckpointID, state.CheckpointSort)
+	} else {
+		fmt.Fprintf(runner.Log, "%s: %s\n", migration.ID, migration.Description)
+		state.Status = StatusRunning
+		state.StartedAt = time.Now().UTC()
+	}
+
+	// In dry-run mode the checkpoint is kept in memory only
+	var startKey dynamo.PagingKey
+	if state.CheckpointID != "" {
+		startKey = dynamo.PagingKey{
+			"id":   {S: aws.String(state.CheckpointID)},
+			"sort": {S: aws.String(state.CheckpointSort)},
+		}
+	}
+
+	for {
+		scan := runner.table.Scan().SearchLimit(runner.PageSize).Consistent(true)
+		if migration.Filter != "" {
+			scan = scan.Filter(migration.Filter, migration.FilterArgs...)
+		}
+		if startKey != nil {
+			scan = scan.StartFrom(startKey)
+		}
+
+		var items []map[string]interface{}
+		lastKey, err := scan.AllWithLastEvaluatedKey(&items)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			changed, err := migration.Apply(runner.table, item, runner.DryRun)
+			if err != nil {
+				return fmt.Errorf("item %v/%v: %v", item["id"], item["sort"], err)
+			}
+
+			state.Scanned++
+			if changed {
+				state.Updated++
+			}
+		}
+
+		if lastKey == nil {
+			break
+		}
+
+		startKey = lastKey
+		state.CheckpointID = stringOf(lastKey["id"])
+		state.CheckpointSort = stringOf(lastKey["sort"])
+		if err := runner.save(state); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(runner.Log, "%s: %d items, %d updated\n", migration.ID, state.Scanned, state.Updated)
+	}
+
+	state.Status = StatusApplied
+	state.AppliedAt = time.Now().UTC()
+	state.CheckpointID = ""
+	state.CheckpointSort = ""
+	if err := runner.save(state); err != nil {
+		return err
+	}
+
+	if runner.DryRun {
+		fmt.Fprintf(runner.Log, "%s: %d items, %d would be updated (dry run)\n", migration.ID, state.Scanned, state.Updated)
+	} else {
+		fmt.Fprintf(runner.Log, "%s: applied, %d items, %d updated\n", migration.ID, state.Scanned, state.Updated)
+	}
+
+	return nil
+}
+
+func (runner Runner) save(state State) error {
+	if runner.DryRun {
+		return nil
+	}
+
+	return runner.table.Put(state).Run()
+}
+
+func stringOf(value *dynamodb.AttributeValue) string {
+	if value == nil || value.S == nil {
+		return ""
+	}
+
+	return *value.S
+}
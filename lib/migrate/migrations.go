@@ -0,0 +1,59 @@
+package migrate
+
+import (
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/ddb"
+)
+
+// All migrations in the order to be applied, never reorder or remove the applied ones
+var All = []Migration{
+	{
+		ID:          "0001_name_lower_and_timestamps",
+		Description: "add name_lower, created_at and updated_at to the users",
+		Filter:      "sort = ?",
+		FilterArgs:  []interface{}{"detail"},
+		Apply:       addNameLowerAndTimestamps,
+	},
+}
+
+func addNameLowerAndTimestamps(table dynamo.Table, item map[string]interface{}, dryRun bool) (bool, error) {
+	name, _ := item["name"].(string)
+	nameLower, _ := item["name_lower"].(string)
+	_, hasCreatedAt := item["created_at"]
+	_, hasUpdatedAt := item["updated_at"]
+
+	if nameLower == strings.ToLower(name) && hasCreatedAt && hasUpdatedAt {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	// The time of the signup is not known, the time of the migration is used instead
+	now := time.Now().UTC()
+	update := table.
+		Update("id", item["id"]).
+		Range("sort", "detail").
+		Set("name_lower", strings.ToLower(name))
+	if !hasCreatedAt {
+		update = update.SetIfNotExists("created_at", now)
+	}
+	if !hasUpdatedAt {
+		update = update.SetIfNotExists("updated_at", now)
+	}
+
+	// The name may have been changed since the scan, it will be fixed by the next write of the user
+	if err := update.If("attribute_exists(id) AND $ = ?", "name", name).Run(); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
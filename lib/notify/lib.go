@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+
+	"github.com/portals-me/account/lib/user"
+)
+
+// Notifier delivers a message to the user out of band
+type Notifier interface {
+	NotifyPasswordReset(user user.UserInfo, token string) error
+}
+
+// New creates a Notifier by the kind
+// kind string: "ses" or "log", there is no default since "log" writes the reset links to the logs
+func New(kind string, resetURL string, source string) (Notifier, error) {
+	if kind == "" {
+		return nil, errors.New("Notifier is not configured")
+	}
+
+	if kind == "ses" {
+		return SESNotifier{
+			SES:      ses.New(session.Must(session.NewSession())),
+			Source:   source,
+			ResetURL: resetURL,
+		}, nil
+	} else if kind == "log" {
+		return LogNotifier{
+			ResetURL: resetURL,
+		}, nil
+	}
+
+	return nil, errors.New("Unsupported notifier: " + kind)
+}
+
+func resetLink(resetURL string, token string) string {
+	return resetURL + "?token=" + url.QueryEscape(token)
+}
+
+// ----------------
+// LogNotifier writes the message to stdout, only for development
+
+type LogNotifier struct {
+	ResetURL string
+}
+
+func (notifier LogNotifier) NotifyPasswordReset(user user.UserInfo, token string) error {
+	fmt.Printf("PasswordReset for %s: %s\n", user.ID, resetLink(notifier.ResetURL, token))
+	return nil
+}
+
+// ----------------
+// SESNotifier sends an email to the address of the user
+
+type SESNotifier struct {
+	SES      sesiface.SESAPI
+	Source   string
+	ResetURL string
+}
+
+func (notifier SESNotifier) NotifyPasswordReset(user user.UserInfo, token string) error {
+	if user.Email == "" {
+		return errors.New("Email is not registered: " + user.ID)
+	}
+
+	body := fmt.Sprintf(
+		"Hi %s,\n\nOpen the link below to reset your password. The link can be used only once and expires shortly.\n\n%s\n\nIf you did not request this, please ignore this email.\n",
+		user.DisplayName,
+		resetLink(notifier.ResetURL, token),
+	)
+
+	_, err := notifier.SES.SendEmail(&ses.SendEmailInput{
+		Source: aws.String(notifier.Source),
+		Destination: &ses.Destination{
+			ToAddresses: []*string{aws.String(user.Email)},
+		},
+		Message: &ses.Message{
+			Subject: &ses.Content{
+				Data: aws.String("Reset your password"),
+			},
+			Body: &ses.Body{
+				Text: &ses.Content{
+					Data: aws.String(body),
+				},
+			},
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,604 @@
+package oauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/ddb"
+	"github.com/portals-me/account/lib/user"
+)
+
+// Lifetimes of the grants and the tokens
+const (
+	AccessTokenLifetime  = time.Hour
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+	codeLifetime         = 10 * time.Minute
+)
+
+// Prefix of refresh tokens, used to tell them from JWTs
+const RefreshTokenPrefix = "rt_"
+
+// Prefix of client secrets
+const ClientSecretPrefix = "cs_"
+
+// Grant types of the token endpoint
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+var GrantTypes = []string{
+	GrantAuthorizationCode,
+	GrantRefreshToken,
+	GrantClientCredentials,
+}
+
+// OpenID Connect scopes, requested besides the API scopes of authz
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+var OpenIDScopes = []string{
+	ScopeOpenID,
+	ScopeProfile,
+	ScopeEmail,
+	ScopeOfflineAccess,
+}
+
+var ErrNotFound = errors.New("OAuth client not found")
+
+// Error is the error response of OAuth 2.0
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (err *Error) Error() string {
+	return err.Code + ": " + err.Description
+}
+
+func NewError(code string, description string) *Error {
+	return &Error{
+		Code:        code,
+		Description: description,
+	}
+}
+
+var ErrInvalidGrant = NewError("invalid_grant", "The grant is invalid, expired or already used")
+
+// Client is an application which signs users in with this service, or a backend service calling the API
+// Name is not stored in `name` attribute since it is the key of the name index
+// SecretHash is empty for public clients, the raw secret is shown only once
+type Client struct {
+	ID           string   `json:"-" dynamo:"id"`
+	Sort         string   `json:"-" dynamo:"sort"`
+	ClientID     string   `json:"id" dynamo:"client_id"`
+	Name         string   `json:"name" dynamo:"name_label"`
+	RedirectURIs []string `json:"redirect_uris" dynamo:"redirect_uris,set"`
+	SecretHash   string   `json:"-" dynamo:"secret_hash"`
+	// API scopes the client can request, OpenID Connect scopes are always allowed
+	Scopes     []string  `json:"scopes" dynamo:"scopes,set"`
+	GrantTypes []string  `json:"grant_types" dynamo:"grant_types,set"`
+	CreatedAt  time.Time `json:"created_at" dynamo:"created_at"`
+}
+
+func (client Client) IsConfidential() bool {
+	return client.SecretHash != ""
+}
+
+// VerifySecret of a confidential client
+func (client Client) VerifySecret(secret string) bool {
+	return client.IsConfidential() && hmac.Equal([]byte(hashToken(secret)), []byte(client.SecretHash))
+}
+
+// AllowedGrantTypes of the client, clients registered before grant types were introduced use the authorization code
+func (client Client) AllowedGrantTypes() []string {
+	if len(client.GrantTypes) == 0 {
+		return []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+
+	return client.GrantTypes
+}
+
+func (client Client) AllowsGrant(grantType string) bool {
+	return authz.Has(client.AllowedGrantTypes(), grantType)
+}
+
+// AllowsScopes checks the API scopes against the scopes of the client
+// Clients without scopes are not restricted, as they were before scopes were introduced
+func (client Client) AllowsScopes(scopes []string) bool {
+	if len(client.Scopes) == 0 {
+		return true
+	}
+
+	for _, scope := range scopes {
+		if !authz.Has(OpenIDScopes, scope) && !authz.Has(client.Scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowsRedirect to the URI, which must exactly match one of the registered URIs
+func (client Client) AllowsRedirect(uri string) bool {
+	for _, registered := range client.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthorizationRequest is the parameters of the authorization endpoint
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// Validate the request except for the client and the redirect URI, which must be checked first
+// PKCE with S256 is required for every client
+func (request AuthorizationRequest) Validate() *Error {
+	if request.ResponseType != "code" {
+		return NewError("unsupported_response_type", "response_type must be code")
+	}
+	if _, err := ParseScope(request.Scope); err != nil {
+		return err
+	}
+	if request.CodeChallengeMethod != "S256" {
+		return NewError("invalid_request", "code_challenge_method must be S256")
+	}
+	if len(request.CodeChallenge) != 43 {
+		return NewError("invalid_request", "code_challenge must be BASE64URL(SHA256(code_verifier))")
+	}
+
+	return nil
+}
+
+// Redirect builds the URI to return to the client with the params and the state
+func (request AuthorizationRequest) Redirect(params url.Values) string {
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+
+	redirect, err := url.Parse(request.RedirectURI)
+	if err != nil {
+		return request.RedirectURI
+	}
+
+	query := redirect.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	redirect.RawQuery = query.Encode()
+
+	return redirect.String()
+}
+
+// RedirectError builds the URI to return the error to the client
+func (request AuthorizationRequest) RedirectError(err *Error) string {
+	params := url.Values{}
+	params.Set("error", err.Code)
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+
+	return request.Redirect(params)
+}
+
+// ParseScope splits the space-separated scope, every scope must be an OpenID Connect scope or an API scope
+func ParseScope(scope string) ([]string, *Error) {
+	scopes := authz.SplitScopes(scope)
+	if len(scopes) == 0 {
+		return nil, NewError("invalid_scope", "scope is required")
+	}
+
+	for _, s := range scopes {
+		if !authz.Has(OpenIDScopes, s) && !authz.IsKnown(s) {
+			return nil, NewError("invalid_scope", "Unknown scope: "+s)
+		}
+	}
+
+	return scopes, nil
+}
+
+// GrantedScopes keeps the API scopes within the current scopes of the account
+func GrantedScopes(scopes []string, userInfo user.UserInfo) []string {
+	allowed := append(authz.EffectiveScopes(userInfo.Role, userInfo.Scopes), OpenIDScopes...)
+
+	return authz.Intersect(scopes, allowed)
+}
+
+// VerifyCodeVerifier checks the code_verifier of PKCE against the code_challenge of S256
+func VerifyCodeVerifier(codeChallenge string, codeVerifier string) bool {
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == codeChallenge
+}
+
+// AuthorizationCode is issued after the consent and exchanged for the tokens only once
+type AuthorizationCode struct {
+	ID            string    `dynamo:"id"`
+	Sort          string    `dynamo:"sort"`
+	ClientID      string    `dynamo:"client_id"`
+	UserID        string    `dynamo:"user_id"`
+	RedirectURI   string    `dynamo:"redirect_uri"`
+	Scopes        []string  `dynamo:"scopes,set"`
+	Nonce         string    `dynamo:"nonce"`
+	CodeChallenge string    `dynamo:"code_challenge"`
+	AuthTime      time.Time `dynamo:"auth_time"`
+	ExpiresAt     time.Time `dynamo:"expires_at"`
+	TTL           int64     `dynamo:"ttl"`
+}
+
+// Consent is the scopes the user has approved for the client
+type Consent struct {
+	ID        string    `json:"-" dynamo:"id"`
+	Sort      string    `json:"-" dynamo:"sort"`
+	ClientID  string    `json:"client_id" dynamo:"client_id"`
+	Scopes    []string  `json:"scopes" dynamo:"scopes,set"`
+	GrantedAt time.Time `json:"granted_at" dynamo:"granted_at"`
+}
+
+// Covers the scopes without asking the user again
+func (consent Consent) Covers(scopes []string) bool {
+	for _, scope := range scopes {
+		if !authz.Has(consent.Scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RefreshToken is stored with the hash of the token and rotated on every use
+type RefreshToken struct {
+	ID        string    `dynamo:"id"`
+	Sort      string    `dynamo:"sort"`
+	TokenID   string    `dynamo:"token_id"`
+	ClientID  string    `dynamo:"client_id"`
+	Scopes    []string  `dynamo:"scopes,set"`
+	AuthTime  time.Time `dynamo:"auth_time"`
+	CreatedAt time.Time `dynamo:"created_at"`
+	ExpiresAt time.Time `dynamo:"expires_at"`
+	TTL       int64     `dynamo:"ttl"`
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func clientKey(clientID string) string {
+	return "client##" + clientID
+}
+
+func codeKey(code string) string {
+	return "oauth-code##" + hashToken(code)
+}
+
+func consentKey(clientID string) string {
+	return "consent##" + clientID
+}
+
+func refreshKey(raw string) string {
+	return "refresh##" + hashToken(raw)
+}
+
+// -- OAuth Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// CreateClient registers a client, returns the raw secret of a confidential client which must be shown only once
+func (repo Repository) CreateClient(name string, redirectURIs []string, scopes []string, grantTypes []string, confidential bool) (Client, string, error) {
+	clientID := uuid.NewV4().String()
+	client := Client{
+		ID:           "oauth-client",
+		Sort:         clientKey(clientID),
+		ClientID:     clientID,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		GrantTypes:   grantTypes,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	secret := ""
+	if confidential {
+		raw, err := randomToken()
+		if err != nil {
+			return Client{}, "", err
+		}
+
+		secret = ClientSecretPrefix + raw
+		client.SecretHash = hashToken(secret)
+	}
+
+	if err := repo.table.Put(client).If("attribute_not_exists(id)").Run(); err != nil {
+		return Client{}, "", err
+	}
+
+	return client, secret, nil
+}
+
+func (repo Repository) GetClient(clientID string) (Client, error) {
+	var client Client
+	if err := repo.table.
+		Get("id", "oauth-client").
+		Range("sort", dynamo.Equal, clientKey(clientID)).
+		One(&client); err != nil {
+		if err == dynamo.ErrNotFound {
+			return Client{}, ErrNotFound
+		}
+
+		return Client{}, err
+	}
+
+	return client, nil
+}
+
+func (repo Repository) ListClients() ([]Client, error) {
+	clients := []Client{}
+	if err := repo.table.
+		Get("id", "oauth-client").
+		Range("sort", dynamo.BeginsWith, "client##").
+		All(&clients); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// DeleteClient unregisters the client
+// Tokens of the client credentials grant are rejected right away, the tokens of users are valid until they expire
+func (repo Repository) DeleteClient(clientID string) error {
+	if err := repo.table.
+		Delete("id", "oauth-client").
+		Range("sort", clientKey(clientID)).
+		If("attribute_exists(id)").
+		Run(); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return ErrNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// IssueCode stores the code, returns the raw code to be sent to the client
+func (repo Repository) IssueCode(code AuthorizationCode) (string, error) {
+	raw, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	code.ID = codeKey(raw)
+	code.Sort = "oauth-code"
+	code.ExpiresAt = now.Add(codeLifetime)
+	code.TTL = code.ExpiresAt.Unix()
+
+	if err := repo.table.Put(code).If("attribute_not_exists(id)").Run(); err != nil {
+		return "", err
+	}
+
+	return raw, nil
+}
+
+// RedeemCode deletes the code and returns it, a code can be redeemed only once
+func (repo Repository) RedeemCode(raw string) (AuthorizationCode, error) {
+	var code AuthorizationCode
+	if err := repo.table.
+		Delete("id", codeKey(raw)).
+		Range("sort", "oauth-code").
+		If("attribute_exists(id)").
+		OldValue(&code); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return AuthorizationCode{}, ErrInvalidGrant
+		}
+
+		return AuthorizationCode{}, err
+	}
+
+	if code.ExpiresAt.Before(time.Now()) {
+		return AuthorizationCode{}, ErrInvalidGrant
+	}
+
+	return code, nil
+}
+
+// GetConsent returns the empty consent if the user has not approved the client
+func (repo Repository) GetConsent(userID string, clientID string) (Consent, error) {
+	var consent Consent
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.Equal, consentKey(clientID)).
+		One(&consent); err != nil {
+		if err == dynamo.ErrNotFound {
+			return Consent{}, nil
+		}
+
+		return Consent{}, err
+	}
+
+	return consent, nil
+}
+
+// GrantConsent records the approved scopes, replacing the previous consent
+func (repo Repository) GrantConsent(userID string, clientID string, scopes []string) error {
+	return repo.table.Put(Consent{
+		ID:        userID,
+		Sort:      consentKey(clientID),
+		ClientID:  clientID,
+		Scopes:    scopes,
+		GrantedAt: time.Now().UTC(),
+	}).Run()
+}
+
+// IssueRefreshToken stores the token, returns the raw token to be sent to the client
+func (repo Repository) IssueRefreshToken(userID string, clientID string, scopes []string, authTime time.Time) (string, error) {
+	raw, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	raw = RefreshTokenPrefix + raw
+
+	now := time.Now().UTC()
+	refreshToken := RefreshToken{
+		ID:        userID,
+		Sort:      refreshKey(raw),
+		TokenID:   uuid.NewV4().String(),
+		ClientID:  clientID,
+		Scopes:    scopes,
+		AuthTime:  authTime,
+		CreatedAt: now,
+		ExpiresAt: now.Add(RefreshTokenLifetime),
+		TTL:       now.Add(RefreshTokenLifetime).Unix(),
+	}
+
+	if err := repo.table.Put(refreshToken).If("attribute_not_exists(id)").Run(); err != nil {
+		return "", err
+	}
+
+	return raw, nil
+}
+
+// GetRefreshToken finds the token by the raw token, returns ErrInvalidGrant if it is revoked or expired
+func (repo Repository) GetRefreshToken(raw string) (RefreshToken, error) {
+	var refreshToken RefreshToken
+	if err := repo.table.
+		Get("sort", refreshKey(raw)).
+		Index("auth").
+		One(&refreshToken); err != nil {
+		if err == dynamo.ErrNotFound {
+			return RefreshToken{}, ErrInvalidGrant
+		}
+
+		return RefreshToken{}, err
+	}
+
+	if refreshToken.ExpiresAt.Before(time.Now()) {
+		return RefreshToken{}, ErrInvalidGrant
+	}
+
+	return refreshToken, nil
+}
+
+// RevokeRefreshToken deletes the token, revoking a deleted token is not an error
+func (repo Repository) RevokeRefreshToken(refreshToken RefreshToken) error {
+	return repo.table.
+		Delete("id", refreshToken.ID).
+		Range("sort", refreshToken.Sort).
+		Run()
+}
+
+// RedeemRefreshToken deletes the token and returns it, the client gets a new refresh token on every use
+func (repo Repository) RedeemRefreshToken(raw string) (RefreshToken, error) {
+	refreshToken, err := repo.GetRefreshToken(raw)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	// The token is redeemed once even if the requests race
+	if err := repo.table.
+		Delete("id", refreshToken.ID).
+		Range("sort", refreshToken.Sort).
+		If("attribute_exists(id)").
+		Run(); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return RefreshToken{}, ErrInvalidGrant
+		}
+
+		return RefreshToken{}, err
+	}
+
+	return refreshToken, nil
+}
+
+// RevokedToken denies the access token of the ID (jti) until it expires
+type RevokedToken struct {
+	ID        string    `dynamo:"id"`
+	Sort      string    `dynamo:"sort"`
+	ClientID  string    `dynamo:"client_id"`
+	RevokedAt time.Time `dynamo:"revoked_at"`
+	TTL       int64     `dynamo:"ttl"`
+}
+
+func revokedTokenKey(tokenID string) string {
+	return "revoked-token##" + tokenID
+}
+
+// RevokeAccessToken denies the token, expiresAt is the exp claim (unix time) of the token
+func (repo Repository) RevokeAccessToken(tokenID string, clientID string, expiresAt int64) error {
+	return repo.table.Put(RevokedToken{
+		ID:        revokedTokenKey(tokenID),
+		Sort:      "revoked-token",
+		ClientID:  clientID,
+		RevokedAt: time.Now().UTC(),
+		TTL:       expiresAt,
+	}).Run()
+}
+
+// IsAccessTokenRevoked checks the token by the ID, tokens issued before jti was introduced have no ID and are not revoked
+func (repo Repository) IsAccessTokenRevoked(tokenID string) (bool, error) {
+	if tokenID == "" {
+		return false, nil
+	}
+
+	var revoked RevokedToken
+	if err := repo.table.
+		Get("id", revokedTokenKey(tokenID)).
+		Range("sort", dynamo.Equal, "revoked-token").
+		One(&revoked); err != nil {
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,119 @@
+package oauth
+
+import (
+	"time"
+
+	"github.com/portals-me/account/lib/authz"
+	"github.com/portals-me/account/lib/jwt"
+	"github.com/portals-me/account/lib/user"
+)
+
+// UserInfoClaims are the standard claims of OpenID Connect, filled by the scopes
+type UserInfoClaims struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+// ClaimsOf the user, profile claims for the profile scope and email for the email scope
+func ClaimsOf(userInfo user.UserInfo, scopes []string) UserInfoClaims {
+	claims := UserInfoClaims{
+		Subject: userInfo.ID,
+	}
+
+	if authz.Has(scopes, ScopeProfile) {
+		claims.Name = userInfo.DisplayName
+		claims.PreferredUsername = userInfo.Name
+		claims.Picture = userInfo.Picture
+		if !userInfo.UpdatedAt.IsZero() {
+			claims.UpdatedAt = userInfo.UpdatedAt.Unix()
+		}
+	}
+	if authz.Has(scopes, ScopeEmail) {
+		claims.Email = userInfo.Email
+	}
+
+	return claims
+}
+
+// IDToken is the payload of the ID token
+// The issuer is the URL of the provider, so an ID token is never accepted as an access token
+type IDToken struct {
+	Issuer         string `json:"iss"`
+	Audience       string `json:"aud"`
+	ExpirationTime int64  `json:"exp"`
+	IssuedAt       int64  `json:"iat"`
+	AuthTime       int64  `json:"auth_time,omitempty"`
+	Nonce          string `json:"nonce,omitempty"`
+	UserInfoClaims
+}
+
+// SignIDToken issues the ID token of the user for the client
+func SignIDToken(signer jwt.ES256Signer, issuer string, clientID string, userInfo user.UserInfo, scopes []string, authTime time.Time, nonce string) (string, error) {
+	now := time.Now()
+	token, err := signer.SignPayload(IDToken{
+		Issuer:         issuer,
+		Audience:       clientID,
+		ExpirationTime: now.Add(AccessTokenLifetime).Unix(),
+		IssuedAt:       now.Unix(),
+		AuthTime:       authTime.Unix(),
+		Nonce:          nonce,
+		UserInfoClaims: ClaimsOf(userInfo, scopes),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
+
+// ProviderMetadata is the discovery document at /.well-known/openid-configuration
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// Discovery describes the provider at the issuer URL
+// The authorization endpoint is the consent page of the web app, which calls /oauth/authorize with the token of the user
+func Discovery(issuer string, authorizationEndpoint string) ProviderMetadata {
+	return ProviderMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             authorizationEndpoint,
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		IntrospectionEndpoint:             issuer + "/introspect",
+		RevocationEndpoint:                issuer + "/revoke",
+		ScopesSupported:                   append(append([]string{}, OpenIDScopes...), authz.KnownScopes...),
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               GrantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"ES256"},
+		TokenEndpointAuthMethodsSupported: []string{"none", "client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{
+			"sub",
+			"name",
+			"preferred_username",
+			"picture",
+			"updated_at",
+			"email",
+		},
+	}
+}
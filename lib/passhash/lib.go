@@ -0,0 +1,226 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxLength prevents hashing extremely long inputs
+const MaxLength = 1024
+
+var ErrMismatch = errors.New("Password does not match")
+var ErrTooLong = errors.New(fmt.Sprintf("Password length must be at most %d", MaxLength))
+var ErrUnknownAlgorithm = errors.New("Unknown hash algorithm")
+
+// Hasher hashes passwords into a self-describing string (PHC or modular crypt format)
+type Hasher interface {
+	// Hash encodes the password with the algorithm and parameters of the hasher
+	Hash(pw string) (string, error)
+
+	// Verify checks the password against the encoded hash
+	Verify(encoded string, pw string) error
+
+	// NeedsRehash reports whether the encoded hash is weaker than the parameters of the hasher
+	NeedsRehash(encoded string) bool
+}
+
+// Current policy used for new hashes
+var Default Hasher = Argon2id{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// hasherOf finds the hasher by the identifier of the encoded hash
+// The parameters are read from the encoded hash on verification
+func hasherOf(encoded string) (Hasher, error) {
+	if strings.HasPrefix(encoded, "$argon2id$") {
+		return Argon2id{}, nil
+	} else if strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$") {
+		return Bcrypt{}, nil
+	}
+
+	return nil, ErrUnknownAlgorithm
+}
+
+// Hash the password by the Default hasher
+func Hash(pw string) (string, error) {
+	return Default.Hash(pw)
+}
+
+// Verify the password by the hasher which is described in the encoded hash
+func Verify(encoded string, pw string) error {
+	hasher, err := hasherOf(encoded)
+	if err != nil {
+		return err
+	}
+
+	return hasher.Verify(encoded, pw)
+}
+
+// NeedsRehash reports whether the encoded hash should be replaced by the Default hasher
+func NeedsRehash(encoded string) bool {
+	hasher, err := hasherOf(encoded)
+	if err != nil {
+		return true
+	}
+	if reflect.TypeOf(hasher) != reflect.TypeOf(Default) {
+		return true
+	}
+
+	return Default.NeedsRehash(encoded)
+}
+
+// ----------------
+// argon2id implementation
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func (hasher Argon2id) Hash(pw string) (string, error) {
+	if len(pw) > MaxLength {
+		return "", ErrTooLong
+	}
+
+	salt := make([]byte, hasher.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(pw), salt, hasher.Iterations, hasher.Memory, hasher.Parallelism, hasher.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		hasher.Memory,
+		hasher.Iterations,
+		hasher.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decode parses the encoded hash into the parameters, salt and key
+func (Argon2id) decode(encoded string) (Argon2id, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2id{}, nil, nil, errors.New("Invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return Argon2id{}, nil, nil, errors.Wrap(err, "Invalid argon2id version")
+	}
+	if version != argon2.Version {
+		return Argon2id{}, nil, nil, errors.New("Unsupported argon2id version")
+	}
+
+	var params Argon2id
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2id{}, nil, nil, errors.Wrap(err, "Invalid argon2id parameters")
+	}
+	// argon2.IDKey panics with zero iterations or parallelism
+	if params.Iterations < 1 || params.Parallelism < 1 {
+		return Argon2id{}, nil, nil, errors.New("Invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2id{}, nil, nil, errors.Wrap(err, "Invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2id{}, nil, nil, errors.Wrap(err, "Invalid argon2id key")
+	}
+	if len(key) == 0 {
+		return Argon2id{}, nil, nil, errors.New("Invalid argon2id key")
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+func (hasher Argon2id) Verify(encoded string, pw string) error {
+	if len(pw) > MaxLength {
+		return ErrTooLong
+	}
+
+	params, salt, key, err := hasher.decode(encoded)
+	if err != nil {
+		return err
+	}
+
+	actual := argon2.IDKey([]byte(pw), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return ErrMismatch
+	}
+
+	return nil
+}
+
+func (hasher Argon2id) NeedsRehash(encoded string) bool {
+	params, _, _, err := hasher.decode(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory < hasher.Memory ||
+		params.Iterations < hasher.Iterations ||
+		params.Parallelism < hasher.Parallelism ||
+		params.SaltLength < hasher.SaltLength ||
+		params.KeyLength < hasher.KeyLength
+}
+
+// ----------------
+// bcrypt implementation, only accepts passwords of 72 bytes or less
+
+type Bcrypt struct {
+	Cost int
+}
+
+func (hasher Bcrypt) Hash(pw string) (string, error) {
+	if len(pw) > 72 {
+		return "", errors.New("Password length must be at most 72 for bcrypt")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), hasher.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (hasher Bcrypt) Verify(encoded string, pw string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pw)); err != nil {
+		return ErrMismatch
+	}
+
+	return nil
+}
+
+func (hasher Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+
+	return cost < hasher.Cost
+}
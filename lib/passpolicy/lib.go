@@ -0,0 +1,228 @@
+package passpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/portals-me/account/lib/user"
+)
+
+// Reason describes why the password is rejected
+type Reason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is returned to the client as it is
+type Error struct {
+	Reasons []Reason `json:"reasons"`
+}
+
+func (err Error) Error() string {
+	messages := []string{}
+	for _, reason := range err.Reasons {
+		messages = append(messages, reason.Message)
+	}
+
+	return "Weak password: " + strings.Join(messages, ", ")
+}
+
+// JSON is the response body for the client
+func (err Error) JSON() string {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"message": "Weak password",
+		"reasons": err.Reasons,
+	})
+
+	return string(raw)
+}
+
+// BreachedList is a list of leaked passwords in k-anonymity form
+// Range returns the hash suffixes (uppercase hex SHA-1 without the first 5 characters) for the prefix
+type BreachedList interface {
+	Range(prefix string) ([]string, error)
+}
+
+// DirectoryList reads `<Dir>/<PREFIX>` files, each line is `<SUFFIX>:<COUNT>`
+// This is the same format as the range API of Have I Been Pwned
+type DirectoryList struct {
+	Dir string
+}
+
+func (list DirectoryList) Range(prefix string) ([]string, error) {
+	file, err := os.Open(filepath.Join(list.Dir, prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer file.Close()
+
+	suffixes := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		suffixes = append(suffixes, strings.ToUpper(strings.SplitN(line, ":", 2)[0]))
+	}
+
+	return suffixes, scanner.Err()
+}
+
+type Policy struct {
+	MinLength      int
+	MinEntropyBits float64
+
+	// Breached can be nil, the check is skipped then
+	Breached BreachedList
+}
+
+var Default = Policy{
+	MinLength:      10,
+	MinEntropyBits: 40,
+}
+
+// FromEnv overrides Default by the environment variables
+// passwordMinLength, passwordMinEntropyBits and breachedPasswordDir
+func FromEnv() Policy {
+	policy := Default
+
+	if value, err := strconv.Atoi(os.Getenv("passwordMinLength")); err == nil {
+		policy.MinLength = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("passwordMinEntropyBits"), 64); err == nil {
+		policy.MinEntropyBits = value
+	}
+	if dir := os.Getenv("breachedPasswordDir"); dir != "" {
+		policy.Breached = DirectoryList{Dir: dir}
+	}
+
+	return policy
+}
+
+// EstimateEntropy is a rough estimate based on the character classes
+// Repeated characters only count one bit each
+func EstimateEntropy(pw string) float64 {
+	var lower, upper, digit, symbol, other bool
+	seen := map[rune]bool{}
+	repeated := 0
+
+	for _, r := range pw {
+		switch {
+		case unicode.IsLower(r) && r < unicode.MaxASCII:
+			lower = true
+		case unicode.IsUpper(r) && r < unicode.MaxASCII:
+			upper = true
+		case unicode.IsDigit(r) && r < unicode.MaxASCII:
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+
+		if seen[r] {
+			repeated++
+		}
+		seen[r] = true
+	}
+
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	return float64(len(seen))*math.Log2(float64(pool)) + float64(repeated)
+}
+
+func containsFold(s string, substr string) bool {
+	return len(substr) >= 3 && strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Check returns nil if the password satisfies the policy, otherwise Error
+func (policy Policy) Check(pw string, userInfo user.UserInfo) error {
+	reasons := []Reason{}
+
+	if len([]rune(pw)) < policy.MinLength {
+		reasons = append(reasons, Reason{
+			Code:    "too_short",
+			Message: fmt.Sprintf("Password must be at least %d characters", policy.MinLength),
+		})
+	}
+
+	if EstimateEntropy(pw) < policy.MinEntropyBits {
+		reasons = append(reasons, Reason{
+			Code:    "too_simple",
+			Message: "Password is too easy to guess, use more kinds of characters",
+		})
+	}
+
+	if containsFold(pw, userInfo.Name) {
+		reasons = append(reasons, Reason{
+			Code:    "contains_user_name",
+			Message: "Password must not contain the user name",
+		})
+	}
+
+	if containsFold(pw, userInfo.DisplayName) {
+		reasons = append(reasons, Reason{
+			Code:    "contains_display_name",
+			Message: "Password must not contain the display name",
+		})
+	}
+
+	if policy.Breached != nil {
+		sum := sha1.Sum([]byte(pw))
+		digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+		suffixes, err := policy.Breached.Range(digest[:5])
+		if err != nil {
+			return err
+		}
+
+		for _, suffix := range suffixes {
+			if suffix == digest[5:] {
+				reasons = append(reasons, Reason{
+					Code:    "breached",
+					Message: "Password has appeared in a data breach",
+				})
+				break
+			}
+		}
+	}
+
+	if len(reasons) != 0 {
+		return Error{Reasons: reasons}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// DynamoDB record for `name-pass##` sort key
+type Record struct {
+	ID        string `dynamo:"id"`
+	Sort      string `dynamo:"sort"`
+	CheckData string `dynamo:"check_data"`
+}
+
+// ResetToken is stored with the hash of the token, the raw token is only delivered to the user
+type ResetToken struct {
+	ID        string `dynamo:"id"`
+	Sort      string `dynamo:"sort"`
+	ExpiresAt int64  `dynamo:"expires_at"`
+	TTL       int64  `dynamo:"ttl"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// -- Password Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// Get the password record of the user
+func (repo Repository) Get(userID string, record *Record) error {
+	return repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.BeginsWith, "name-pass##").
+		Consistent(true).
+		One(record)
+}
+
+// GetByName gets the password record by user_name
+func (repo Repository) GetByName(userName string, record *Record) error {
+	return repo.table.
+		Get("sort", "name-pass##"+userName).
+		Index("auth").
+		One(record)
+}
+
+// UpdateHash replaces check_data of the record
+// This fails if check_data has been changed since the record was read
+func (repo Repository) UpdateHash(record Record, hash string) error {
+	return repo.table.
+		Update("id", record.ID).
+		Range("sort", record.Sort).
+		Set("check_data", hash).
+		If("check_data = ?", record.CheckData).
+		Run()
+}
+
+// Rename moves the password record to the new user_name
+func (repo Repository) Rename(userID string, newName string) error {
+	var record Record
+	if err := repo.Get(userID, &record); err != nil {
+		return err
+	}
+
+	if err := repo.table.
+		Put(Record{
+			ID:        record.ID,
+			Sort:      "name-pass##" + newName,
+			CheckData: record.CheckData,
+		}).
+		If("attribute_not_exists(id)").
+		Run(); err != nil {
+		return err
+	}
+
+	return repo.table.
+		Delete("id", record.ID).
+		Range("sort", record.Sort).
+		Run()
+}
+
+// RenameTx adds the move of the password record to tx, for renaming in a transaction with the user record
+// dynamo.ErrNotFound is returned if the user has no password
+func (repo Repository) RenameTx(tx *dynamo.WriteTx, userID string, newName string) error {
+	var record Record
+	if err := repo.Get(userID, &record); err != nil {
+		return err
+	}
+
+	tx.Put(repo.table.
+		Put(Record{
+			ID:        record.ID,
+			Sort:      "name-pass##" + newName,
+			CheckData: record.CheckData,
+		}).
+		If("attribute_not_exists(id)"))
+	tx.Delete(repo.table.
+		Delete("id", record.ID).
+		Range("sort", record.Sort).
+		If("check_data = ?", record.CheckData))
+
+	return nil
+}
+
+// CreateResetToken issues a single-use token which expires after ttl
+func (repo Repository) CreateResetToken(userID string, ttl time.Duration) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	expiresAt := time.Now().Add(ttl).Unix()
+	if err := repo.table.Put(ResetToken{
+		ID:        userID,
+		Sort:      "password-reset##" + hashToken(token),
+		ExpiresAt: expiresAt,
+		TTL:       expiresAt,
+	}).Run(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// GetResetToken returns the user ID of the token without consuming it
+func (repo Repository) GetResetToken(token string) (string, error) {
+	var record ResetToken
+	if err := repo.table.
+		Get("sort", "password-reset##"+hashToken(token)).
+		Index("auth").
+		One(&record); err != nil {
+		return "", ErrInvalidToken
+	}
+
+	if record.ExpiresAt < time.Now().Unix() {
+		return "", ErrInvalidToken
+	}
+
+	return record.ID, nil
+}
+
+// ConsumeResetToken deletes the token and returns the user ID
+// The token can not be used twice since the deletion is conditional
+func (repo Repository) ConsumeResetToken(token string) (string, error) {
+	userID, err := repo.GetResetToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	if err := repo.table.
+		Delete("id", userID).
+		Range("sort", "password-reset##"+hashToken(token)).
+		If("attribute_exists(id)").
+		Run(); err != nil {
+		return "", ErrInvalidToken
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,363 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+
+	"github.com/portals-me/account/lib/user"
+)
+
+// Namespaces of SAML 2.0
+const (
+	NamespaceProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	NamespaceAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	NamespaceMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	NamespaceSignature = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+const statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+
+// ClockSkew is allowed between the clocks of the identity provider and this service
+const ClockSkew = 3 * time.Minute
+
+var ErrInvalidResponse = errors.New("Invalid SAML response")
+
+// ServiceProvider is this service as the relying party of the identity providers
+type ServiceProvider struct {
+	EntityID string
+	// URL of AssertionConsumerService, where the identity provider posts the response
+	ACSURL string
+}
+
+// Assertion is the validated assertion of the user
+type Assertion struct {
+	ID         string
+	EntityID   string
+	NameID     string
+	ExpiresAt  time.Time
+	Attributes map[string][]string
+}
+
+type assertionXML struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID           string   `xml:"ID,attr"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameID       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject>NameID"`
+	Confirmation []struct {
+		Method string `xml:"Method,attr"`
+		Data   struct {
+			Recipient    string `xml:"Recipient,attr"`
+			NotOnOrAfter string `xml:"NotOnOrAfter,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject>SubjectConfirmation"`
+	Conditions *struct {
+		NotBefore    string   `xml:"NotBefore,attr"`
+		NotOnOrAfter string   `xml:"NotOnOrAfter,attr"`
+		Audiences    []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction>Audience"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement>Attribute"`
+}
+
+// parseResponse decodes the base64 SAMLResponse of HTTP-POST binding
+func parseResponse(raw string) (*etree.Element, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(raw), ""))
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(decoded); err != nil {
+		return nil, ErrInvalidResponse
+	}
+
+	root := doc.Root()
+	if root == nil || root.Tag != "Response" || root.NamespaceURI() != NamespaceProtocol {
+		return nil, ErrInvalidResponse
+	}
+
+	return root, nil
+}
+
+// childOf the element in the namespace, the prefixes declared on the ancestors are resolved
+func childOf(el *etree.Element, namespace string, tag string) *etree.Element {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil
+	}
+
+	child, err := etreeutils.NSFindOneChildCtx(ctx, el, namespace, tag)
+	if err != nil {
+		return nil
+	}
+
+	return child
+}
+
+// IssuerOf the response, used to find the provider before the signature is validated
+func IssuerOf(raw string) (string, error) {
+	root, err := parseResponse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	if issuer := childOf(root, NamespaceAssertion, "Issuer"); issuer != nil {
+		return strings.TrimSpace(issuer.Text()), nil
+	}
+	if assertion := childOf(root, NamespaceAssertion, "Assertion"); assertion != nil {
+		if issuer := childOf(assertion, NamespaceAssertion, "Issuer"); issuer != nil {
+			return strings.TrimSpace(issuer.Text()), nil
+		}
+	}
+
+	return "", ErrInvalidResponse
+}
+
+// validateSignature returns the assertion covered by the signature of the response or of the assertion
+// Only the returned element must be read, the rest of the document is not trusted
+func validateSignature(root *etree.Element, cert *x509.Certificate, now time.Time) (*etree.Element, error) {
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{cert},
+	})
+	ctx.Clock = dsig.NewFakeClockAt(now)
+
+	if childOf(root, NamespaceAssertion, "EncryptedAssertion") != nil {
+		return nil, errors.New("Encrypted assertions are not supported")
+	}
+
+	signed := root
+	if childOf(root, NamespaceSignature, "Signature") == nil {
+		signed = childOf(root, NamespaceAssertion, "Assertion")
+		if signed == nil {
+			return nil, errors.New("No assertion in the response")
+		}
+	}
+
+	nsContext, err := etreeutils.NSBuildParentContext(signed)
+	if err != nil {
+		return nil, err
+	}
+	detached, err := etreeutils.NSDetatch(nsContext, signed)
+	if err != nil {
+		return nil, err
+	}
+
+	validated, err := ctx.Validate(detached)
+	if err != nil {
+		return nil, errors.New("Invalid signature: " + err.Error())
+	}
+	if validated.Tag == "Assertion" {
+		return validated, nil
+	}
+
+	// The assertion in the signed response
+	assertions := []*etree.Element{}
+	if err := etreeutils.NSFindChildrenIterateCtx(etreeutils.NewDefaultNSContext(), validated, NamespaceAssertion, "Assertion", func(ctx etreeutils.NSContext, el *etree.Element) error {
+		detached, err := etreeutils.NSDetatch(ctx, el)
+		if err != nil {
+			return err
+		}
+
+		assertions = append(assertions, detached)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(assertions) != 1 {
+		return nil, errors.New("The response must have exactly one assertion")
+	}
+
+	return assertions[0], nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// Validate the response of HTTP-POST binding against the provider at the time
+// The signature, the status, the destination, the audience, the conditions and the subject confirmation are checked
+// The replay is checked by the caller with the ID of the assertion
+func (sp ServiceProvider) Validate(raw string, provider Provider, now time.Time) (Assertion, error) {
+	root, err := parseResponse(raw)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	cert, err := ParseCertificate(provider.Certificate)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	signed, err := validateSignature(root, cert, now)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	// The status and the destination are read from the response, which may not be signed
+	status := childOf(root, NamespaceProtocol, "Status")
+	if status == nil {
+		return Assertion{}, errors.New("No status in the response")
+	}
+	if code := childOf(status, NamespaceProtocol, "StatusCode"); code == nil || code.SelectAttrValue("Value", "") != statusSuccess {
+		return Assertion{}, errors.New("The authentication failed at the identity provider")
+	}
+	if destination := root.SelectAttrValue("Destination", ""); destination != "" && destination != sp.ACSURL {
+		return Assertion{}, errors.New("Unexpected destination: " + destination)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(signed)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	var parsed assertionXML
+	if err := xml.Unmarshal(buf, &parsed); err != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+
+	if strings.TrimSpace(parsed.Issuer) != provider.EntityID {
+		return Assertion{}, errors.New("Unexpected issuer: " + parsed.Issuer)
+	}
+	if parsed.ID == "" {
+		return Assertion{}, errors.New("No ID in the assertion")
+	}
+
+	nameID := strings.TrimSpace(parsed.NameID)
+	if nameID == "" {
+		return Assertion{}, errors.New("No NameID in the assertion")
+	}
+
+	// The assertion expires at the earliest of the conditions and the subject confirmation
+	var expiresAt time.Time
+	if parsed.Conditions == nil {
+		return Assertion{}, errors.New("No conditions in the assertion")
+	}
+	notBefore, err := parseTime(parsed.Conditions.NotBefore)
+	if err != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+	if !notBefore.IsZero() && now.Add(ClockSkew).Before(notBefore) {
+		return Assertion{}, errors.New("The assertion is not yet valid")
+	}
+	notOnOrAfter, err := parseTime(parsed.Conditions.NotOnOrAfter)
+	if err != nil {
+		return Assertion{}, ErrInvalidResponse
+	}
+	if !notOnOrAfter.IsZero() {
+		if !now.Add(-ClockSkew).Before(notOnOrAfter) {
+			return Assertion{}, errors.New("The assertion has expired")
+		}
+		expiresAt = notOnOrAfter
+	}
+
+	audienceMatched := false
+	for _, audience := range parsed.Conditions.Audiences {
+		if strings.TrimSpace(audience) == sp.EntityID {
+			audienceMatched = true
+		}
+	}
+	if !audienceMatched {
+		return Assertion{}, errors.New("The assertion is not for this service")
+	}
+
+	// A bearer confirmation for the ACS URL is required
+	confirmed := false
+	for _, confirmation := range parsed.Confirmation {
+		if confirmation.Method != "urn:oasis:names:tc:SAML:2.0:cm:bearer" || confirmation.Data.Recipient != sp.ACSURL {
+			continue
+		}
+
+		until, err := parseTime(confirmation.Data.NotOnOrAfter)
+		if err != nil || until.IsZero() || !now.Add(-ClockSkew).Before(until) {
+			continue
+		}
+
+		confirmed = true
+		if expiresAt.IsZero() || until.Before(expiresAt) {
+			expiresAt = until
+		}
+	}
+	if !confirmed {
+		return Assertion{}, errors.New("No valid subject confirmation in the assertion")
+	}
+
+	attributes := map[string][]string{}
+	for _, attribute := range parsed.Attributes {
+		attributes[attribute.Name] = append(attributes[attribute.Name], attribute.Values...)
+	}
+
+	return Assertion{
+		ID:         parsed.ID,
+		EntityID:   provider.EntityID,
+		NameID:     nameID,
+		ExpiresAt:  expiresAt.Add(ClockSkew),
+		Attributes: attributes,
+	}, nil
+}
+
+// Default names of the attributes, the friendly names and the OIDs and the claims of ADFS / Azure AD
+var defaultAttributes = AttributeMap{
+	Name:        "uid",
+	DisplayName: "displayName",
+	Email:       "email",
+	Picture:     "picture",
+}
+
+var attributeAliases = map[string][]string{
+	"uid": {
+		"urn:oid:0.9.2342.19200300.100.1.1",
+		"username",
+	},
+	"displayName": {
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"http://schemas.microsoft.com/identity/claims/displayname",
+		"name",
+	},
+	"email": {
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"mail",
+	},
+}
+
+// value of the attribute, the aliases are tried only for the default names
+func (assertion Assertion) value(name string, defaultName string) string {
+	names := []string{name}
+	if name == "" {
+		names = append([]string{defaultName}, attributeAliases[defaultName]...)
+	}
+
+	for _, name := range names {
+		if values := assertion.Attributes[name]; len(values) != 0 {
+			return strings.TrimSpace(values[0])
+		}
+	}
+
+	return ""
+}
+
+// UserInfo maps the attributes onto the profile, the fields without the attribute are left empty
+func (assertion Assertion) UserInfo(attributes AttributeMap) user.UserInfo {
+	return user.UserInfo{
+		Name:        assertion.value(attributes.Name, defaultAttributes.Name),
+		DisplayName: assertion.value(attributes.DisplayName, defaultAttributes.DisplayName),
+		Email:       assertion.value(attributes.Email, defaultAttributes.Email),
+		Picture:     assertion.value(attributes.Picture, defaultAttributes.Picture),
+	}
+}
@@ -0,0 +1,266 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/beevik/etree"
+	"github.com/guregu/dynamo"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var testNow = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+var testSP = ServiceProvider{
+	EntityID: "https://account.example.com/saml/metadata",
+	ACSURL:   "https://account.example.com/saml/acs",
+}
+
+// testIdP signs the responses with a key and a self-signed certificate generated for the test
+type testIdP struct {
+	EntityID string
+	key      *rsa.PrivateKey
+	cert     []byte
+}
+
+func newTestIdP(t *testing.T) testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    testNow.Add(-time.Hour),
+		NotAfter:     testNow.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testIdP{
+		EntityID: "https://idp.example.com/metadata",
+		key:      key,
+		cert:     cert,
+	}
+}
+
+func (idp testIdP) Provider() Provider {
+	return Provider{
+		EntityID:    idp.EntityID,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.cert})),
+	}
+}
+
+// Response returns the SAMLResponse with the assertion signed, issued at testNow for the audience
+func (idp testIdP) Response(t *testing.T, assertionID string, audience string) string {
+	assertionDoc := etree.NewDocument()
+	if err := assertionDoc.ReadFromString(fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<saml:Subject>`+
+		`<saml:NameID>alice@example.com</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">`+
+		`<saml:SubjectConfirmationData Recipient="%s" NotOnOrAfter="%s"/>`+
+		`</saml:SubjectConfirmation>`+
+		`</saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s">`+
+		`<saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction>`+
+		`</saml:Conditions>`+
+		`<saml:AttributeStatement>`+
+		`<saml:Attribute Name="uid"><saml:AttributeValue>alice</saml:AttributeValue></saml:Attribute>`+
+		`</saml:AttributeStatement>`+
+		`</saml:Assertion>`,
+		NamespaceAssertion,
+		assertionID,
+		testNow.Format(time.RFC3339),
+		idp.EntityID,
+		testSP.ACSURL,
+		testNow.Add(5*time.Minute).Format(time.RFC3339),
+		testNow.Add(-time.Minute).Format(time.RFC3339),
+		testNow.Add(5*time.Minute).Format(time.RFC3339),
+		audience,
+	)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := dsig.NewSigningContext(idp.key, [][]byte{idp.cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+	signed, err := ctx.SignEnveloped(assertionDoc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseDoc := etree.NewDocument()
+	if err := responseDoc.ReadFromString(fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" ID="response-%s" Version="2.0" IssueInstant="%s" Destination="%s">`+
+		`<saml:Issuer xmlns:saml="%s">%s</saml:Issuer>`+
+		`<samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>`+
+		`</samlp:Response>`,
+		NamespaceProtocol,
+		assertionID,
+		testNow.Format(time.RFC3339),
+		testSP.ACSURL,
+		NamespaceAssertion,
+		idp.EntityID,
+		statusSuccess,
+	)); err != nil {
+		t.Fatal(err)
+	}
+	responseDoc.Root().AddChild(signed)
+
+	raw, err := responseDoc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func encodeResponse(raw string) string {
+	return base64.StdEncoding.EncodeToString([]byte(raw))
+}
+
+func TestValidate(t *testing.T) {
+	idp := newTestIdP(t)
+
+	assertion, err := testSP.Validate(encodeResponse(idp.Response(t, "assertion-1", testSP.EntityID)), idp.Provider(), testNow)
+	if err != nil {
+		t.Fatalf("Validate failed: %+v", err)
+	}
+
+	if assertion.ID != "assertion-1" {
+		t.Errorf("ID = %q", assertion.ID)
+	}
+	if assertion.EntityID != idp.EntityID {
+		t.Errorf("EntityID = %q", assertion.EntityID)
+	}
+	if assertion.NameID != "alice@example.com" {
+		t.Errorf("NameID = %q", assertion.NameID)
+	}
+	if expected := testNow.Add(5*time.Minute + ClockSkew); !assertion.ExpiresAt.Equal(expected) {
+		t.Errorf("ExpiresAt = %v, expected %v", assertion.ExpiresAt, expected)
+	}
+	if name := assertion.UserInfo(AttributeMap{}).Name; name != "alice" {
+		t.Errorf("Name = %q", name)
+	}
+}
+
+func TestValidateTampered(t *testing.T) {
+	idp := newTestIdP(t)
+
+	raw := idp.Response(t, "assertion-1", testSP.EntityID)
+	tampered := strings.Replace(raw, "alice@example.com", "mallory@example.com", 1)
+	if tampered == raw {
+		t.Fatal("The NameID is not in the response")
+	}
+
+	if _, err := testSP.Validate(encodeResponse(tampered), idp.Provider(), testNow); err == nil || !strings.HasPrefix(err.Error(), "Invalid signature") {
+		t.Errorf("Validate should fail by the signature: %+v", err)
+	}
+}
+
+func TestValidateOtherKey(t *testing.T) {
+	idp := newTestIdP(t)
+	other := newTestIdP(t)
+
+	if _, err := testSP.Validate(encodeResponse(other.Response(t, "assertion-1", testSP.EntityID)), idp.Provider(), testNow); err == nil || !strings.HasPrefix(err.Error(), "Invalid signature") {
+		t.Errorf("Validate should fail by the signature: %+v", err)
+	}
+}
+
+func TestValidateWrongAudience(t *testing.T) {
+	idp := newTestIdP(t)
+
+	raw := idp.Response(t, "assertion-1", "https://other.example.com/saml/metadata")
+	if _, err := testSP.Validate(encodeResponse(raw), idp.Provider(), testNow); err == nil || err.Error() != "The assertion is not for this service" {
+		t.Errorf("Validate should fail by the audience: %+v", err)
+	}
+}
+
+func TestValidateExpired(t *testing.T) {
+	idp := newTestIdP(t)
+
+	raw := idp.Response(t, "assertion-1", testSP.EntityID)
+	if _, err := testSP.Validate(encodeResponse(raw), idp.Provider(), testNow.Add(5*time.Minute+ClockSkew)); err == nil || err.Error() != "The assertion has expired" {
+		t.Errorf("Validate should fail by the expiry: %+v", err)
+	}
+
+	// within the clock skew
+	if _, err := testSP.Validate(encodeResponse(raw), idp.Provider(), testNow.Add(5*time.Minute)); err != nil {
+		t.Errorf("Validate failed within the clock skew: %+v", err)
+	}
+}
+
+// fakeDynamoDB keeps the items put by the ID, for the conditional writes of UseAssertion
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (db *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, options ...request.Option) (*dynamodb.PutItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id := aws.StringValue(input.Item["id"].S)
+	if _, exists := db.items[id]; exists && input.ConditionExpression != nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+
+	db.items[id] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestUseAssertionReplay(t *testing.T) {
+	idp := newTestIdP(t)
+	repo := NewRepository(dynamo.NewFromIface(&fakeDynamoDB{
+		items: map[string]map[string]*dynamodb.AttributeValue{},
+	}).Table("accounts"))
+
+	raw := encodeResponse(idp.Response(t, "assertion-1", testSP.EntityID))
+	assertion, err := testSP.Validate(raw, idp.Provider(), testNow)
+	if err != nil {
+		t.Fatalf("Validate failed: %+v", err)
+	}
+	if err := repo.UseAssertion(assertion); err != nil {
+		t.Fatalf("UseAssertion failed: %+v", err)
+	}
+
+	// The same response is still valid, the replay is rejected by the ID
+	replayed, err := testSP.Validate(raw, idp.Provider(), testNow.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Validate failed: %+v", err)
+	}
+	if err := repo.UseAssertion(replayed); err != ErrReplayed {
+		t.Errorf("UseAssertion should reject the replay: %+v", err)
+	}
+
+	other, err := testSP.Validate(encodeResponse(idp.Response(t, "assertion-2", testSP.EntityID)), idp.Provider(), testNow)
+	if err != nil {
+		t.Fatalf("Validate failed: %+v", err)
+	}
+	if err := repo.UseAssertion(other); err != nil {
+		t.Errorf("UseAssertion failed for another assertion: %+v", err)
+	}
+}
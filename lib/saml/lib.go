@@ -0,0 +1,265 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/ddb"
+)
+
+var ErrNotFound = errors.New("Not found")
+var ErrReplayed = errors.New("The assertion has already been used")
+var ErrAlreadyLinked = errors.New("The SAML user is linked to another account")
+
+// AttributeMap is the names of the attributes mapped onto the user, the defaults are used for empty names
+type AttributeMap struct {
+	Name        string `json:"name,omitempty" dynamo:"name,omitempty"`
+	DisplayName string `json:"display_name,omitempty" dynamo:"display_name,omitempty"`
+	Email       string `json:"email,omitempty" dynamo:"email,omitempty"`
+	Picture     string `json:"picture,omitempty" dynamo:"picture,omitempty"`
+}
+
+// Provider is an identity provider trusted for the signin
+// The record is keyed by the entity ID, which is the Issuer of the responses
+type Provider struct {
+	ID          string       `json:"-" dynamo:"id"`
+	Sort        string       `json:"-" dynamo:"sort"`
+	ProviderID  string       `json:"id" dynamo:"provider_id"`
+	EntityID    string       `json:"entity_id" dynamo:"entity_id"`
+	SSOURL      string       `json:"sso_url" dynamo:"sso_url"`
+	Certificate string       `json:"certificate" dynamo:"certificate"`
+	Attributes  AttributeMap `json:"attributes" dynamo:"attributes"`
+	CreatedAt   time.Time    `json:"created_at" dynamo:"created_at"`
+}
+
+// UsedAssertion records the ID of the assertion until it expires, to reject the replay
+type UsedAssertion struct {
+	ID       string    `dynamo:"id"`
+	Sort     string    `dynamo:"sort"`
+	EntityID string    `dynamo:"entity_id"`
+	UsedAt   time.Time `dynamo:"used_at"`
+	TTL      int64     `dynamo:"ttl"`
+}
+
+func providerKey(entityID string) string {
+	return "saml-idp##" + entityID
+}
+
+// RecordKey is the sort of the auth record of the user
+func RecordKey(entityID string, nameID string) string {
+	return "saml##" + entityID + "##" + nameID
+}
+
+// ParseCertificate accepts PEM, or base64 DER as in the metadata of the identity provider
+func ParseCertificate(certificate string) (*x509.Certificate, error) {
+	if block, _ := pem.Decode([]byte(certificate)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(certificate), ""))
+	if err != nil {
+		return nil, errors.New("certificate must be PEM or base64 DER")
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// -- SAML Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// CreateProvider registers the identity provider, an entity ID can be registered only once
+func (repo Repository) CreateProvider(provider Provider) (Provider, error) {
+	provider.ID = "saml-idp"
+	provider.Sort = providerKey(provider.EntityID)
+	provider.ProviderID = uuid.NewV4().String()
+	provider.CreatedAt = time.Now().UTC()
+
+	if err := repo.table.Put(provider).If("attribute_not_exists(id)").Run(); err != nil {
+		return Provider{}, err
+	}
+
+	return provider, nil
+}
+
+func (repo Repository) ListProviders() ([]Provider, error) {
+	providers := []Provider{}
+	if err := repo.table.
+		Get("id", "saml-idp").
+		Range("sort", dynamo.BeginsWith, "saml-idp##").
+		All(&providers); err != nil {
+		return nil, err
+	}
+
+	return providers, nil
+}
+
+// GetProvider finds the provider by the ID
+func (repo Repository) GetProvider(providerID string) (Provider, error) {
+	providers, err := repo.ListProviders()
+	if err != nil {
+		return Provider{}, err
+	}
+
+	for _, provider := range providers {
+		if provider.ProviderID == providerID {
+			return provider, nil
+		}
+	}
+
+	return Provider{}, ErrNotFound
+}
+
+// GetProviderByEntityID finds the provider by the Issuer of the response
+func (repo Repository) GetProviderByEntityID(entityID string) (Provider, error) {
+	var provider Provider
+	if err := repo.table.
+		Get("id", "saml-idp").
+		Range("sort", dynamo.Equal, providerKey(entityID)).
+		One(&provider); err != nil {
+		if err == dynamo.ErrNotFound {
+			return Provider{}, ErrNotFound
+		}
+
+		return Provider{}, err
+	}
+
+	return provider, nil
+}
+
+// DeleteProvider stops trusting the provider, the users keep their accounts
+func (repo Repository) DeleteProvider(providerID string) error {
+	provider, err := repo.GetProvider(providerID)
+	if err != nil {
+		return err
+	}
+
+	return repo.table.
+		Delete("id", provider.ID).
+		Range("sort", provider.Sort).
+		Run()
+}
+
+// UseAssertion records the assertion as used, ErrReplayed is returned if it has already been used
+func (repo Repository) UseAssertion(assertion Assertion) error {
+	if err := repo.table.Put(UsedAssertion{
+		ID:       "saml-assertion##" + assertion.EntityID + "##" + assertion.ID,
+		Sort:     "saml-assertion",
+		EntityID: assertion.EntityID,
+		UsedAt:   time.Now().UTC(),
+		TTL:      assertion.ExpiresAt.Unix(),
+	}).If("attribute_not_exists(id)").Run(); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return ErrReplayed
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// LinkedUserID returns the ID of the user signing in as the NameID of the provider, ErrNotFound if none
+func (repo Repository) LinkedUserID(entityID string, nameID string) (string, error) {
+	var records []struct {
+		ID string `dynamo:"id"`
+	}
+	if err := repo.table.
+		Get("sort", RecordKey(entityID, nameID)).
+		Index("auth").
+		All(&records); err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", ErrNotFound
+	}
+
+	return records[0].ID, nil
+}
+
+// Link writes the auth record of the user, so that the NameID of the provider signs in as the user
+// ErrAlreadyLinked is returned if the NameID signs in as another user
+func (repo Repository) Link(userID string, entityID string, nameID string) error {
+	linkedID, err := repo.LinkedUserID(entityID, nameID)
+	if err == nil && linkedID != userID {
+		return ErrAlreadyLinked
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	return repo.table.Put(map[string]interface{}{
+		"id":   userID,
+		"sort": RecordKey(entityID, nameID),
+	}).Run()
+}
+
+// Relink moves the auth record of the user to the new NameID, nothing is done if the user is not linked by the old one
+func (repo Repository) Relink(userID string, entityID string, oldNameID string, newNameID string) error {
+	linkedID, err := repo.LinkedUserID(entityID, oldNameID)
+	if err == ErrNotFound || (err == nil && linkedID != userID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := repo.Link(userID, entityID, newNameID); err != nil {
+		return err
+	}
+
+	return repo.table.
+		Delete("id", userID).
+		Range("sort", RecordKey(entityID, oldNameID)).
+		Run()
+}
+
+// Response is the data of the signin, the SAMLResponse posted to the ACS URL
+type Response struct {
+	SAMLResponse string `json:"saml_response"`
+}
+
+type Config struct {
+	Response        Response
+	ServiceProvider ServiceProvider
+}
+
+// GetAssertion validates the response by the provider of the issuer, and consumes the assertion
+// An assertion can be used only once, ErrReplayed is returned for the second time
+func (config Config) GetAssertion(repo Repository) (Assertion, Provider, error) {
+	issuer, err := IssuerOf(config.Response.SAMLResponse)
+	if err != nil {
+		return Assertion{}, Provider{}, err
+	}
+
+	provider, err := repo.GetProviderByEntityID(issuer)
+	if err != nil {
+		return Assertion{}, Provider{}, errors.New("Unknown identity provider: " + issuer)
+	}
+
+	assertion, err := config.ServiceProvider.Validate(config.Response.SAMLResponse, provider, time.Now())
+	if err != nil {
+		return Assertion{}, Provider{}, err
+	}
+
+	if err := repo.UseAssertion(assertion); err != nil {
+		return Assertion{}, Provider{}, err
+	}
+
+	return assertion, provider, nil
+}
@@ -0,0 +1,119 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const bindingPOST = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+const nameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+type authnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	IssueInstant                string   `xml:"IssueInstant,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	Issuer                      struct {
+		XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+		Value   string   `xml:",chardata"`
+	}
+	NameIDPolicy struct {
+		XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+		Format      string   `xml:"Format,attr"`
+		AllowCreate bool     `xml:"AllowCreate,attr"`
+	}
+}
+
+// AuthnRequestURL is the URL of the identity provider with the AuthnRequest of HTTP-Redirect binding
+// The request is not signed, the response is posted to the ACS URL
+func (sp ServiceProvider) AuthnRequestURL(provider Provider, relayState string, now time.Time) (string, error) {
+	request := authnRequest{
+		// xs:ID must not start with a digit
+		ID:                          "_" + strings.Replace(uuid.NewV4().String(), "-", "", -1),
+		Version:                     "2.0",
+		IssueInstant:                now.UTC().Format(time.RFC3339),
+		Destination:                 provider.SSOURL,
+		AssertionConsumerServiceURL: sp.ACSURL,
+		ProtocolBinding:             bindingPOST,
+	}
+	request.Issuer.Value = sp.EntityID
+	request.NameIDPolicy.Format = nameIDFormatUnspecified
+	request.NameIDPolicy.AllowCreate = true
+
+	raw, err := xml.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write(raw); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	redirectURL, err := url.Parse(provider.SSOURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := redirectURL.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	redirectURL.RawQuery = query.Encode()
+
+	return redirectURL.String(), nil
+}
+
+type entityDescriptor struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string   `xml:"entityID,attr"`
+	SPSSODescriptor struct {
+		AuthnRequestsSigned        bool   `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool   `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat               string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+		AssertionConsumerService   struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+			Index    int    `xml:"index,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+}
+
+// Metadata of this service for the identity providers
+func (sp ServiceProvider) Metadata() ([]byte, error) {
+	var descriptor entityDescriptor
+	descriptor.EntityID = sp.EntityID
+	descriptor.SPSSODescriptor.AuthnRequestsSigned = false
+	descriptor.SPSSODescriptor.WantAssertionsSigned = true
+	descriptor.SPSSODescriptor.ProtocolSupportEnumeration = NamespaceProtocol
+	descriptor.SPSSODescriptor.NameIDFormat = nameIDFormatUnspecified
+	descriptor.SPSSODescriptor.AssertionConsumerService.Binding = bindingPOST
+	descriptor.SPSSODescriptor.AssertionConsumerService.Location = sp.ACSURL
+	descriptor.SPSSODescriptor.AssertionConsumerService.Index = 0
+
+	raw, err := xml.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), raw...), nil
+}
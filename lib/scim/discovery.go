@@ -0,0 +1,180 @@
+package scim
+
+// DiscoveryMeta is the meta of the discovery resources, which have no versions
+type DiscoveryMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+// Supported is the capability of ServiceProviderConfig
+type Supported struct {
+	Supported bool `json:"supported"`
+}
+
+type FilterSupported struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type BulkSupported struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type AuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+// ServiceProviderConfig is the discovery resource of RFC 7643 5
+type ServiceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 Supported              `json:"patch"`
+	Bulk                  BulkSupported          `json:"bulk"`
+	Filter                FilterSupported        `json:"filter"`
+	ChangePassword        Supported              `json:"changePassword"`
+	Sort                  Supported              `json:"sort"`
+	ETag                  Supported              `json:"etag"`
+	AuthenticationSchemes []AuthenticationScheme `json:"authenticationSchemes"`
+	Meta                  DiscoveryMeta          `json:"meta"`
+}
+
+func Config(location string) ServiceProviderConfig {
+	return ServiceProviderConfig{
+		Schemas: []string{SchemaServiceProviderConfig},
+		Patch:   Supported{Supported: true},
+		Bulk:    BulkSupported{Supported: false},
+		Filter: FilterSupported{
+			Supported:  true,
+			MaxResults: MaxResults,
+		},
+		ChangePassword: Supported{Supported: false},
+		Sort:           Supported{Supported: false},
+		ETag:           Supported{Supported: true},
+		AuthenticationSchemes: []AuthenticationScheme{
+			{
+				Type:        "oauthbearertoken",
+				Name:        "Bearer token",
+				Description: "The token of the tenant, issued by POST /admin/scim-tenants",
+				Primary:     true,
+			},
+		},
+		Meta: DiscoveryMeta{
+			ResourceType: "ServiceProviderConfig",
+			Location:     location,
+		},
+	}
+}
+
+// Attribute is the definition of an attribute of RFC 7643 7
+type Attribute struct {
+	Name          string      `json:"name"`
+	Type          string      `json:"type"`
+	MultiValued   bool        `json:"multiValued"`
+	Description   string      `json:"description"`
+	Required      bool        `json:"required"`
+	CaseExact     bool        `json:"caseExact"`
+	Mutability    string      `json:"mutability"`
+	Returned      string      `json:"returned"`
+	Uniqueness    string      `json:"uniqueness"`
+	SubAttributes []Attribute `json:"subAttributes,omitempty"`
+}
+
+type Schema struct {
+	Schemas     []string      `json:"schemas"`
+	ID          string        `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Attributes  []Attribute   `json:"attributes"`
+	Meta        DiscoveryMeta `json:"meta"`
+}
+
+func stringAttribute(name string, description string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        "string",
+		Description: description,
+		Mutability:  "readWrite",
+		Returned:    "default",
+		Uniqueness:  "none",
+	}
+}
+
+func multiValuedAttribute(name string, description string) Attribute {
+	return Attribute{
+		Name:        name,
+		Type:        "complex",
+		MultiValued: true,
+		Description: description,
+		Mutability:  "readWrite",
+		Returned:    "default",
+		Uniqueness:  "none",
+		SubAttributes: []Attribute{
+			stringAttribute("value", "The value, only the primary value is stored"),
+			stringAttribute("type", "The label of the value"),
+			{
+				Name:        "primary",
+				Type:        "boolean",
+				Description: "The primary value",
+				Mutability:  "readWrite",
+				Returned:    "default",
+				Uniqueness:  "none",
+			},
+		},
+	}
+}
+
+// UserSchema describes the attributes of the User resource mapped onto the account
+func UserSchema(location string) Schema {
+	userName := stringAttribute("userName", "The name of the account, letters, digits and underscores of 3 characters or more")
+	userName.Required = true
+	userName.Uniqueness = "server"
+
+	id := stringAttribute("id", "The ID of the account")
+	id.CaseExact = true
+	id.Mutability = "readOnly"
+	id.Returned = "always"
+	id.Uniqueness = "server"
+
+	externalID := stringAttribute("externalId", "The ID of the user in the directory")
+	externalID.CaseExact = true
+
+	return Schema{
+		Schemas:     []string{SchemaSchema},
+		ID:          SchemaUser,
+		Name:        "User",
+		Description: "User Account",
+		Attributes: []Attribute{
+			id,
+			externalID,
+			userName,
+			stringAttribute("displayName", "The display name, name.formatted or userName if not given"),
+			{
+				Name:          "name",
+				Type:          "complex",
+				Description:   "The name of the user",
+				Mutability:    "readWrite",
+				Returned:      "default",
+				Uniqueness:    "none",
+				SubAttributes: []Attribute{stringAttribute("formatted", "The full name")},
+			},
+			multiValuedAttribute("emails", "The email address"),
+			multiValuedAttribute("photos", "The URL of the picture, under the domain of the service"),
+			{
+				Name:        "active",
+				Type:        "boolean",
+				Description: "false suspends the account",
+				Mutability:  "readWrite",
+				Returned:    "default",
+				Uniqueness:  "none",
+			},
+		},
+		Meta: DiscoveryMeta{
+			ResourceType: "Schema",
+			Location:     location,
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package scim
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Filter is a subset of the filters of RFC 7644 3.4.2.2
+// Comparisons of eq, ne, co, sw, ew and pr joined by `and` and `or`, where `and` binds tighter, without grouping
+type Filter struct {
+	// any of the groups matches, every condition of a group matches
+	groups [][]condition
+}
+
+type condition struct {
+	attribute string
+	operator  string
+	value     string
+}
+
+// attributes which can be filtered, with whether the comparison is case sensitive
+var filterAttributes = map[string]bool{
+	"id":             true,
+	"externalid":     true,
+	"username":       false,
+	"displayname":    false,
+	"name.formatted": false,
+	"emails":         false,
+	"emails.value":   false,
+	"active":         false,
+}
+
+func invalidFilter(detail string) Error {
+	return NewError(400, "invalidFilter", detail)
+}
+
+// tokenize splits the filter by spaces outside of the quoted strings
+func tokenize(raw string) ([]string, error) {
+	tokens := []string{}
+	current := strings.Builder{}
+	quoted := false
+	escaped := false
+	for _, r := range raw {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && r == ' ':
+			if current.Len() != 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+			continue
+		}
+
+		current.WriteRune(r)
+	}
+	if quoted {
+		return nil, invalidFilter("Unterminated string")
+	}
+	if current.Len() != 0 {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens, nil
+}
+
+// ParseFilter parses the filter parameter, an empty filter matches every resource
+func ParseFilter(raw string) (Filter, error) {
+	tokens, err := tokenize(raw)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	filter := Filter{}
+	group := []condition{}
+	for i := 0; i < len(tokens); {
+		attribute := strings.ToLower(tokens[i])
+		if _, ok := filterAttributes[attribute]; !ok {
+			return Filter{}, invalidFilter("Unsupported attribute: " + tokens[i])
+		}
+		if i+1 >= len(tokens) {
+			return Filter{}, invalidFilter("Operator is missing")
+		}
+
+		cond := condition{
+			attribute: attribute,
+			operator:  strings.ToLower(tokens[i+1]),
+		}
+		i += 2
+
+		switch cond.operator {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew":
+			if i >= len(tokens) {
+				return Filter{}, invalidFilter("Value is missing")
+			}
+
+			value := tokens[i]
+			if strings.HasPrefix(value, `"`) {
+				unquoted, err := strconv.Unquote(value)
+				if err != nil {
+					return Filter{}, invalidFilter("Invalid string: " + value)
+				}
+				value = unquoted
+			}
+			cond.value = value
+			i++
+		default:
+			return Filter{}, invalidFilter("Unsupported operator: " + cond.operator)
+		}
+		group = append(group, cond)
+
+		if i >= len(tokens) {
+			break
+		}
+		switch strings.ToLower(tokens[i]) {
+		case "and":
+		case "or":
+			filter.groups = append(filter.groups, group)
+			group = []condition{}
+		default:
+			return Filter{}, invalidFilter("Unexpected token: " + tokens[i])
+		}
+		i++
+		if i >= len(tokens) {
+			return Filter{}, invalidFilter("Expression is missing after " + tokens[i-1])
+		}
+	}
+	if len(group) != 0 {
+		filter.groups = append(filter.groups, group)
+	}
+
+	return filter, nil
+}
+
+// valuesOf the attribute of the resource, empty values are not present
+func valuesOf(resource User, attribute string) []string {
+	values := []string{}
+	switch attribute {
+	case "id":
+		values = append(values, resource.ID)
+	case "externalid":
+		values = append(values, resource.ExternalID)
+	case "username":
+		values = append(values, resource.UserName)
+	case "displayname":
+		values = append(values, resource.DisplayName)
+	case "name.formatted":
+		if resource.Name != nil {
+			values = append(values, resource.Name.Formatted)
+		}
+	case "emails", "emails.value":
+		for _, email := range resource.Emails {
+			values = append(values, email.Value)
+		}
+	case "active":
+		if resource.Active != nil {
+			values = append(values, strconv.FormatBool(*resource.Active))
+		}
+	}
+
+	present := []string{}
+	for _, value := range values {
+		if value != "" {
+			present = append(present, value)
+		}
+	}
+
+	return present
+}
+
+func (cond condition) match(resource User) bool {
+	values := valuesOf(resource, cond.attribute)
+	if cond.operator == "pr" {
+		return len(values) != 0
+	}
+	if cond.operator == "ne" {
+		return !condition{cond.attribute, "eq", cond.value}.match(resource)
+	}
+
+	expected := cond.value
+	if !filterAttributes[cond.attribute] {
+		expected = strings.ToLower(expected)
+	}
+	for _, value := range values {
+		if !filterAttributes[cond.attribute] {
+			value = strings.ToLower(value)
+		}
+
+		switch cond.operator {
+		case "eq":
+			if value == expected {
+				return true
+			}
+		case "co":
+			if strings.Contains(value, expected) {
+				return true
+			}
+		case "sw":
+			if strings.HasPrefix(value, expected) {
+				return true
+			}
+		case "ew":
+			if strings.HasSuffix(value, expected) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Match the resource against the filter
+func (filter Filter) Match(resource User) bool {
+	if len(filter.groups) == 0 {
+		return true
+	}
+
+	for _, group := range filter.groups {
+		matched := true
+		for _, cond := range group {
+			if !cond.match(resource) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
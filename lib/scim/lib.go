@@ -0,0 +1,203 @@
+package scim
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+)
+
+// TokenPrefix distinguishes the bearer tokens of the tenants from the other tokens
+const TokenPrefix = "scim_"
+
+var ErrNotFound = errors.New("Not found")
+var ErrInvalidToken = errors.New("Invalid token")
+
+// Tenant is a directory of an organisation provisioning the users by SCIM
+// The record is keyed by the hash of the bearer token, the raw token is shown only once
+// Name is not stored in `name` attribute since it is the key of the name index
+// The users of a tenant with SAMLEntityID sign in by the SAML provider, with the userName as the NameID
+type Tenant struct {
+	ID           string    `json:"-" dynamo:"id"`
+	Sort         string    `json:"-" dynamo:"sort"`
+	TenantID     string    `json:"id" dynamo:"tenant_id"`
+	Name         string    `json:"name" dynamo:"name_label"`
+	SAMLEntityID string    `json:"saml_entity_id,omitempty" dynamo:"saml_entity_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at" dynamo:"created_at"`
+}
+
+// Member records that the user is provisioned by the tenant, with the ID of the user in the directory
+type Member struct {
+	ID         string    `dynamo:"id"`
+	Sort       string    `dynamo:"sort"`
+	TenantID   string    `dynamo:"tenant_id"`
+	ExternalID string    `dynamo:"external_id"`
+	CreatedAt  time.Time `dynamo:"created_at"`
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenKey(raw string) string {
+	return "scim-token##" + hashToken(raw)
+}
+
+func memberKey(tenantID string) string {
+	return "scim##" + tenantID
+}
+
+// -- SCIM Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// CreateTenant registers a tenant, returns the raw bearer token which must be shown only once
+// samlEntityID is the SAML provider of the users, or empty if they sign in otherwise
+func (repo Repository) CreateTenant(name string, samlEntityID string) (Tenant, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Tenant{}, "", err
+	}
+	raw := TokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	tenant := Tenant{
+		ID:           "scim-tenant",
+		Sort:         tokenKey(raw),
+		TenantID:     uuid.NewV4().String(),
+		Name:         name,
+		SAMLEntityID: samlEntityID,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := repo.table.Put(tenant).If("attribute_not_exists(id)").Run(); err != nil {
+		return Tenant{}, "", err
+	}
+
+	return tenant, raw, nil
+}
+
+func (repo Repository) ListTenants() ([]Tenant, error) {
+	tenants := []Tenant{}
+	if err := repo.table.
+		Get("id", "scim-tenant").
+		Range("sort", dynamo.BeginsWith, "scim-token##").
+		All(&tenants); err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+// DeleteTenant revokes the token of the tenant, the users provisioned by the tenant are kept
+func (repo Repository) DeleteTenant(tenantID string) error {
+	tenants, err := repo.ListTenants()
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		if tenant.TenantID == tenantID {
+			return repo.table.
+				Delete("id", tenant.ID).
+				Range("sort", tenant.Sort).
+				Run()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Authenticate finds the tenant by the raw bearer token
+func (repo Repository) Authenticate(raw string) (Tenant, error) {
+	var tenant Tenant
+	if err := repo.table.
+		Get("id", "scim-tenant").
+		Range("sort", dynamo.Equal, tokenKey(raw)).
+		One(&tenant); err != nil {
+		if err == dynamo.ErrNotFound {
+			return Tenant{}, ErrInvalidToken
+		}
+
+		return Tenant{}, err
+	}
+
+	return tenant, nil
+}
+
+// AddMember records the user as provisioned by the tenant
+func (repo Repository) AddMember(tenantID string, userID string, externalID string) (Member, error) {
+	member := Member{
+		ID:         userID,
+		Sort:       memberKey(tenantID),
+		TenantID:   tenantID,
+		ExternalID: externalID,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := repo.table.Put(member).Run(); err != nil {
+		return Member{}, err
+	}
+
+	return member, nil
+}
+
+// GetMember returns ErrNotFound if the user is not provisioned by the tenant
+func (repo Repository) GetMember(tenantID string, userID string) (Member, error) {
+	var member Member
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.Equal, memberKey(tenantID)).
+		One(&member); err != nil {
+		if err == dynamo.ErrNotFound {
+			return Member{}, ErrNotFound
+		}
+
+		return Member{}, err
+	}
+
+	return member, nil
+}
+
+// ListMembers of the tenant, ordered by the user ID
+func (repo Repository) ListMembers(tenantID string) ([]Member, error) {
+	members := []Member{}
+	if err := repo.table.
+		Get("sort", memberKey(tenantID)).
+		Index("auth").
+		All(&members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SetExternalID of the member, the directory may change it on replace
+func (repo Repository) SetExternalID(member Member, externalID string) error {
+	if externalID == "" {
+		return repo.table.
+			Update("id", member.ID).
+			Range("sort", member.Sort).
+			Remove("external_id").
+			If("attribute_exists(id)").
+			Run()
+	}
+
+	return repo.table.
+		Update("id", member.ID).
+		Range("sort", member.Sort).
+		Set("external_id", externalID).
+		If("attribute_exists(id)").
+		Run()
+}
@@ -0,0 +1,148 @@
+package scim
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is the request of PATCH, RFC 7644 3.5.2
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation of the patch, op is case insensitive since some directories send Replace
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+func invalidValue(detail string) Error {
+	return NewError(400, "invalidValue", detail)
+}
+
+// Apply the operations to the resource in order
+func (patch PatchOp) Apply(resource User) (User, error) {
+	for _, operation := range patch.Operations {
+		var err error
+		switch strings.ToLower(operation.Op) {
+		case "add", "replace":
+			err = operation.set(&resource)
+		case "remove":
+			err = operation.remove(&resource)
+		default:
+			err = invalidValue("Unsupported op: " + operation.Op)
+		}
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	return resource, nil
+}
+
+// set the value at the path, or every attribute of the value if the path is not given
+func (operation Operation) set(resource *User) error {
+	if operation.Path != "" {
+		return setAttribute(resource, operation.Path, operation.Value)
+	}
+
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+		return invalidValue("value must be an object without path")
+	}
+	for path, value := range attributes {
+		if err := setAttribute(resource, path, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseBool accepts the strings such as "False" as well, which some directories send
+func parseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, err
+	}
+
+	return strconv.ParseBool(strings.ToLower(s))
+}
+
+// singleValue of the multi-valued attribute, for the paths such as emails[type eq "work"].value
+func singleValue(value json.RawMessage, valueType string) ([]MultiValue, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, err
+	}
+
+	return []MultiValue{{Value: s, Type: valueType, Primary: true}}, nil
+}
+
+func setAttribute(resource *User, path string, value json.RawMessage) error {
+	var err error
+	lower := strings.ToLower(path)
+	switch {
+	case lower == "username":
+		err = json.Unmarshal(value, &resource.UserName)
+	case lower == "displayname":
+		err = json.Unmarshal(value, &resource.DisplayName)
+	case lower == "externalid":
+		err = json.Unmarshal(value, &resource.ExternalID)
+	case lower == "name":
+		err = json.Unmarshal(value, &resource.Name)
+	case lower == "name.formatted":
+		resource.Name = &Name{}
+		err = json.Unmarshal(value, &resource.Name.Formatted)
+	case lower == "active":
+		var active bool
+		active, err = parseBool(value)
+		resource.Active = &active
+	case lower == "emails":
+		err = json.Unmarshal(value, &resource.Emails)
+	case strings.HasPrefix(lower, "emails["):
+		resource.Emails, err = singleValue(value, "work")
+	case lower == "photos":
+		err = json.Unmarshal(value, &resource.Photos)
+	case strings.HasPrefix(lower, "photos["):
+		resource.Photos, err = singleValue(value, "photo")
+	default:
+		return NewError(400, "invalidPath", "Unsupported path: "+path)
+	}
+	if err != nil {
+		return invalidValue("Invalid value of " + path)
+	}
+
+	return nil
+}
+
+// remove the attribute, userName and active can not be removed
+func (operation Operation) remove(resource *User) error {
+	lower := strings.ToLower(operation.Path)
+	switch {
+	case lower == "":
+		return NewError(400, "noTarget", "path is required for remove")
+	case lower == "displayname":
+		resource.DisplayName = ""
+	case lower == "externalid":
+		resource.ExternalID = ""
+	case lower == "name", lower == "name.formatted":
+		resource.Name = nil
+	case lower == "emails", strings.HasPrefix(lower, "emails["):
+		resource.Emails = nil
+	case lower == "photos", strings.HasPrefix(lower, "photos["):
+		resource.Photos = nil
+	default:
+		return NewError(400, "mutability", "The attribute can not be removed: "+operation.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package scim
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/portals-me/account/lib/user"
+)
+
+// Schema URIs of RFC 7643 and RFC 7644
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// ContentType of the requests and the responses
+const ContentType = "application/scim+json"
+
+// MaxResults of a page of the list
+const MaxResults = 100
+
+// Error is the error response of RFC 7644 3.12, Status is a string by the spec
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func (err Error) Error() string {
+	return err.Detail
+}
+
+// StatusCode of the response
+func (err Error) StatusCode() int {
+	code, _ := strconv.Atoi(err.Status)
+	return code
+}
+
+func NewError(status int, scimType string, detail string) Error {
+	return Error{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+type Name struct {
+	Formatted string `json:"formatted,omitempty"`
+}
+
+// MultiValue is an item of emails and photos
+type MultiValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Version      string    `json:"version"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// User is the User resource, Active is nil if it is not given in the request
+type User struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *Name        `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Emails      []MultiValue `json:"emails,omitempty"`
+	Photos      []MultiValue `json:"photos,omitempty"`
+	Active      *bool        `json:"active,omitempty"`
+	Meta        *Meta        `json:"meta,omitempty"`
+}
+
+// ListResponse is a page of the resources, StartIndex is 1-based
+type ListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// VersionOf the user as the weak ETag, the version is incremented on every write
+func VersionOf(userInfo user.UserInfo) string {
+	return `W/"` + strconv.FormatInt(userInfo.Version, 10) + `"`
+}
+
+// primaryOf the values, or the first value if none is primary
+func primaryOf(values []MultiValue) string {
+	for _, value := range values {
+		if value.Primary {
+			return value.Value
+		}
+	}
+	if len(values) != 0 {
+		return values[0].Value
+	}
+
+	return ""
+}
+
+// UserOf maps the user provisioned by the tenant onto the resource
+func UserOf(userInfo user.UserInfo, member Member, location string) User {
+	active := userInfo.IsActive()
+	resource := User{
+		Schemas:     []string{SchemaUser},
+		ID:          userInfo.ID,
+		ExternalID:  member.ExternalID,
+		UserName:    userInfo.Name,
+		Name:        &Name{Formatted: userInfo.DisplayName},
+		DisplayName: userInfo.DisplayName,
+		Active:      &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      userInfo.CreatedAt,
+			LastModified: userInfo.UpdatedAt,
+			Version:      VersionOf(userInfo),
+			Location:     location,
+		},
+	}
+	if userInfo.Email != "" {
+		resource.Emails = []MultiValue{{Value: userInfo.Email, Type: "work", Primary: true}}
+	}
+	if userInfo.Picture != "" {
+		resource.Photos = []MultiValue{{Value: userInfo.Picture, Type: "photo", Primary: true}}
+	}
+
+	return resource
+}
+
+// Apply the resource to the user, replacing the mapped fields
+// displayName falls back to name.formatted and then to userName, since the display name is required
+// The picture is kept unless photos is given, the status is handled by the caller with Active
+func (resource User) Apply(userInfo user.UserInfo) user.UserInfo {
+	userInfo.Name = resource.UserName
+	userInfo.DisplayName = resource.DisplayName
+	if userInfo.DisplayName == "" && resource.Name != nil {
+		userInfo.DisplayName = resource.Name.Formatted
+	}
+	if userInfo.DisplayName == "" {
+		userInfo.DisplayName = resource.UserName
+	}
+	userInfo.Email = primaryOf(resource.Emails)
+	if picture := primaryOf(resource.Photos); picture != "" {
+		userInfo.Picture = picture
+	}
+
+	return userInfo
+}
+
+// Validate the fields given by the directory, the other fields are checked by user.ValidateFields
+func (resource User) Validate() error {
+	if strings.TrimSpace(resource.UserName) == "" {
+		return NewError(400, "invalidValue", "userName is required")
+	}
+
+	return nil
+}
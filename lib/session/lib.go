@@ -0,0 +1,207 @@
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/ddb"
+	"github.com/portals-me/account/lib/jwt"
+)
+
+var ErrNotFound = errors.New("Session not found")
+
+// last_seen_at is not updated more often than this
+const touchInterval = 5 * time.Minute
+
+// Session is created for each signin and referenced from the token by `sid` claim
+type Session struct {
+	ID          string    `json:"-" dynamo:"id"`
+	Sort        string    `json:"-" dynamo:"sort"`
+	SessionID   string    `json:"id" dynamo:"session_id"`
+	DeviceLabel string    `json:"device_label" dynamo:"device_label"`
+	UserAgent   string    `json:"user_agent" dynamo:"user_agent"`
+	SourceIP    string    `json:"source_ip" dynamo:"source_ip"`
+	AuthMethod  string    `json:"auth_method" dynamo:"auth_method"`
+	CreatedAt   time.Time `json:"created_at" dynamo:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at" dynamo:"last_seen_at"`
+	TTL         int64     `json:"-" dynamo:"ttl"`
+}
+
+// Revocation invalidates every token of the user issued before RevokedAt (unix time in milliseconds)
+type Revocation struct {
+	ID        string `dynamo:"id"`
+	Sort      string `dynamo:"sort"`
+	RevokedAt int64  `dynamo:"revoked_at"`
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func sortKey(sessionID string) string {
+	return "session##" + sessionID
+}
+
+// DeviceLabelOf makes a label from User-Agent when the client does not send one
+func DeviceLabelOf(label string, userAgent string) string {
+	if label == "" {
+		label = userAgent
+	}
+	if len(label) > 64 {
+		label = label[:64]
+	}
+
+	return label
+}
+
+// -- Session Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// Create a new session for the signin
+func (repo Repository) Create(userID string, authMethod string, deviceLabel string, userAgent string, sourceIP string) (Session, error) {
+	now := time.Now().UTC()
+	sessionID := uuid.NewV4().String()
+
+	session := Session{
+		ID:          userID,
+		Sort:        sortKey(sessionID),
+		SessionID:   sessionID,
+		DeviceLabel: DeviceLabelOf(deviceLabel, userAgent),
+		UserAgent:   userAgent,
+		SourceIP:    sourceIP,
+		AuthMethod:  authMethod,
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		TTL:         now.Add(jwt.Lifetime).Unix(),
+	}
+
+	if err := repo.table.Put(session).If("attribute_not_exists(id)").Run(); err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// Get the session, returns ErrNotFound if the session is revoked or expired
+func (repo Repository) Get(userID string, sessionID string, session *Session) error {
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.Equal, sortKey(sessionID)).
+		One(session); err != nil {
+		if err == dynamo.ErrNotFound {
+			return ErrNotFound
+		}
+
+		return err
+	}
+
+	if session.TTL < time.Now().Unix() {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// List sessions of the user
+func (repo Repository) List(userID string) ([]Session, error) {
+	sessions := []Session{}
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.BeginsWith, "session##").
+		All(&sessions); err != nil {
+		return nil, err
+	}
+
+	active := []Session{}
+	for _, session := range sessions {
+		if session.TTL >= time.Now().Unix() {
+			active = append(active, session)
+		}
+	}
+
+	return active, nil
+}
+
+// Touch updates last_seen_at of the session
+func (repo Repository) Touch(session Session) error {
+	now := time.Now().UTC()
+	if now.Sub(session.LastSeenAt) < touchInterval {
+		return nil
+	}
+
+	return repo.table.
+		Update("id", session.ID).
+		Range("sort", session.Sort).
+		Set("last_seen_at", now).
+		If("attribute_exists(id)").
+		Run()
+}
+
+// Revoke signs the session out
+func (repo Repository) Revoke(userID string, sessionID string) error {
+	if err := repo.table.
+		Delete("id", userID).
+		Range("sort", sortKey(sessionID)).
+		If("attribute_exists(id)").
+		Run(); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return ErrNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// RevokeAll signs the user out from every device
+// The tokens without a session, such as the refresh tokens and the tokens issued before sessions were introduced,
+// are rejected by the revocation marker
+func (repo Repository) RevokeAll(userID string) error {
+	sessions, err := repo.List(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := repo.Revoke(userID, session.SessionID); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	return repo.table.Put(Revocation{
+		ID:        userID,
+		Sort:      "revocation",
+		RevokedAt: unixMilli(time.Now()),
+	}).Run()
+}
+
+// IsRevoked checks whether a token issued at issuedAt has been revoked by RevokeAll
+// Pass time.Unix(iat, 0) for a JWT, a token issued in the same second as the revocation is rejected then
+func (repo Repository) IsRevoked(userID string, issuedAt time.Time) (bool, error) {
+	var revocation Revocation
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.Equal, "revocation").
+		One(&revocation); err != nil {
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return unixMilli(issuedAt) <= revocation.RevokedAt, nil
+}
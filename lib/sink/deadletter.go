@@ -0,0 +1,270 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/ddb"
+	"github.com/portals-me/account/lib/event"
+)
+
+// DeadLetter is an event which could not be delivered to the sink,
+// or a stream record which could not be converted to events
+type DeadLetter struct {
+	ID      string `json:"-" dynamo:"id"`
+	Sort    string `json:"-" dynamo:"sort"`
+	EntryID string `json:"id" dynamo:"entry_id"`
+	// Sink is empty for a stream record
+	Sink     string `json:"sink,omitempty" dynamo:"sink"`
+	Error    string `json:"error" dynamo:"error"`
+	Attempts int    `json:"attempts" dynamo:"attempts"`
+	// JSON of the CloudEvent or the stream record, one of them is set
+	Event    string    `json:"event,omitempty" dynamo:"event"`
+	Record   string    `json:"record,omitempty" dynamo:"record"`
+	FailedAt time.Time `json:"failed_at" dynamo:"failed_at"`
+}
+
+// DeadLetterQueue keeps the dead letters until they are replayed
+type DeadLetterQueue interface {
+	Put(deadLetter DeadLetter) error
+	List() ([]DeadLetter, error)
+	Delete(deadLetter DeadLetter) error
+}
+
+// NewDeadLetterQueue creates a DeadLetterQueue by the config
+// Type string: "table" for the account table or "file" for the JSON lines at Target
+func NewDeadLetterQueue(config Config, table dynamo.Table) (DeadLetterQueue, error) {
+	switch config.Type {
+	case "table", "":
+		return TableDeadLetterQueue{
+			table: table,
+		}, nil
+	case "file":
+		return FileDeadLetterQueue{
+			Path: config.Target,
+		}, nil
+	}
+
+	return nil, errors.New("Unsupported dead letter queue: " + config.Type)
+}
+
+func newDeadLetter(deadLetter DeadLetter) DeadLetter {
+	deadLetter.EntryID = uuid.NewV4().String()
+	deadLetter.FailedAt = time.Now().UTC()
+	deadLetter.ID = "dead-letter"
+	deadLetter.Sort = "dead-letter##" + deadLetter.FailedAt.Format(ddb.SortTimeFormat) + "##" + deadLetter.EntryID
+
+	return deadLetter
+}
+
+// DeadLetterOfEvent records the event failed to be sent to the sink
+func DeadLetterOfEvent(sinkName string, cloudEvent event.CloudEvent, attempts int, err error) (DeadLetter, error) {
+	raw, merr := json.Marshal(cloudEvent)
+	if merr != nil {
+		return DeadLetter{}, merr
+	}
+
+	return newDeadLetter(DeadLetter{
+		Sink:     sinkName,
+		Error:    err.Error(),
+		Attempts: attempts,
+		Event:    string(raw),
+	}), nil
+}
+
+// DeadLetterOfRecord records the stream record failed to be converted
+func DeadLetterOfRecord(record events.DynamoDBEventRecord, err error) (DeadLetter, error) {
+	raw, merr := json.Marshal(record)
+	if merr != nil {
+		return DeadLetter{}, merr
+	}
+
+	return newDeadLetter(DeadLetter{
+		Error:    err.Error(),
+		Attempts: 1,
+		Record:   string(raw),
+	}), nil
+}
+
+// ----------------
+// TableDeadLetterQueue keeps the dead letters in the account table, oldest first
+
+type TableDeadLetterQueue struct {
+	table dynamo.Table
+}
+
+func (queue TableDeadLetterQueue) Put(deadLetter DeadLetter) error {
+	return queue.table.Put(deadLetter).Run()
+}
+
+func (queue TableDeadLetterQueue) List() ([]DeadLetter, error) {
+	var deadLetters []DeadLetter
+	if err := queue.table.
+		Get("id", "dead-letter").
+		Range("sort", dynamo.BeginsWith, "dead-letter##").
+		Consistent(true).
+		All(&deadLetters); err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+func (queue TableDeadLetterQueue) Delete(deadLetter DeadLetter) error {
+	return queue.table.
+		Delete("id", deadLetter.ID).
+		Range("sort", deadLetter.Sort).
+		Run()
+}
+
+// ----------------
+// FileDeadLetterQueue keeps the dead letters as JSON lines, for development
+
+type FileDeadLetterQueue struct {
+	Path string
+}
+
+func (queue FileDeadLetterQueue) Put(deadLetter DeadLetter) error {
+	file, err := os.OpenFile(queue.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(deadLetter)
+}
+
+func (queue FileDeadLetterQueue) List() ([]DeadLetter, error) {
+	file, err := os.Open(queue.Path)
+	if os.IsNotExist(err) {
+		return []DeadLetter{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	deadLetters := []DeadLetter{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var deadLetter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &deadLetter); err != nil {
+			return nil, err
+		}
+
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, scanner.Err()
+}
+
+// Delete rewrites the file without the dead letter
+func (queue FileDeadLetterQueue) Delete(deadLetter DeadLetter) error {
+	deadLetters, err := queue.List()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(queue.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, entry := range deadLetters {
+		if entry.EntryID == deadLetter.EntryID {
+			continue
+		}
+
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// -- Replay --
+
+// Replay re-drives the dead letters and deletes the ones delivered
+// An event is sent to the sink it failed on, a stream record is converted and routed again
+func Replay(router Router, queue DeadLetterQueue, dryRun bool, log io.Writer) error {
+	deadLetters, err := queue.List()
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for _, deadLetter := range deadLetters {
+		if dryRun {
+			fmt.Fprintf(log, "%s: %s %s (%s)\n", deadLetter.EntryID, deadLetter.FailedAt.Format(time.RFC3339), deadLetter.Sink, deadLetter.Error)
+			continue
+		}
+
+		if err := replay(router, deadLetter); err != nil {
+			fmt.Fprintf(log, "%s: failed again: %v\n", deadLetter.EntryID, err)
+			continue
+		}
+		if err := queue.Delete(deadLetter); err != nil {
+			return err
+		}
+
+		replayed++
+	}
+
+	fmt.Fprintf(log, "%d dead letters, %d replayed\n", len(deadLetters), replayed)
+	return nil
+}
+
+func replay(router Router, deadLetter DeadLetter) error {
+	if deadLetter.Event != "" {
+		var cloudEvent event.CloudEvent
+		if err := json.Unmarshal([]byte(deadLetter.Event), &cloudEvent); err != nil {
+			return err
+		}
+
+		return firstError(router.SendTo([]string{deadLetter.Sink}, cloudEvent))
+	}
+
+	var record events.DynamoDBEventRecord
+	if err := json.Unmarshal([]byte(deadLetter.Record), &record); err != nil {
+		return err
+	}
+
+	accountEvents, err := event.FromStreamRecord(record)
+	if err != nil {
+		return err
+	}
+
+	for _, accountEvent := range accountEvents {
+		cloudEvent := accountEvent.CloudEvent()
+		if err := firstError(router.SendTo(router.SinksOf(cloudEvent.EventType()), cloudEvent)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func firstError(failures map[string]error) error {
+	for name, err := range failures {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package sink
+
+import (
+	"time"
+
+	"github.com/guregu/dynamo"
+)
+
+// The stream keeps the records for 24 hours, a record can not be delivered again after that
+const publishedLifetime = 24 * time.Hour
+
+// IdempotencyStore remembers the events sent to each sink, so a retried batch does not send them again
+type IdempotencyStore interface {
+	IsPublished(eventID string, sinkName string) (bool, error)
+	MarkPublished(eventID string, sinkName string) error
+}
+
+// Published is the mark of an event sent to the sink
+type Published struct {
+	ID          string    `dynamo:"id"`
+	Sort        string    `dynamo:"sort"`
+	PublishedAt time.Time `dynamo:"published_at"`
+	TTL         int64     `dynamo:"ttl"`
+}
+
+// ----------------
+// TableIdempotencyStore keeps the marks in the account table until they expire by TTL
+
+type TableIdempotencyStore struct {
+	table dynamo.Table
+}
+
+func NewTableIdempotencyStore(table dynamo.Table) TableIdempotencyStore {
+	return TableIdempotencyStore{
+		table: table,
+	}
+}
+
+func publishedKey(eventID string) string {
+	return "event##" + eventID
+}
+
+func (store TableIdempotencyStore) IsPublished(eventID string, sinkName string) (bool, error) {
+	var published Published
+	if err := store.table.
+		Get("id", publishedKey(eventID)).
+		Range("sort", dynamo.Equal, "published##"+sinkName).
+		Consistent(true).
+		One(&published); err != nil {
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (store TableIdempotencyStore) MarkPublished(eventID string, sinkName string) error {
+	now := time.Now().UTC()
+
+	return store.table.Put(Published{
+		ID:          publishedKey(eventID),
+		Sort:        "published##" + sinkName,
+		PublishedAt: now,
+		TTL:         now.Add(publishedLifetime).Unix(),
+	}).Run()
+}
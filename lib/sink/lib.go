@@ -0,0 +1,423 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents/cloudwatcheventsiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/event"
+	"github.com/portals-me/account/lib/webhook"
+)
+
+// Sink delivers the account events to somewhere
+type Sink interface {
+	Send(cloudEvent event.CloudEvent) error
+}
+
+// Config of a sink
+// Type string: "sns", "sqs", "eventbridge", "http", "webhooks", "stdout" or "file"
+// Target is the topic ARN, the queue URL, the URL, the account table name or the file path by the type, unused for eventbridge
+type Config struct {
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+// New creates a Sink by the config
+func New(config Config, sess *session.Session) (Sink, error) {
+	switch config.Type {
+	case "sns":
+		return SNSSink{
+			SNS:      sns.New(sess),
+			TopicArn: config.Target,
+		}, nil
+	case "sqs":
+		return SQSSink{
+			SQS:      sqs.New(sess),
+			QueueURL: config.Target,
+		}, nil
+	case "eventbridge":
+		return EventBridgeSink{
+			Events: cloudwatchevents.New(sess),
+		}, nil
+	case "http":
+		return HTTPSink{
+			URL:    config.Target,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "webhooks":
+		return WebhookSink{
+			Dispatcher: webhook.NewDispatcher(dynamo.NewFromIface(dynamodb.New(sess)).Table(config.Target)),
+		}, nil
+	case "stdout":
+		return &WriterSink{
+			Writer: os.Stdout,
+		}, nil
+	case "file":
+		file, err := os.OpenFile(config.Target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		return &WriterSink{
+			Writer: file,
+		}, nil
+	}
+
+	return nil, errors.New("Unsupported sink: " + config.Type)
+}
+
+// message attributes for the filter policy of the subscribers
+func attributesOf(cloudEvent event.CloudEvent) map[string]string {
+	return map[string]string{
+		"event_type":     cloudEvent.EventType(),
+		"schema_version": cloudEvent.SchemaVersion,
+	}
+}
+
+func isFIFO(target string) bool {
+	return strings.HasSuffix(target, ".fifo")
+}
+
+// ----------------
+// SNSSink publishes the events to the topic
+// For a FIFO topic the events are grouped by the user, and deduplicated by the event ID
+
+type SNSSink struct {
+	SNS      snsiface.SNSAPI
+	TopicArn string
+}
+
+func (sink SNSSink) Send(cloudEvent event.CloudEvent) error {
+	jsn, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+
+	attributes := map[string]*sns.MessageAttributeValue{}
+	for key, value := range attributesOf(cloudEvent) {
+		attributes[key] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	input := &sns.PublishInput{
+		Message:           aws.String(string(jsn)),
+		TopicArn:          aws.String(sink.TopicArn),
+		MessageAttributes: attributes,
+	}
+	if isFIFO(sink.TopicArn) {
+		input.MessageGroupId = aws.String(cloudEvent.Subject)
+		input.MessageDeduplicationId = aws.String(cloudEvent.ID)
+	}
+
+	_, err = sink.SNS.Publish(input)
+	return err
+}
+
+// ----------------
+// SQSSink sends the events to the queue
+// For a FIFO queue the events are grouped by the user, and deduplicated by the event ID
+
+type SQSSink struct {
+	SQS      sqsiface.SQSAPI
+	QueueURL string
+}
+
+func (sink SQSSink) Send(cloudEvent event.CloudEvent) error {
+	jsn, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+
+	attributes := map[string]*sqs.MessageAttributeValue{}
+	for key, value := range attributesOf(cloudEvent) {
+		attributes[key] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	input := &sqs.SendMessageInput{
+		MessageBody:       aws.String(string(jsn)),
+		QueueUrl:          aws.String(sink.QueueURL),
+		MessageAttributes: attributes,
+	}
+	if isFIFO(sink.QueueURL) {
+		input.MessageGroupId = aws.String(cloudEvent.Subject)
+		input.MessageDeduplicationId = aws.String(cloudEvent.ID)
+	}
+
+	_, err = sink.SQS.SendMessage(input)
+	return err
+}
+
+// ----------------
+// EventBridgeSink puts the events to the default event bus, the detail type is the type of the CloudEvent
+
+type EventBridgeSink struct {
+	Events cloudwatcheventsiface.CloudWatchEventsAPI
+}
+
+func (sink EventBridgeSink) Send(cloudEvent event.CloudEvent) error {
+	jsn, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+
+	output, err := sink.Events.PutEvents(&cloudwatchevents.PutEventsInput{
+		Entries: []*cloudwatchevents.PutEventsRequestEntry{
+			{
+				Source:     aws.String(cloudEvent.Source),
+				DetailType: aws.String(cloudEvent.Type),
+				Detail:     aws.String(string(jsn)),
+				Time:       aws.Time(cloudEvent.Time),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(output.FailedEntryCount) != 0 {
+		return fmt.Errorf("PutEvents failed: %s", aws.StringValue(output.Entries[0].ErrorMessage))
+	}
+
+	return nil
+}
+
+// ----------------
+// HTTPSink posts the events in the structured content mode of CloudEvents
+
+type HTTPSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (sink HTTPSink) Send(cloudEvent event.CloudEvent) error {
+	jsn, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sink.Client.Post(sink.URL, "application/cloudevents+json; charset=utf-8", bytes.NewReader(jsn))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %d", sink.URL, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// ----------------
+// WebhookSink delivers the events to the webhook endpoints registered in the account table
+// A failed delivery is logged to the endpoint instead of failing the sink
+
+type WebhookSink struct {
+	Dispatcher webhook.Dispatcher
+}
+
+func (sink WebhookSink) Send(cloudEvent event.CloudEvent) error {
+	return sink.Dispatcher.Dispatch(cloudEvent)
+}
+
+// ----------------
+// WriterSink writes the events as JSON lines, for development
+
+type WriterSink struct {
+	Writer io.Writer
+	mutex  sync.Mutex
+}
+
+func (sink *WriterSink) Send(cloudEvent event.CloudEvent) error {
+	jsn, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	_, err = sink.Writer.Write(append(jsn, '\n'))
+	return err
+}
+
+// -- Routing --
+
+// Route sends the events of Types to the sinks
+// A type is the exact event type, a prefix such as "user.*" or "*" for every event
+type Route struct {
+	Types []string `json:"types"`
+	Sinks []string `json:"sinks"`
+}
+
+// RouterConfig defines the sinks by name and the routes referring to them
+type RouterConfig struct {
+	Sinks  map[string]Config `json:"sinks"`
+	Routes []Route           `json:"routes"`
+	// DeadLetter is the config of the DeadLetterQueue, the account table by default
+	DeadLetter Config `json:"dead_letter"`
+}
+
+type Router struct {
+	sinks  map[string]Sink
+	routes []Route
+	// Retry policy of Deliver
+	MaxAttempts int
+	Backoff     time.Duration
+	// The sinks already sent the event are skipped if set
+	Published IdempotencyStore
+}
+
+// LoadRouterConfig parses the JSON config
+// Every event is published to the topic and the webhooks of the table when the config is empty
+func LoadRouterConfig(raw string, topicArn string, tableName string) (RouterConfig, error) {
+	if raw == "" {
+		return RouterConfig{
+			Sinks: map[string]Config{
+				"topic":    {Type: "sns", Target: topicArn},
+				"webhooks": {Type: "webhooks", Target: tableName},
+			},
+			Routes: []Route{
+				{Types: []string{"*"}, Sinks: []string{"topic", "webhooks"}},
+			},
+		}, nil
+	}
+
+	var config RouterConfig
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return RouterConfig{}, err
+	}
+
+	return config, nil
+}
+
+// NewRouter creates the sinks, every sink referred by the routes must be defined
+func NewRouter(config RouterConfig, sess *session.Session) (Router, error) {
+	sinks := map[string]Sink{}
+	for name, sinkConfig := range config.Sinks {
+		sink, err := New(sinkConfig, sess)
+		if err != nil {
+			return Router{}, fmt.Errorf("sink %s: %v", name, err)
+		}
+
+		sinks[name] = sink
+	}
+
+	for _, route := range config.Routes {
+		for _, name := range route.Sinks {
+			if _, ok := sinks[name]; !ok {
+				return Router{}, errors.New("Undefined sink: " + name)
+			}
+		}
+	}
+
+	return Router{
+		sinks:       sinks,
+		routes:      config.Routes,
+		MaxAttempts: 3,
+		Backoff:     200 * time.Millisecond,
+	}, nil
+}
+
+// SinksOf the event type, each sink appears once even if several routes match
+func (router Router) SinksOf(eventType string) []string {
+	names := []string{}
+	found := map[string]bool{}
+	for _, route := range router.routes {
+		for _, pattern := range route.Types {
+			if !event.MatchType(pattern, eventType) {
+				continue
+			}
+
+			for _, name := range route.Sinks {
+				if !found[name] {
+					found[name] = true
+					names = append(names, name)
+				}
+			}
+			break
+		}
+	}
+
+	return names
+}
+
+// SendTo sends the event to the sinks and returns the errors by the failed sinks
+// The event is sent to the rest of the sinks even if one fails
+func (router Router) SendTo(names []string, cloudEvent event.CloudEvent) map[string]error {
+	failures := map[string]error{}
+	for _, name := range names {
+		sink, ok := router.sinks[name]
+		if !ok {
+			failures[name] = errors.New("Undefined sink: " + name)
+			continue
+		}
+
+		if router.Published != nil {
+			published, err := router.Published.IsPublished(cloudEvent.ID, name)
+			if err != nil {
+				failures[name] = err
+				continue
+			}
+			if published {
+				continue
+			}
+		}
+
+		if err := sink.Send(cloudEvent); err != nil {
+			failures[name] = err
+			continue
+		}
+
+		// The event was sent, failing to mark it only risks a duplicate on the retry
+		if router.Published != nil {
+			if err := router.Published.MarkPublished(cloudEvent.ID, name); err != nil {
+				fmt.Printf("Mark %s published to %s failed: %+v\n", cloudEvent.ID, name, err)
+			}
+		}
+	}
+
+	return failures
+}
+
+// Deliver sends the event to every sink routed, retrying only the failed sinks with exponential backoff
+// Returns the last errors of the sinks which failed MaxAttempts times
+func (router Router) Deliver(cloudEvent event.CloudEvent) map[string]error {
+	pending := router.SinksOf(cloudEvent.EventType())
+	failures := map[string]error{}
+	for attempt := 0; attempt < router.MaxAttempts && len(pending) != 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(router.Backoff << uint(attempt-1))
+		}
+
+		failures = router.SendTo(pending, cloudEvent)
+		pending = []string{}
+		for name := range failures {
+			pending = append(pending, name)
+		}
+	}
+
+	return failures
+}
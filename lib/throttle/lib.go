@@ -0,0 +1,176 @@
+package throttle
+
+import (
+	"time"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/ddb"
+)
+
+// Attempt counts the failed signin attempts for a key (user_name or source IP)
+type Attempt struct {
+	ID            string `json:"key" dynamo:"id"`
+	Sort          string `json:"-" dynamo:"sort"`
+	Failures      int    `json:"failures" dynamo:"failures"`
+	LastFailureAt int64  `json:"last_failure_at" dynamo:"last_failure_at"`
+	LockedUntil   int64  `json:"locked_until" dynamo:"locked_until"`
+	TTL           int64  `json:"-" dynamo:"ttl"`
+}
+
+// Policy describes when and how long the key is locked
+// The key is locked for BaseDelay * 2^(failures - FreeAttempts - 1) (up to MaxDelay)
+// after FreeAttempts failures within Window
+type Policy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+var UserPolicy = Policy{
+	FreeAttempts: 5,
+	BaseDelay:    30 * time.Second,
+	MaxDelay:     time.Hour,
+	Window:       24 * time.Hour,
+}
+
+var IPPolicy = Policy{
+	FreeAttempts: 20,
+	BaseDelay:    30 * time.Second,
+	MaxDelay:     time.Hour,
+	Window:       24 * time.Hour,
+}
+
+func UserKey(userName string) string {
+	return "signin-attempt##user##" + userName
+}
+
+func IPKey(sourceIP string) string {
+	return "signin-attempt##ip##" + sourceIP
+}
+
+func (policy Policy) lockDuration(failures int) time.Duration {
+	exceeded := failures - policy.FreeAttempts
+	if exceeded <= 0 {
+		return 0
+	}
+
+	delay := policy.BaseDelay
+	for i := 1; i < exceeded && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	return delay
+}
+
+// -- Throttle Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// Get the attempt record of the key
+func (repo Repository) Get(key string, attempt *Attempt) error {
+	return repo.table.
+		Get("id", key).
+		Range("sort", dynamo.Equal, "signin-attempt").
+		Consistent(true).
+		One(attempt)
+}
+
+// LockedUntil returns the time until the key is locked, or zero time if the key is not locked
+func (repo Repository) LockedUntil(key string) (time.Time, error) {
+	var attempt Attempt
+	if err := repo.Get(key, &attempt); err != nil {
+		if err == dynamo.ErrNotFound {
+			return time.Time{}, nil
+		}
+
+		return time.Time{}, err
+	}
+
+	if attempt.LockedUntil <= time.Now().Unix() {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(attempt.LockedUntil, 0), nil
+}
+
+// RecordFailure increments the failure counter and locks the key if necessary
+func (repo Repository) RecordFailure(key string, policy Policy) error {
+	now := time.Now()
+	ttl := now.Add(policy.Window).Unix()
+
+	var attempt Attempt
+	err := repo.table.
+		Update("id", key).
+		Range("sort", "signin-attempt").
+		Add("failures", 1).
+		Set("last_failure_at", now.Unix()).
+		Set("ttl", ttl).
+		If("attribute_not_exists(last_failure_at) OR last_failure_at > ?", now.Add(-policy.Window).Unix()).
+		Value(&attempt)
+	if ddb.IsCondCheckFailed(err) {
+		// The last failure is out of the window, start counting again
+		attempt = Attempt{
+			ID:            key,
+			Sort:          "signin-attempt",
+			Failures:      1,
+			LastFailureAt: now.Unix(),
+			TTL:           ttl,
+		}
+		err = repo.table.Put(attempt).Run()
+	}
+	if err != nil {
+		return err
+	}
+
+	lock := policy.lockDuration(attempt.Failures)
+	if lock == 0 {
+		return nil
+	}
+
+	return repo.table.
+		Update("id", key).
+		Range("sort", "signin-attempt").
+		Set("locked_until", now.Add(lock).Unix()).
+		Run()
+}
+
+// Reset the counter after a successful signin or by Unlock
+func (repo Repository) Reset(key string) error {
+	return repo.table.
+		Delete("id", key).
+		Range("sort", "signin-attempt").
+		Run()
+}
+
+// Lockout returns the failures of the user_name for admins, nil if there are none
+func (repo Repository) Lockout(userName string) (*Attempt, error) {
+	var attempt Attempt
+	if err := repo.Get(UserKey(userName), &attempt); err != nil {
+		if err == dynamo.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// Unlock lets the user sign in again before the lock expires
+// The counter of the source IP is kept, it is not tied to the user
+func (repo Repository) Unlock(userName string) error {
+	return repo.Reset(UserKey(userName))
+}
@@ -0,0 +1,172 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/ddb"
+)
+
+// Prefix of personal access tokens, used to tell them from JWTs
+const Prefix = "pat_"
+
+// last_used_at is not updated more often than this
+const touchInterval = 5 * time.Minute
+
+var ErrNotFound = errors.New("Token not found")
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+// PersonalAccessToken is stored with the hash of the token, the raw token is shown only once
+// Name is not stored in `name` attribute since it is the key of the name index
+type PersonalAccessToken struct {
+	ID         string    `json:"-" dynamo:"id"`
+	Sort       string    `json:"-" dynamo:"sort"`
+	TokenID    string    `json:"id" dynamo:"token_id"`
+	Name       string    `json:"name" dynamo:"name_label"`
+	Scopes     []string  `json:"scopes" dynamo:"scopes,set"`
+	CreatedAt  time.Time `json:"created_at" dynamo:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at" dynamo:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at" dynamo:"last_used_at"`
+	TTL        int64     `json:"-" dynamo:"ttl"`
+}
+
+func IsPersonalAccessToken(raw string) bool {
+	return strings.HasPrefix(raw, Prefix)
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// -- Token Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// Create a token, returns the raw token which must be shown to the user only once
+func (repo Repository) Create(userID string, name string, scopes []string, lifetime time.Duration) (PersonalAccessToken, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return PersonalAccessToken{}, "", err
+	}
+	raw := Prefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	now := time.Now().UTC()
+	pat := PersonalAccessToken{
+		ID:        userID,
+		Sort:      "pat##" + hashToken(raw),
+		TokenID:   uuid.NewV4().String(),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(lifetime),
+		TTL:       now.Add(lifetime).Unix(),
+	}
+
+	if err := repo.table.Put(pat).If("attribute_not_exists(id)").Run(); err != nil {
+		return PersonalAccessToken{}, "", err
+	}
+
+	return pat, raw, nil
+}
+
+// Verify finds the token by the raw token, returns ErrInvalidToken if it is revoked or expired
+func (repo Repository) Verify(raw string, pat *PersonalAccessToken) error {
+	if err := repo.table.
+		Get("sort", "pat##"+hashToken(raw)).
+		Index("auth").
+		One(pat); err != nil {
+		if err == dynamo.ErrNotFound {
+			return ErrInvalidToken
+		}
+
+		return err
+	}
+
+	if pat.ExpiresAt.Before(time.Now()) {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// List tokens of the user
+func (repo Repository) List(userID string) ([]PersonalAccessToken, error) {
+	pats := []PersonalAccessToken{}
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.BeginsWith, "pat##").
+		All(&pats); err != nil {
+		return nil, err
+	}
+
+	active := []PersonalAccessToken{}
+	for _, pat := range pats {
+		if pat.ExpiresAt.After(time.Now()) {
+			active = append(active, pat)
+		}
+	}
+
+	return active, nil
+}
+
+// Revoke the token by its ID
+func (repo Repository) Revoke(userID string, tokenID string) error {
+	var pats []PersonalAccessToken
+	if err := repo.table.
+		Get("id", userID).
+		Range("sort", dynamo.BeginsWith, "pat##").
+		Filter("token_id = ?", tokenID).
+		All(&pats); err != nil {
+		return err
+	}
+
+	if len(pats) == 0 {
+		return ErrNotFound
+	}
+
+	if err := repo.table.
+		Delete("id", userID).
+		Range("sort", pats[0].Sort).
+		If("attribute_exists(id)").
+		Run(); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return ErrNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Touch updates last_used_at of the token
+func (repo Repository) Touch(pat PersonalAccessToken) error {
+	now := time.Now().UTC()
+	if now.Sub(pat.LastUsedAt) < touchInterval {
+		return nil
+	}
+
+	return repo.table.
+		Update("id", pat.ID).
+		Range("sort", pat.Sort).
+		Set("last_used_at", now).
+		If("attribute_exists(id)").
+		Run()
+}
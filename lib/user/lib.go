@@ -3,16 +3,22 @@ package user
 import (
 	"errors"
 	"fmt"
+	"net/mail"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/ddb"
 )
 
 // DynamoDB record compatible UserInfo
 type UserInfoDDB struct {
 	UserInfo
 	Sort string `dynamo:"sort"`
+	// for case-insensitive lookup of the name
+	NameLower string `dynamo:"name_lower"`
 }
 
 type UserInfo struct {
@@ -20,44 +26,161 @@ type UserInfo struct {
 	Name        string `json:"name" dynamo:"name"`
 	Picture     string `json:"picture" dynamo:"picture"`
 	DisplayName string `json:"display_name" dynamo:"display_name"`
+	Email       string `json:"email" dynamo:"email"`
+	// Role and Scopes are managed by admins, users can not change them
+	Role   string   `json:"role,omitempty" dynamo:"role"`
+	Scopes []string `json:"scopes,omitempty" dynamo:"scopes,set"`
+	// Status is empty for accounts created before suspension was introduced, which means active
+	Status       string `json:"status,omitempty" dynamo:"status"`
+	StatusReason string `json:"status_reason,omitempty" dynamo:"status_reason"`
+	// unix time when the suspension ends, 0 for indefinite suspension
+	StatusUntil int64     `json:"status_until,omitempty" dynamo:"status_until"`
+	CreatedAt   time.Time `json:"created_at" dynamo:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" dynamo:"updated_at"`
+	// Version is incremented on every write, records without version are treated as version 0
+	Version int64 `json:"version" dynamo:"version"`
 }
 
+// Status of the account
+const (
+	StatusActive          = "active"
+	StatusSuspended       = "suspended"
+	StatusPendingDeletion = "pending_deletion"
+)
+
+var ErrVersionConflict = errors.New("The user has been updated by another request")
+var ErrSuspended = errors.New("Account suspended")
+var ErrPendingDeletion = errors.New("Account pending deletion")
+
+// CurrentStatus returns the status at now, a timed suspension which has ended is active
+func (userInfo UserInfo) CurrentStatus(now time.Time) string {
+	if userInfo.Status == "" {
+		return StatusActive
+	}
+	if userInfo.Status == StatusSuspended && userInfo.StatusUntil != 0 && userInfo.StatusUntil <= now.Unix() {
+		return StatusActive
+	}
+
+	return userInfo.Status
+}
+
+func (userInfo UserInfo) IsActive() bool {
+	return userInfo.CurrentStatus(time.Now()) == StatusActive
+}
+
+// ToDDB fills the timestamps and the version if they are not set, for a new record
 func (userInfo UserInfo) ToDDB() UserInfoDDB {
+	if userInfo.Version == 0 {
+		userInfo.Version = 1
+	}
+	if userInfo.CreatedAt.IsZero() {
+		userInfo.CreatedAt = time.Now().UTC()
+	}
+	if userInfo.UpdatedAt.IsZero() {
+		userInfo.UpdatedAt = userInfo.CreatedAt
+	}
+
 	return UserInfoDDB{
-		UserInfo: userInfo,
-		Sort:     "detail",
+		UserInfo:  userInfo,
+		Sort:      "detail",
+		NameLower: strings.ToLower(userInfo.Name),
 	}
 }
 
+// FieldError describes why the field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is returned by Put for the invalid fields, the message is the one of the first field
+type FieldErrors []FieldError
+
+func (fieldErrors FieldErrors) Error() string {
+	return fieldErrors[0].Message
+}
+
 func Validate(authTable dynamo.Table, newUser UserInfo) error {
-	if len(newUser.Name) < 3 {
-		return errors.New("UserName too short")
+	fieldErrors, err := ValidateFields(authTable, newUser)
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return errors.New("Something went wrong")
 	}
 
-	if !regexp.MustCompile(`^[A-Za-z0-9_]*$`).MatchString(newUser.Name) {
-		return errors.New("Invalid UserName")
+	if len(fieldErrors) != 0 {
+		return errors.New(fieldErrors[0].Message)
 	}
 
+	return nil
+}
+
+// nameExists checks whether another user has the name of newUser, case-insensitively
+// A user keeping the current name is not checked against the other cases, which may exist from before name_lower
+func nameExists(authTable dynamo.Table, newUser UserInfo) (bool, error) {
 	var records []UserInfo
 	if err := authTable.
 		Get("name", newUser.Name).
 		Index("name").
 		All(&records); err != nil {
-		fmt.Printf("%+v\n", err)
-		return errors.New("Something went wrong")
+		return false, err
 	}
 
+	keeping := false
 	for _, record := range records {
 		if record.ID != newUser.ID {
-			return errors.New("UserName already exists")
+			return true, nil
+		}
+
+		keeping = true
+	}
+	if keeping {
+		return false, nil
+	}
+
+	var lowerRecords []UserInfoDDB
+	if err := authTable.
+		Get("name_lower", strings.ToLower(newUser.Name)).
+		Index("name_lower").
+		All(&lowerRecords); err != nil {
+		return false, err
+	}
+
+	for _, record := range lowerRecords {
+		if record.ID != newUser.ID {
+			return true, nil
 		}
 	}
 
-	if newUser.DisplayName == "" || newUser.Picture == "" {
-		return errors.New("Empty field is not acceptable")
+	return false, nil
+}
+
+// ValidateFields reports every invalid field of newUser
+func ValidateFields(authTable dynamo.Table, newUser UserInfo) ([]FieldError, error) {
+	fieldErrors := []FieldError{}
+
+	if len(newUser.Name) < 3 {
+		fieldErrors = append(fieldErrors, FieldError{"name", "too_short", "UserName too short"})
+	} else if !regexp.MustCompile(`^[A-Za-z0-9_]*$`).MatchString(newUser.Name) {
+		fieldErrors = append(fieldErrors, FieldError{"name", "invalid", "Invalid UserName"})
+	} else {
+		exists, err := nameExists(authTable, newUser)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			fieldErrors = append(fieldErrors, FieldError{"name", "already_exists", "UserName already exists"})
+		}
 	}
 
-	return nil
+	if newUser.DisplayName == "" {
+		fieldErrors = append(fieldErrors, FieldError{"display_name", "required", "Empty field is not acceptable"})
+	}
+	if newUser.Picture == "" {
+		fieldErrors = append(fieldErrors, FieldError{"picture", "required", "Empty field is not acceptable"})
+	}
+
+	return fieldErrors, nil
 }
 
 // -- User Repository --
@@ -81,19 +204,216 @@ func (repo Repository) Get(userID string, user *UserInfo) error {
 		One(user)
 }
 
-// Put user object
+// Create the user record without an auth method, for the users provisioned by a directory
+// The user signs in by the identity provider of the directory, check the fields by ValidateFields beforehand
+func (repo Repository) Create(user UserInfo) (UserInfo, error) {
+	record := user.ToDDB()
+	if err := repo.table.Put(record).If("attribute_not_exists(id)").Run(); err != nil {
+		return UserInfo{}, err
+	}
+
+	return record.UserInfo, nil
+}
+
+// update the user record with incrementing the version
+func (repo Repository) update(userID string) *dynamo.Update {
+	return repo.table.
+		Update("id", userID).
+		Range("sort", "detail").
+		Add("version", 1).
+		Set("updated_at", time.Now().UTC())
+}
+
+// pictureChanged compares the picture with the stored record
+// The picture prefilled by the identity provider at signup is kept even if it is not on the domain
+func (repo Repository) pictureChanged(user UserInfo) (bool, error) {
+	var current UserInfo
+	if err := repo.Get(user.ID, &current); err != nil {
+		if err == dynamo.ErrNotFound {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return current.Picture != user.Picture, nil
+}
+
+// Put user object, replacing the whole record
+// Invalid fields are reported as FieldErrors, the picture must be on the domain unless it is unchanged
+// The write succeeds only if the version of the record is still user.Version, otherwise ErrVersionConflict
+// The version and updated_at of user are updated on success
 // domain string: the prefix domain for the picture
-func (repo Repository) Put(user UserInfo, domain string) error {
+func (repo Repository) Put(user *UserInfo, domain string) error {
+	return repo.PutWith(nil, user, domain)
+}
+
+// PutWith is Put in the transaction tx together with the other writes of tx, nil tx writes the user alone
+func (repo Repository) PutWith(tx *dynamo.WriteTx, user *UserInfo, domain string) error {
+	fieldErrors, err := ValidateFields(repo.table, *user)
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+		return errors.New("Something went wrong")
+	}
 	// check picture domain prefix
-	if !strings.HasPrefix(user.Picture, domain) {
-		return errors.New("Unexpected domain: " + user.Picture)
+	if user.Picture != "" && !strings.HasPrefix(user.Picture, domain) {
+		changed, err := repo.pictureChanged(*user)
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			return errors.New("Something went wrong")
+		}
+		if changed {
+			fieldErrors = append(fieldErrors, FieldError{"picture", "invalid_domain", "Unexpected domain: " + user.Picture})
+		}
+	}
+	if user.Email != "" {
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			fieldErrors = append(fieldErrors, FieldError{"email", "invalid", "Invalid email address"})
+		}
+	}
+	if len(fieldErrors) != 0 {
+		return FieldErrors(fieldErrors)
+	}
+
+	expected := user.Version
+	record := *user
+	record.Version = expected + 1
+	record.UpdatedAt = time.Now().UTC()
+
+	put := repo.table.Put(record.ToDDB())
+	if expected == 0 {
+		put = put.If("attribute_exists(id) AND (attribute_not_exists(version) OR version = ?)", expected)
+	} else {
+		put = put.If("attribute_exists(id) AND version = ?", expected)
+	}
+
+	if tx == nil {
+		err = put.Run()
+	} else {
+		err = tx.Put(put).Run()
+	}
+	if err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return ErrVersionConflict
+		}
+
+		return err
+	}
+
+	*user = record
+	return nil
+}
+
+// SetStatus changes the status of the account
+// until int64: unix time when the status ends, only for StatusSuspended
+func (repo Repository) SetStatus(userID string, status string, reason string, until int64) error {
+	update := repo.update(userID).Set("status", status)
+
+	if reason != "" {
+		update = update.Set("status_reason", reason)
+	} else {
+		update = update.Remove("status_reason")
+	}
+	if status == StatusSuspended && until != 0 {
+		update = update.Set("status_until", until)
+	} else {
+		update = update.Remove("status_until")
+	}
+
+	return update.If("attribute_exists(id)").Run()
+}
+
+// EnsureActive returns ErrSuspended or ErrPendingDeletion if the account can not be used
+// The status of a timed suspension which has ended is cleared here
+func (repo Repository) EnsureActive(userInfo *UserInfo) error {
+	switch userInfo.CurrentStatus(time.Now()) {
+	case StatusSuspended:
+		return ErrSuspended
+	case StatusPendingDeletion:
+		return ErrPendingDeletion
+	}
+
+	if userInfo.Status == StatusSuspended {
+		if err := repo.update(userInfo.ID).
+			Set("status", StatusActive).
+			Remove("status_reason").
+			Remove("status_until").
+			If("status = ? AND status_until = ?", StatusSuspended, userInfo.StatusUntil).
+			Run(); err != nil && !ddb.IsCondCheckFailed(err) {
+			return err
+		}
+
+		userInfo.Status = StatusActive
+		userInfo.StatusReason = ""
+		userInfo.StatusUntil = 0
 	}
 
-	if err := Validate(repo.table, user); err != nil {
+	return nil
+}
+
+// Rename changes the name of the user without the other checks of Put
+// The password record is keyed by the name, use password.Repository.Rename (or RenameTx with PutWith) together
+func (repo Repository) Rename(userInfo UserInfo, newName string) error {
+	userInfo.Name = newName
+	if err := Validate(repo.table, userInfo); err != nil {
 		return err
 	}
 
-	return repo.table.Put(user.ToDDB()).Run()
+	return repo.update(userInfo.ID).
+		Set("name", newName).
+		Set("name_lower", strings.ToLower(newName)).
+		If("attribute_exists(id)").
+		Run()
+}
+
+// SetRole changes the role of the user
+func (repo Repository) SetRole(userID string, role string) error {
+	return repo.update(userID).
+		Set("role", role).
+		If("attribute_exists(id)").
+		Run()
+}
+
+// The consents are kept for the stream retention after the user is deleted,
+// so that user.deleted is delivered to the webhooks of the clients the user has approved
+const deletedConsentLifetime = 24 * time.Hour
+
+// Delete every record of the user, the consents expire by TTL
+func (repo Repository) Delete(userID string) error {
+	var records []struct {
+		ID   string `dynamo:"id"`
+		Sort string `dynamo:"sort"`
+	}
+	if err := repo.table.
+		Get("id", userID).
+		Project("id", "sort").
+		All(&records); err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(deletedConsentLifetime).Unix()
+	for _, record := range records {
+		if strings.HasPrefix(record.Sort, "consent##") {
+			if err := repo.table.
+				Update("id", record.ID).
+				Range("sort", record.Sort).
+				Set("ttl", expiresAt).
+				Run(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := repo.table.
+			Delete("id", record.ID).
+			Range("sort", record.Sort).
+			Run(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // AsDynamoTable is used for extracting the internal dynamo table
@@ -0,0 +1,612 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/guregu/dynamo"
+	"github.com/satori/go.uuid"
+
+	"github.com/portals-me/account/lib/ddb"
+	"github.com/portals-me/account/lib/event"
+	"github.com/portals-me/account/lib/oauth"
+)
+
+// Status of an endpoint
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// An endpoint is disabled after this number of deliveries failed in a row
+const MaxConsecutiveFailures = 10
+
+// Delivery logs are kept for this period
+const deliveryLogLifetime = 30 * 24 * time.Hour
+
+// Dispatched marks are kept for the stream retention, a retried batch skips the endpoints already attempted
+const dispatchedLifetime = 24 * time.Hour
+
+// Headers of a delivery
+const (
+	HeaderEventID   = "X-Portals-Event-Id"
+	HeaderEventType = "X-Portals-Event-Type"
+	HeaderTimestamp = "X-Portals-Timestamp"
+	HeaderSignature = "X-Portals-Signature"
+)
+
+var ErrNotFound = errors.New("Webhook endpoint not found")
+var ErrInvalidSignature = errors.New("Invalid signature")
+
+// Endpoint receives the account events for the OAuth client
+// Secret is stored as is since it is needed to sign the deliveries, it is never returned after the creation
+// EventTypes is empty for every event, see event.MatchType for the patterns
+type Endpoint struct {
+	ID                  string    `json:"-" dynamo:"id"`
+	Sort                string    `json:"-" dynamo:"sort"`
+	EndpointID          string    `json:"id" dynamo:"endpoint_id"`
+	ClientID            string    `json:"client_id" dynamo:"client_id"`
+	URL                 string    `json:"url" dynamo:"url"`
+	Secret              string    `json:"-" dynamo:"secret"`
+	EventTypes          []string  `json:"event_types" dynamo:"event_types,set"`
+	Status              string    `json:"status" dynamo:"status"`
+	ConsecutiveFailures int       `json:"consecutive_failures" dynamo:"consecutive_failures"`
+	DisabledAt          time.Time `json:"disabled_at,omitempty" dynamo:"disabled_at"`
+	CreatedAt           time.Time `json:"created_at" dynamo:"created_at"`
+}
+
+// Delivery is the log of an attempt to deliver an event to the endpoint
+// NextAttemptAt is set if the delivery failed and is scheduled to be retried
+type Delivery struct {
+	ID            string    `json:"-" dynamo:"id"`
+	Sort          string    `json:"-" dynamo:"sort"`
+	DeliveryID    string    `json:"id" dynamo:"delivery_id"`
+	EndpointID    string    `json:"endpoint_id" dynamo:"endpoint_id"`
+	EventID       string    `json:"event_id" dynamo:"event_id"`
+	EventType     string    `json:"event_type" dynamo:"event_type"`
+	Attempt       int       `json:"attempt" dynamo:"attempt"`
+	Succeeded     bool      `json:"succeeded" dynamo:"succeeded"`
+	StatusCode    int       `json:"status_code,omitempty" dynamo:"status_code"`
+	Error         string    `json:"error,omitempty" dynamo:"error"`
+	DeliveredAt   time.Time `json:"delivered_at" dynamo:"delivered_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at,omitempty" dynamo:"next_attempt_at"`
+	TTL           int64     `json:"-" dynamo:"ttl"`
+}
+
+// Retry is a failed delivery scheduled at NextAttemptAt, with the CloudEvent JSON to be sent as is
+type Retry struct {
+	ID            string    `dynamo:"id"`
+	Sort          string    `dynamo:"sort"`
+	RetryID       string    `dynamo:"retry_id"`
+	EndpointID    string    `dynamo:"endpoint_id"`
+	Event         string    `dynamo:"event"`
+	Attempts      int       `dynamo:"attempts"`
+	NextAttemptAt time.Time `dynamo:"next_attempt_at"`
+}
+
+// Dispatched is the mark of an event attempted to the endpoint, the failed deliveries are retried by RetryDue
+type Dispatched struct {
+	ID           string    `dynamo:"id"`
+	Sort         string    `dynamo:"sort"`
+	DispatchedAt time.Time `dynamo:"dispatched_at"`
+	TTL          int64     `dynamo:"ttl"`
+}
+
+func sortKey(endpointID string) string {
+	return "webhook##" + endpointID
+}
+
+func deliveryKey(endpointID string) string {
+	return "webhook-delivery##" + endpointID
+}
+
+// Accepts the event type
+func (endpoint Endpoint) Accepts(eventType string) bool {
+	if len(endpoint.EventTypes) == 0 {
+		return true
+	}
+
+	for _, pattern := range endpoint.EventTypes {
+		if event.MatchType(pattern, eventType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// -- Signature --
+
+// Sign the body with the timestamp, the signature is "v1=" and hex of HMAC-SHA256(secret, timestamp + "." + body)
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify the headers of a delivery, for the receivers
+// Deliveries older than tolerance are rejected to prevent replays
+func Verify(secret string, timestampHeader string, signatureHeader string, body []byte, tolerance time.Duration, now time.Time) error {
+	timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if diff := now.Sub(time.Unix(timestamp, 0)); diff > tolerance || diff < -tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signatureHeader)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// -- Webhook Repository --
+
+type Repository struct {
+	table dynamo.Table
+}
+
+func NewRepository(table dynamo.Table) Repository {
+	return Repository{
+		table: table,
+	}
+}
+
+// Create an endpoint, the secret is in the returned endpoint
+func (repo Repository) Create(clientID string, url string, eventTypes []string) (Endpoint, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Endpoint{}, err
+	}
+
+	endpointID := uuid.NewV4().String()
+	endpoint := Endpoint{
+		ID:         "webhook",
+		Sort:       sortKey(endpointID),
+		EndpointID: endpointID,
+		ClientID:   clientID,
+		URL:        url,
+		Secret:     "whsec_" + base64.RawURLEncoding.EncodeToString(buf),
+		EventTypes: eventTypes,
+		Status:     StatusActive,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if err := repo.table.Put(endpoint).If("attribute_not_exists(id)").Run(); err != nil {
+		return Endpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+// List the endpoints, of every client if clientID is empty
+func (repo Repository) List(clientID string) ([]Endpoint, error) {
+	query := repo.table.
+		Get("id", "webhook").
+		Range("sort", dynamo.BeginsWith, "webhook##")
+	if clientID != "" {
+		query = query.Filter("client_id = ?", clientID)
+	}
+
+	endpoints := []Endpoint{}
+	if err := query.All(&endpoints); err != nil {
+		return nil, err
+	}
+
+	return endpoints, nil
+}
+
+func (repo Repository) Get(endpointID string) (Endpoint, error) {
+	var endpoint Endpoint
+	if err := repo.table.
+		Get("id", "webhook").
+		Range("sort", dynamo.Equal, sortKey(endpointID)).
+		Consistent(true).
+		One(&endpoint); err != nil {
+		if err == dynamo.ErrNotFound {
+			return Endpoint{}, ErrNotFound
+		}
+
+		return Endpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+// Delete the endpoint, the delivery logs expire by TTL
+func (repo Repository) Delete(endpointID string) error {
+	err := repo.table.
+		Delete("id", "webhook").
+		Range("sort", sortKey(endpointID)).
+		If("attribute_exists(id)").
+		Run()
+	if ddb.IsCondCheckFailed(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Enable the disabled endpoint again, with resetting the failures
+func (repo Repository) Enable(endpointID string) error {
+	err := repo.table.
+		Update("id", "webhook").
+		Range("sort", sortKey(endpointID)).
+		Set("status", StatusActive).
+		Set("consecutive_failures", 0).
+		Remove("disabled_at").
+		If("attribute_exists(id)").
+		Run()
+	if ddb.IsCondCheckFailed(err) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// recordResult counts the failures in a row, and disables the endpoint after MaxConsecutiveFailures
+func (repo Repository) recordResult(endpoint Endpoint, succeeded bool) error {
+	if succeeded {
+		if endpoint.ConsecutiveFailures == 0 {
+			return nil
+		}
+
+		return repo.table.
+			Update("id", "webhook").
+			Range("sort", endpoint.Sort).
+			Set("consecutive_failures", 0).
+			If("attribute_exists(id)").
+			Run()
+	}
+
+	var updated Endpoint
+	if err := repo.table.
+		Update("id", "webhook").
+		Range("sort", endpoint.Sort).
+		Add("consecutive_failures", 1).
+		If("attribute_exists(id)").
+		Value(&updated); err != nil {
+		if ddb.IsCondCheckFailed(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if updated.Status == StatusActive && updated.ConsecutiveFailures >= MaxConsecutiveFailures {
+		err := repo.table.
+			Update("id", "webhook").
+			Range("sort", endpoint.Sort).
+			Set("status", StatusDisabled).
+			Set("disabled_at", time.Now().UTC()).
+			If("$ = ?", "status", StatusActive).
+			Run()
+		if ddb.IsCondCheckFailed(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (repo Repository) logDelivery(delivery Delivery) error {
+	now := time.Now().UTC()
+	delivery.DeliveryID = uuid.NewV4().String()
+	delivery.ID = deliveryKey(delivery.EndpointID)
+	delivery.Sort = "delivery##" + now.Format(ddb.SortTimeFormat) + "##" + delivery.DeliveryID
+	delivery.DeliveredAt = now
+	delivery.TTL = now.Add(deliveryLogLifetime).Unix()
+
+	return repo.table.Put(delivery).Run()
+}
+
+// Deliveries of the endpoint, newest first
+func (repo Repository) Deliveries(endpointID string, limit int64) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	if err := repo.table.
+		Get("id", deliveryKey(endpointID)).
+		Range("sort", dynamo.BeginsWith, "delivery##").
+		Order(dynamo.Descending).
+		Limit(limit).
+		All(&deliveries); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func dispatchedKey(eventID string) string {
+	return "event##" + eventID
+}
+
+func (repo Repository) isDispatched(eventID string, endpointID string) (bool, error) {
+	var dispatched Dispatched
+	if err := repo.table.
+		Get("id", dispatchedKey(eventID)).
+		Range("sort", dynamo.Equal, "dispatched##"+endpointID).
+		Consistent(true).
+		One(&dispatched); err != nil {
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (repo Repository) markDispatched(eventID string, endpointID string) error {
+	now := time.Now().UTC()
+
+	return repo.table.Put(Dispatched{
+		ID:           dispatchedKey(eventID),
+		Sort:         "dispatched##" + endpointID,
+		DispatchedAt: now,
+		TTL:          now.Add(dispatchedLifetime).Unix(),
+	}).Run()
+}
+
+// scheduleRetry stores the delivery to be attempted again at the time
+func (repo Repository) scheduleRetry(retry Retry) error {
+	retry.ID = "webhook-retry"
+	retry.Sort = "retry##" + retry.NextAttemptAt.Format(ddb.SortTimeFormat) + "##" + retry.RetryID
+
+	return repo.table.Put(retry).Run()
+}
+
+// dueRetries returns the retries scheduled until now, oldest first
+func (repo Repository) dueRetries(now time.Time) ([]Retry, error) {
+	retries := []Retry{}
+	if err := repo.table.
+		Get("id", "webhook-retry").
+		Range("sort", dynamo.Between, "retry##", "retry##"+now.UTC().Format(ddb.SortTimeFormat)).
+		All(&retries); err != nil {
+		return nil, err
+	}
+
+	return retries, nil
+}
+
+// takeRetry deletes the retry, false if another worker has taken it
+func (repo Repository) takeRetry(retry Retry) (bool, error) {
+	err := repo.table.
+		Delete("id", retry.ID).
+		Range("sort", retry.Sort).
+		If("attribute_exists(id)").
+		Run()
+	if ddb.IsCondCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// -- Dispatcher --
+
+// Dispatcher delivers the events to every active endpoint accepting the type,
+// only if the user of the event has consented to the client of the endpoint
+// A failed delivery is retried by RetryDue with exponential backoff, Backoff << (attempt - 1) after the attempt
+type Dispatcher struct {
+	repo        Repository
+	consents    oauth.Repository
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+func NewDispatcher(table dynamo.Table) Dispatcher {
+	return Dispatcher{
+		repo:        NewRepository(table),
+		consents:    oauth.NewRepository(table),
+		Client:      &http.Client{Timeout: 3 * time.Second},
+		MaxAttempts: 6,
+		Backoff:     time.Minute,
+	}
+}
+
+// Dispatch the event, a failed delivery is logged and scheduled to be retried instead of failing the dispatch
+// Each endpoint is marked after the attempt, so dispatching the event again only attempts the rest of the endpoints
+func (dispatcher Dispatcher) Dispatch(cloudEvent event.CloudEvent) error {
+	endpoints, err := dispatcher.repo.List("")
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(cloudEvent)
+	if err != nil {
+		return err
+	}
+
+	// the consent of the user is read once for each client
+	consented := map[string]bool{}
+	for _, endpoint := range endpoints {
+		if endpoint.Status != StatusActive || !endpoint.Accepts(cloudEvent.EventType()) {
+			continue
+		}
+
+		ok, found := consented[endpoint.ClientID]
+		if !found {
+			ok, err = dispatcher.hasConsent(cloudEvent.Subject, endpoint.ClientID)
+			if err != nil {
+				return err
+			}
+
+			consented[endpoint.ClientID] = ok
+		}
+		if !ok {
+			continue
+		}
+
+		dispatched, err := dispatcher.repo.isDispatched(cloudEvent.ID, endpoint.EndpointID)
+		if err != nil {
+			return err
+		}
+		if dispatched {
+			continue
+		}
+
+		if err := dispatcher.attempt(endpoint, cloudEvent, body, 1); err != nil {
+			return err
+		}
+
+		// The event was attempted, failing to mark it only risks a duplicate on the retry
+		if err := dispatcher.repo.markDispatched(cloudEvent.ID, endpoint.EndpointID); err != nil {
+			fmt.Printf("Mark %s dispatched to %s failed: %+v\n", cloudEvent.ID, endpoint.EndpointID, err)
+		}
+	}
+
+	return nil
+}
+
+// hasConsent reports whether the user has approved the client, the events without the user are not delivered
+func (dispatcher Dispatcher) hasConsent(userID string, clientID string) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+
+	consent, err := dispatcher.consents.GetConsent(userID, clientID)
+	if err != nil {
+		return false, err
+	}
+
+	return consent.ClientID != "", nil
+}
+
+// RetryDue attempts the deliveries scheduled until now
+// Deliveries to deleted or disabled endpoints, or for the users who no longer consent, are dropped
+func (dispatcher Dispatcher) RetryDue(now time.Time) (int, error) {
+	retries, err := dispatcher.repo.dueRetries(now)
+	if err != nil {
+		return 0, err
+	}
+
+	attempted := 0
+	for _, retry := range retries {
+		taken, err := dispatcher.repo.takeRetry(retry)
+		if err != nil {
+			return attempted, err
+		}
+		if !taken {
+			continue
+		}
+
+		endpoint, err := dispatcher.repo.Get(retry.EndpointID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return attempted, err
+		}
+		if endpoint.Status != StatusActive {
+			continue
+		}
+
+		var cloudEvent event.CloudEvent
+		if err := json.Unmarshal([]byte(retry.Event), &cloudEvent); err != nil {
+			return attempted, err
+		}
+
+		ok, err := dispatcher.hasConsent(cloudEvent.Subject, endpoint.ClientID)
+		if err != nil {
+			return attempted, err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := dispatcher.attempt(endpoint, cloudEvent, []byte(retry.Event), retry.Attempts+1); err != nil {
+			return attempted, err
+		}
+		attempted++
+	}
+
+	return attempted, nil
+}
+
+// attempt posts the event and logs the result, the failure is retried unless it is the last attempt or a client error
+func (dispatcher Dispatcher) attempt(endpoint Endpoint, cloudEvent event.CloudEvent, body []byte, attempt int) error {
+	delivery := Delivery{
+		EndpointID: endpoint.EndpointID,
+		EventID:    cloudEvent.ID,
+		EventType:  cloudEvent.EventType(),
+		Attempt:    attempt,
+	}
+
+	retryable := true
+	statusCode, err := dispatcher.post(endpoint, cloudEvent, body)
+	delivery.StatusCode = statusCode
+	if err != nil {
+		delivery.Error = err.Error()
+	} else if statusCode >= 200 && statusCode < 300 {
+		delivery.Succeeded = true
+	} else {
+		delivery.Error = fmt.Sprintf("Responded %d", statusCode)
+		retryable = statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+	}
+
+	if !delivery.Succeeded && retryable && attempt < dispatcher.MaxAttempts {
+		delivery.NextAttemptAt = time.Now().UTC().Add(dispatcher.Backoff << uint(attempt-1))
+		if err := dispatcher.repo.scheduleRetry(Retry{
+			RetryID:       uuid.NewV4().String(),
+			EndpointID:    endpoint.EndpointID,
+			Event:         string(body),
+			Attempts:      attempt,
+			NextAttemptAt: delivery.NextAttemptAt,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := dispatcher.repo.logDelivery(delivery); err != nil {
+		return err
+	}
+
+	// Only the final result counts for disabling the endpoint
+	if delivery.Succeeded || delivery.NextAttemptAt.IsZero() {
+		return dispatcher.repo.recordResult(endpoint, delivery.Succeeded)
+	}
+
+	return nil
+}
+
+func (dispatcher Dispatcher) post(endpoint Endpoint, cloudEvent event.CloudEvent, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	// The timestamp is signed with the body, the receivers reject old deliveries
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	req.Header.Set(HeaderEventID, cloudEvent.ID)
+	req.Header.Set(HeaderEventType, cloudEvent.EventType())
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, body))
+
+	resp, err := dispatcher.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,311 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/portals-me/account/lib/event"
+	"github.com/portals-me/account/lib/oauth"
+	"github.com/portals-me/account/lib/user"
+)
+
+type fakeItem map[string]*dynamodb.AttributeValue
+
+// fakeDynamoDB is the account table in memory, keyed by id and sort with the auth index
+// Only the requests made by the repositories are supported, filters and projections are ignored
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	items map[string]fakeItem
+	// failGet fails the next GetItem of the key, for the tests of the retried dispatch
+	failGet string
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		items: map[string]fakeItem{},
+	}
+}
+
+func keyOf(item fakeItem) string {
+	return aws.StringValue(item["id"].S) + "\x00" + aws.StringValue(item["sort"].S)
+}
+
+func condCheckFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+// checkCondition supports attribute_exists and attribute_not_exists of the key
+func checkCondition(condition *string, exists bool) error {
+	switch {
+	case condition == nil:
+		return nil
+	case strings.Contains(*condition, "attribute_not_exists") && exists:
+		return condCheckFailed()
+	case strings.Contains(*condition, "attribute_exists") && !strings.Contains(*condition, "attribute_not_exists") && !exists:
+		return condCheckFailed()
+	}
+
+	return nil
+}
+
+func (db *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, options ...request.Option) (*dynamodb.PutItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	key := keyOf(input.Item)
+	if err := checkCondition(input.ConditionExpression, db.items[key] != nil); err != nil {
+		return nil, err
+	}
+
+	db.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (db *fakeDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, options ...request.Option) (*dynamodb.GetItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	key := keyOf(input.Key)
+	if key == db.failGet {
+		db.failGet = ""
+		return nil, awserr.New(dynamodb.ErrCodeInternalServerError, "Internal server error", nil)
+	}
+
+	return &dynamodb.GetItemOutput{Item: db.items[key]}, nil
+}
+
+func (db *fakeDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, options ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	key := keyOf(input.Key)
+	if err := checkCondition(input.ConditionExpression, db.items[key] != nil); err != nil {
+		return nil, err
+	}
+
+	delete(db.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+var setClause = regexp.MustCompile(`^SET (.*)$`)
+
+// UpdateItemWithContext supports SET of the attributes
+func (db *fakeDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, options ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	key := keyOf(input.Key)
+	item := db.items[key]
+	if err := checkCondition(input.ConditionExpression, item != nil); err != nil {
+		return nil, err
+	}
+
+	match := setClause.FindStringSubmatch(aws.StringValue(input.UpdateExpression))
+	if match == nil {
+		return nil, awserr.New("ValidationException", "Unsupported update: "+aws.StringValue(input.UpdateExpression), nil)
+	}
+
+	if item == nil {
+		item = fakeItem{"id": input.Key["id"], "sort": input.Key["sort"]}
+	}
+	for _, assignment := range strings.Split(match[1], ", ") {
+		parts := strings.SplitN(assignment, " = ", 2)
+		name := parts[0]
+		if alias, ok := input.ExpressionAttributeNames[name]; ok {
+			name = aws.StringValue(alias)
+		}
+		item[name] = input.ExpressionAttributeValues[parts[1]]
+	}
+	db.items[key] = item
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func matchCondition(value *dynamodb.AttributeValue, condition *dynamodb.Condition) bool {
+	if value == nil || value.S == nil {
+		return false
+	}
+
+	actual := *value.S
+	values := condition.AttributeValueList
+	switch aws.StringValue(condition.ComparisonOperator) {
+	case "EQ":
+		return actual == aws.StringValue(values[0].S)
+	case "BEGINS_WITH":
+		return strings.HasPrefix(actual, aws.StringValue(values[0].S))
+	case "BETWEEN":
+		return aws.StringValue(values[0].S) <= actual && actual <= aws.StringValue(values[1].S)
+	}
+
+	return false
+}
+
+// QueryWithContext supports the key conditions on the table and the auth index
+func (db *fakeDynamoDB) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, options ...request.Option) (*dynamodb.QueryOutput, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	rangeKey := "sort"
+	if aws.StringValue(input.IndexName) == "auth" {
+		rangeKey = "id"
+	}
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range db.items {
+		matched := true
+		for name, condition := range input.KeyConditions {
+			if !matchCondition(item[name], condition) {
+				matched = false
+			}
+		}
+		if matched {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		less := aws.StringValue(items[i][rangeKey].S) < aws.StringValue(items[j][rangeKey].S)
+		if input.ScanIndexForward != nil && !*input.ScanIndexForward {
+			return !less
+		}
+
+		return less
+	})
+
+	return &dynamodb.QueryOutput{
+		Items: items,
+		Count: aws.Int64(int64(len(items))),
+	}, nil
+}
+
+// receiver counts the deliveries of the events by the type
+type receiver struct {
+	mutex      sync.Mutex
+	deliveries map[string]int
+}
+
+func (receiver *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.deliveries[r.Header.Get(HeaderEventType)]++
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newReceiver() (*receiver, *httptest.Server) {
+	receiver := &receiver{deliveries: map[string]int{}}
+	return receiver, httptest.NewServer(receiver)
+}
+
+func TestDispatchUserDeleted(t *testing.T) {
+	table := dynamo.NewFromIface(newFakeDynamoDB()).Table("accounts")
+	repo := NewRepository(table)
+
+	consented, consentedServer := newReceiver()
+	defer consentedServer.Close()
+	if _, err := repo.Create("consented-client", consentedServer.URL, []string{"user.*"}); err != nil {
+		t.Fatal(err)
+	}
+	other, otherServer := newReceiver()
+	defer otherServer.Close()
+	if _, err := repo.Create("other-client", otherServer.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	userInfo := user.UserInfo{ID: "user-1", Name: "alice", DisplayName: "Alice", Email: "alice@example.com"}
+	if err := table.Put(userInfo.ToDDB()).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := oauth.NewRepository(table).GrantConsent(userInfo.ID, "consented-client", []string{"openid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := user.NewRepository(table).Delete(userInfo.ID); err != nil {
+		t.Fatal(err)
+	}
+	var detail user.UserInfo
+	if err := user.NewRepository(table).Get(userInfo.ID, &detail); err != dynamo.ErrNotFound {
+		t.Fatalf("The user is not deleted: %+v", err)
+	}
+
+	deleted, err := event.New("1-1", event.UserDeleted, userInfo.ID, time.Now(), event.UserDeletedData{
+		User: event.User{ID: userInfo.ID, Name: userInfo.Name, Email: userInfo.Email},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewDispatcher(table).Dispatch(deleted.CloudEvent()); err != nil {
+		t.Fatalf("Dispatch failed: %+v", err)
+	}
+
+	if count := consented.deliveries["user.deleted"]; count != 1 {
+		t.Errorf("user.deleted is delivered %d times to the consented client", count)
+	}
+	if len(other.deliveries) != 0 {
+		t.Errorf("The events are delivered to the client without the consent: %+v", other.deliveries)
+	}
+}
+
+func TestDispatchAgain(t *testing.T) {
+	db := newFakeDynamoDB()
+	table := dynamo.NewFromIface(db).Table("accounts")
+	repo := NewRepository(table)
+
+	receivers := map[string]*receiver{}
+	for _, clientID := range []string{"client-1", "client-2"} {
+		receiver, server := newReceiver()
+		defer server.Close()
+		if _, err := repo.Create(clientID, server.URL, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := oauth.NewRepository(table).GrantConsent("user-1", clientID, []string{"openid"}); err != nil {
+			t.Fatal(err)
+		}
+
+		receivers[clientID] = receiver
+	}
+
+	endpoints, err := repo.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := endpoints[0], endpoints[1]
+
+	renamed, err := event.New("1-1", event.UserRenamed, "user-1", time.Now(), event.UserRenamedData{
+		OldName: "alice",
+		NewName: "alice2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dispatch fails at the second endpoint, after the first one is delivered
+	db.failGet = "user-1\x00consent##" + second.ClientID
+	if err := NewDispatcher(table).Dispatch(renamed.CloudEvent()); err == nil {
+		t.Fatal("Dispatch should fail by the consent check")
+	}
+	if err := NewDispatcher(table).Dispatch(renamed.CloudEvent()); err != nil {
+		t.Fatalf("Dispatch failed: %+v", err)
+	}
+
+	if count := receivers[first.ClientID].deliveries["user.renamed"]; count != 1 {
+		t.Errorf("user.renamed is delivered %d times to the first endpoint", count)
+	}
+	if count := receivers[second.ClientID].deliveries["user.renamed"]; count != 1 {
+		t.Errorf("user.renamed is delivered %d times to the second endpoint", count)
+	}
+}
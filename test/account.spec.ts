@@ -2,6 +2,8 @@ import axios from "axios";
 import AWS from "aws-sdk";
 const bcrypt = require("bcrypt");
 const uuid = require("uuid/v4");
+const querystring = require("querystring");
+const crypto = require("crypto");
 const genName = () => uuid().replace(/\-/g, "_");
 
 AWS.config.update({
@@ -32,6 +34,14 @@ const guestUser = {
   display_name: "guest"
 };
 
+const passwordUser = {
+  id: uuid(),
+  name: `password_${genName()}`,
+  password: uuid(),
+  picture: `${env.domain}/avatar/password`,
+  display_name: "password"
+};
+
 const createUser = async (user: {
   id: string;
   name: string;
@@ -41,7 +51,8 @@ const createUser = async (user: {
 }) => {
   await Dynamo.put({
     Item: Object.assign(user, {
-      sort: "detail"
+      sort: "detail",
+      name_lower: user.name.toLowerCase()
     }),
     TableName: env.tableName
   }).promise();
@@ -77,11 +88,13 @@ const deleteUser = async (user: { id: string; name: string }) => {
 beforeAll(async () => {
   await createUser(user);
   await createUser(guestUser);
+  await createUser(passwordUser);
 });
 
 afterAll(async () => {
   await deleteUser(user);
   await deleteUser(guestUser);
+  await deleteUser(passwordUser);
 });
 
 describe("Account", () => {
@@ -121,6 +134,144 @@ describe("Account", () => {
     );
 
     expect(result.status).toEqual(204);
+    user.name = newName;
+  });
+
+  it("should signin with the new user_name", async () => {
+    const result = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: user.name,
+        password: user.password
+      }
+    });
+    expect(result.data).toBeTruthy();
+  });
+
+  it("should reject the update with a stale If-Match", async () => {
+    const first = await axios.put(
+      `${env.restApi}/self`,
+      {
+        display_name: "first"
+      },
+      {
+        headers: {
+          Authorization: userJWT
+        }
+      }
+    );
+    expect(first.headers.etag).toBeTruthy();
+
+    const second = await axios.put(
+      `${env.restApi}/self`,
+      {
+        display_name: "second"
+      },
+      {
+        headers: {
+          Authorization: userJWT,
+          "If-Match": first.headers.etag
+        }
+      }
+    );
+    expect(second.status).toEqual(204);
+
+    const stale = await axios
+      .put(
+        `${env.restApi}/self`,
+        {
+          display_name: "stale"
+        },
+        {
+          headers: {
+            Authorization: userJWT,
+            "If-Match": first.headers.etag
+          }
+        }
+      )
+      .catch(err => err.response);
+    expect(stale.status).toEqual(412);
+    expect(stale.headers.etag).toEqual(second.headers.etag);
+  });
+
+  it("should clear the email with a merge patch", async () => {
+    const result = await axios.patch(
+      `${env.restApi}/self`,
+      {
+        email: null
+      },
+      {
+        headers: {
+          Authorization: userJWT,
+          "Content-Type": "application/merge-patch+json"
+        }
+      }
+    );
+
+    expect(result.status).toEqual(204);
+  });
+
+  it("should reject a merge patch of read-only or unknown fields", async () => {
+    const result = await axios
+      .patch(
+        `${env.restApi}/self`,
+        {
+          id: "x",
+          nickname: "x"
+        },
+        {
+          headers: {
+            Authorization: userJWT,
+            "Content-Type": "application/merge-patch+json"
+          }
+        }
+      )
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(400);
+    expect(result.data.errors).toEqual([
+      expect.objectContaining({ field: "id", code: "read_only" }),
+      expect.objectContaining({ field: "nickname", code: "unknown_field" })
+    ]);
+  });
+
+  it("should reject a merge patch which is not an object", async () => {
+    const result = await axios
+      .patch(`${env.restApi}/self`, "null", {
+        headers: {
+          Authorization: userJWT,
+          "Content-Type": "application/merge-patch+json"
+        }
+      })
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(400);
+  });
+
+  it("should keep the version for a merge patch without changes", async () => {
+    const first = await axios.patch(
+      `${env.restApi}/self`,
+      {},
+      {
+        headers: {
+          Authorization: userJWT,
+          "Content-Type": "application/merge-patch+json"
+        }
+      }
+    );
+    const second = await axios.patch(
+      `${env.restApi}/self`,
+      {},
+      {
+        headers: {
+          Authorization: userJWT,
+          "Content-Type": "application/merge-patch+json"
+        }
+      }
+    );
+
+    expect(second.status).toEqual(204);
+    expect(second.headers.etag).toEqual(first.headers.etag);
   });
 
   it("should not update user_name less than 3 characters", async () => {
@@ -189,6 +340,7 @@ describe("Account", () => {
     );
 
     expect(result.status).toEqual(204);
+    user.name = newName;
   });
 
   it("should not update the profile with invalid url", async () => {
@@ -209,6 +361,18 @@ describe("Account", () => {
     ).rejects.toThrow("400");
   });
 
+  it("should list the activities", async () => {
+    const result = await axios.get(`${env.restApi}/self/activity`, {
+      headers: {
+        Authorization: userJWT
+      }
+    });
+
+    const events = result.data.activities.map((entry: any) => entry.event);
+    expect(events).toContain("signin_succeeded");
+    expect(events).toContain("name_changed");
+  });
+
   it("should not update the profile using wrong JWT", async () => {
     const newName = genName();
 
@@ -227,3 +391,739 @@ describe("Account", () => {
     ).rejects.toThrow("401");
   });
 });
+
+describe("Sessions", () => {
+  let firstJWT: string;
+  let secondJWT: string;
+
+  it("should create a session for each signin", async () => {
+    for (const label of ["first", "second"]) {
+      const result = await axios.post(`${env.restApi}/signin`, {
+        auth_type: "password",
+        device_label: label,
+        data: {
+          user_name: guestUser.name,
+          password: guestUser.password
+        }
+      });
+
+      if (label === "first") {
+        firstJWT = result.data;
+      } else {
+        secondJWT = result.data;
+      }
+    }
+
+    const result = await axios.get(`${env.restApi}/self/sessions`, {
+      headers: {
+        Authorization: firstJWT
+      }
+    });
+    const labels = result.data.map((session: any) => session.device_label);
+    expect(labels).toContain("first");
+    expect(labels).toContain("second");
+  });
+
+  it("should revoke the other session", async () => {
+    const sessions = await axios.get(`${env.restApi}/self/sessions`, {
+      headers: {
+        Authorization: firstJWT
+      }
+    });
+    const second = sessions.data.find(
+      (session: any) => session.device_label === "second"
+    );
+    expect(second.current).toBeFalsy();
+
+    const result = await axios.delete(
+      `${env.restApi}/self/sessions/${second.id}`,
+      {
+        headers: {
+          Authorization: firstJWT
+        }
+      }
+    );
+    expect(result.status).toEqual(204);
+
+    await expect(
+      axios.get(`${env.restApi}/self/sessions`, {
+        headers: {
+          Authorization: secondJWT
+        }
+      })
+    ).rejects.toThrow("401");
+  });
+});
+
+describe("Personal access tokens", () => {
+  let jwt: string;
+  let created: any;
+
+  beforeAll(async () => {
+    const result = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+    jwt = result.data;
+  });
+
+  it("should create a token and use it in place of JWT", async () => {
+    const result = await axios.post(
+      `${env.restApi}/self/tokens`,
+      {
+        name: "ci",
+        scopes: ["activity:read"],
+        expires_in_days: 7
+      },
+      {
+        headers: {
+          Authorization: jwt
+        }
+      }
+    );
+    expect(result.status).toEqual(201);
+    expect(result.data.token).toMatch(/^pat_/);
+    created = result.data;
+
+    const activity = await axios.get(`${env.restApi}/self/activity`, {
+      headers: {
+        Authorization: `Bearer ${created.token}`
+      }
+    });
+    expect(activity.status).toEqual(200);
+
+    const tokens = await axios.get(`${env.restApi}/self/tokens`, {
+      headers: {
+        Authorization: jwt
+      }
+    });
+    const token = tokens.data.find((token: any) => token.id === created.id);
+    expect(token.name).toEqual("ci");
+    expect(token.token).toBeUndefined();
+  });
+
+  it("should reject an unknown scope", async () => {
+    const result = await axios
+      .post(
+        `${env.restApi}/self/tokens`,
+        {
+          name: "ci",
+          scopes: ["unknown:scope"]
+        },
+        {
+          headers: {
+            Authorization: jwt
+          }
+        }
+      )
+      .catch(err => err.response);
+    expect(result.status).toEqual(400);
+  });
+
+  it("should not create a token with a personal access token", async () => {
+    const withWrite = await axios.post(
+      `${env.restApi}/self/tokens`,
+      {
+        name: "tokens",
+        scopes: ["tokens:write"]
+      },
+      {
+        headers: {
+          Authorization: jwt
+        }
+      }
+    );
+
+    const result = await axios
+      .post(
+        `${env.restApi}/self/tokens`,
+        {
+          name: "ci",
+          scopes: ["tokens:write"]
+        },
+        {
+          headers: {
+            Authorization: `Bearer ${withWrite.data.token}`
+          }
+        }
+      )
+      .catch(err => err.response);
+    expect(result.status).toEqual(403);
+  });
+
+  it("should deny the routes out of the scopes", async () => {
+    await expect(
+      axios.get(`${env.restApi}/self/sessions`, {
+        headers: {
+          Authorization: `Bearer ${created.token}`
+        }
+      })
+    ).rejects.toThrow("403");
+  });
+
+  it("should not create a token with a scope the user does not have", async () => {
+    const result = await axios
+      .post(
+        `${env.restApi}/self/tokens`,
+        {
+          name: "admin",
+          scopes: ["users:write"]
+        },
+        {
+          headers: {
+            Authorization: jwt
+          }
+        }
+      )
+      .catch(err => err.response);
+    expect(result.status).toEqual(403);
+  });
+
+  it("should reject the revoked token", async () => {
+    const result = await axios.delete(
+      `${env.restApi}/self/tokens/${created.id}`,
+      {
+        headers: {
+          Authorization: jwt
+        }
+      }
+    );
+    expect(result.status).toEqual(204);
+
+    await expect(
+      axios.get(`${env.restApi}/self/activity`, {
+        headers: {
+          Authorization: `Bearer ${created.token}`
+        }
+      })
+    ).rejects.toThrow("401");
+  });
+});
+
+describe("Admin", () => {
+  const adminUser = {
+    id: uuid(),
+    name: `admin_${genName()}`,
+    password: uuid(),
+    picture: `${env.domain}/avatar/admin`,
+    display_name: "admin"
+  };
+
+  beforeAll(async () => {
+    await createUser(adminUser);
+    await Dynamo.update({
+      Key: {
+        id: adminUser.id,
+        sort: "detail"
+      },
+      UpdateExpression: "SET #role = :role",
+      ExpressionAttributeNames: {
+        "#role": "role"
+      },
+      ExpressionAttributeValues: {
+        ":role": "admin"
+      },
+      TableName: env.tableName
+    }).promise();
+  });
+
+  afterAll(async () => {
+    await deleteUser(adminUser);
+  });
+
+  it("should search users by the name case-insensitively", async () => {
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: adminUser.name,
+        password: adminUser.password
+      }
+    });
+
+    const result = await axios.get(`${env.restApi}/admin/users`, {
+      params: {
+        name: guestUser.name.toUpperCase()
+      },
+      headers: {
+        Authorization: signin.data
+      }
+    });
+    expect(result.data.map((found: any) => found.id)).toEqual([guestUser.id]);
+  });
+
+  it("should deny the admin API to users", async () => {
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+
+    await expect(
+      axios.get(`${env.restApi}/admin/users`, {
+        params: {
+          name: guestUser.name
+        },
+        headers: {
+          Authorization: signin.data
+        }
+      })
+    ).rejects.toThrow("403");
+  });
+
+  it("should deny registering webhooks to users", async () => {
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+
+    await expect(
+      axios.post(
+        `${env.restApi}/admin/webhooks`,
+        {
+          client_id: "client",
+          url: "https://example.com/webhook"
+        },
+        {
+          headers: {
+            Authorization: signin.data
+          }
+        }
+      )
+    ).rejects.toThrow("403");
+  });
+
+  it("should deny unlocking users to users", async () => {
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+
+    await expect(
+      axios.post(
+        `${env.restApi}/admin/users/${guestUser.id}/unlock`,
+        {},
+        {
+          headers: {
+            Authorization: signin.data
+          }
+        }
+      )
+    ).rejects.toThrow("403");
+  });
+});
+
+describe("OAuth", () => {
+  it("should publish the OpenID Connect discovery", async () => {
+    const discovery = await axios.get(
+      `${env.restApi}/.well-known/openid-configuration`
+    );
+    expect(discovery.data.token_endpoint).toEqual(
+      `${discovery.data.issuer}/oauth/token`
+    );
+    expect(discovery.data.code_challenge_methods_supported).toEqual(["S256"]);
+
+    const jwks = await axios.get(discovery.data.jwks_uri);
+    expect(jwks.data.keys[0].alg).toEqual("ES256");
+
+    // kid is the RFC 7638 thumbprint of the key
+    const key = jwks.data.keys[0];
+    const thumbprint = crypto
+      .createHash("sha256")
+      .update(
+        `{"crv":"${key.crv}","kty":"${key.kty}","x":"${key.x}","y":"${key.y}"}`
+      )
+      .digest("base64")
+      .replace(/\+/g, "-")
+      .replace(/\//g, "_")
+      .replace(/=+$/, "");
+    expect(key.kid).toEqual(thumbprint);
+
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+    const header = JSON.parse(
+      Buffer.from(signin.data.split(".")[0], "base64").toString()
+    );
+    expect(header.kid).toEqual(key.kid);
+  });
+
+  it("should not authorize an unknown client", async () => {
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+
+    const result = await axios
+      .get(`${env.restApi}/oauth/authorize`, {
+        params: {
+          response_type: "code",
+          client_id: uuid(),
+          redirect_uri: "https://example.com/callback",
+          scope: "openid"
+        },
+        headers: {
+          Authorization: signin.data
+        }
+      })
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(400);
+    expect(result.data.redirect_to).toBeUndefined();
+  });
+
+  it("should reject an invalid authorization code", async () => {
+    const result = await axios
+      .post(
+        `${env.restApi}/oauth/token`,
+        querystring.stringify({
+          grant_type: "authorization_code",
+          code: "invalid",
+          client_id: uuid(),
+          redirect_uri: "https://example.com/callback",
+          code_verifier: uuid() + uuid()
+        }),
+        {
+          headers: {
+            "Content-Type": "application/x-www-form-urlencoded"
+          }
+        }
+      )
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(400);
+    expect(result.data.error).toEqual("invalid_grant");
+  });
+
+  it("should not issue a service token to an unknown client", async () => {
+    const result = await axios
+      .post(
+        `${env.restApi}/oauth/token`,
+        querystring.stringify({
+          grant_type: "client_credentials"
+        }),
+        {
+          auth: {
+            username: uuid(),
+            password: "cs_invalid"
+          },
+          headers: {
+            "Content-Type": "application/x-www-form-urlencoded"
+          }
+        }
+      )
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(401);
+    expect(result.data.error).toEqual("invalid_client");
+  });
+
+  it("should not introspect for an unknown client", async () => {
+    const signin = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: guestUser.name,
+        password: guestUser.password
+      }
+    });
+
+    const result = await axios
+      .post(
+        `${env.restApi}/introspect`,
+        querystring.stringify({
+          token: signin.data,
+          client_id: uuid()
+        }),
+        {
+          headers: {
+            "Content-Type": "application/x-www-form-urlencoded"
+          }
+        }
+      )
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(401);
+    expect(result.data.error).toEqual("invalid_client");
+  });
+});
+
+describe("SCIM", () => {
+  it("should not provision without the token of a tenant", async () => {
+    const result = await axios
+      .get(`${env.restApi}/scim/v2/Users`, {
+        headers: {
+          Authorization: `Bearer scim_${uuid()}`
+        }
+      })
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(401);
+    expect(result.data.status).toEqual("401");
+  });
+
+  it("should describe the service provider", async () => {
+    const result = await axios.get(
+      `${env.restApi}/scim/v2/ServiceProviderConfig`
+    );
+
+    expect(result.data.patch.supported).toBe(true);
+    expect(result.data.filter.maxResults).toEqual(100);
+  });
+});
+
+describe("SAML", () => {
+  it("should serve the metadata of the service provider", async () => {
+    const result = await axios.get(`${env.restApi}/saml/metadata`);
+
+    expect(result.data).toContain("EntityDescriptor");
+    expect(result.data).toContain("AssertionConsumerService");
+  });
+
+  it("should not signin with an unsigned response", async () => {
+    const samlResponse = Buffer.from(
+      `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"><saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">https://idp.example.com</saml:Issuer></samlp:Response>`
+    ).toString("base64");
+
+    await expect(
+      axios.post(`${env.restApi}/signin`, {
+        auth_type: "saml",
+        data: {
+          saml_response: samlResponse
+        }
+      })
+    ).rejects.toThrow("400");
+  });
+});
+
+describe("GitHub", () => {
+  it("should not signin with an invalid code", async () => {
+    await expect(
+      axios.post(`${env.restApi}/signin`, {
+        auth_type: "github",
+        data: {
+          code: "invalid-code"
+        }
+      })
+    ).rejects.toThrow("400");
+  });
+});
+
+describe("Signin throttling", () => {
+  const lockedName = `locked_${genName()}`;
+
+  it("should not distinguish unknown user_name from wrong password", async () => {
+    const unknown = await axios
+      .post(`${env.restApi}/signin`, {
+        auth_type: "password",
+        data: {
+          user_name: `unknown_${genName()}`,
+          password: "wrong"
+        }
+      })
+      .catch(err => err.response);
+    const wrong = await axios
+      .post(`${env.restApi}/signin`, {
+        auth_type: "password",
+        data: {
+          user_name: guestUser.name,
+          password: "wrong"
+        }
+      })
+      .catch(err => err.response);
+
+    expect(unknown.status).toEqual(wrong.status);
+    expect(unknown.data).toEqual(wrong.data);
+  });
+
+  it("should lock the user_name after too many failures", async () => {
+    for (let i = 0; i < 6; i++) {
+      await expect(
+        axios.post(`${env.restApi}/signin`, {
+          auth_type: "password",
+          data: {
+            user_name: lockedName,
+            password: "wrong"
+          }
+        })
+      ).rejects.toThrow("400");
+    }
+
+    await expect(
+      axios.post(`${env.restApi}/signin`, {
+        auth_type: "password",
+        data: {
+          user_name: lockedName,
+          password: "wrong"
+        }
+      })
+    ).rejects.toThrow("429");
+  });
+});
+
+describe("Password", () => {
+  let userJWT: string;
+  let personalAccessToken: string;
+  const newPassword = uuid();
+
+  it("should signin with password", async () => {
+    const result = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: passwordUser.name,
+        password: passwordUser.password
+      }
+    });
+    expect(result.data).toBeTruthy();
+
+    userJWT = result.data;
+
+    const created = await axios.post(
+      `${env.restApi}/self/tokens`,
+      {
+        name: "before the change",
+        scopes: ["activity:read"]
+      },
+      {
+        headers: {
+          Authorization: userJWT
+        }
+      }
+    );
+    personalAccessToken = created.data.token;
+  });
+
+  it("should not change the password with wrong current_password", async () => {
+    await expect(
+      axios.post(
+        `${env.restApi}/self/password`,
+        {
+          current_password: "wrong",
+          new_password: newPassword
+        },
+        {
+          headers: {
+            Authorization: userJWT
+          }
+        }
+      )
+    ).rejects.toThrow("403");
+  });
+
+  it("should change the password", async () => {
+    const result = await axios.post(
+      `${env.restApi}/self/password`,
+      {
+        current_password: passwordUser.password,
+        new_password: newPassword
+      },
+      {
+        headers: {
+          Authorization: userJWT
+        }
+      }
+    );
+
+    expect(result.status).toEqual(204);
+  });
+
+  it("should reject the token issued before the password change", async () => {
+    await expect(
+      axios.put(
+        `${env.restApi}/self`,
+        {
+          display_name: "password"
+        },
+        {
+          headers: {
+            Authorization: userJWT
+          }
+        }
+      )
+    ).rejects.toThrow("401");
+  });
+
+  it("should reject the personal access token created before the password change", async () => {
+    await expect(
+      axios.get(`${env.restApi}/self/activity`, {
+        headers: {
+          Authorization: `Bearer ${personalAccessToken}`
+        }
+      })
+    ).rejects.toThrow("401");
+  });
+
+  it("should signin with the new password", async () => {
+    const result = await axios.post(`${env.restApi}/signin`, {
+      auth_type: "password",
+      data: {
+        user_name: passwordUser.name,
+        password: newPassword
+      }
+    });
+    expect(result.data).toBeTruthy();
+
+    // The token issued right after the change, possibly in the same second, is accepted
+    const sessions = await axios.get(`${env.restApi}/self/sessions`, {
+      headers: {
+        Authorization: result.data
+      }
+    });
+    expect(sessions.status).toEqual(200);
+  });
+
+  it("should not signup with a weak password", async () => {
+    const name = genName();
+    const result = await axios
+      .post(`${env.restApi}/signup`, {
+        auth_type: "password",
+        data: {
+          user_name: name,
+          password: name
+        },
+        user: {
+          name: name,
+          picture: `${env.domain}/avatar/weak`,
+          display_name: "weak"
+        }
+      })
+      .catch(err => err.response);
+
+    expect(result.status).toEqual(400);
+    expect(result.data.reasons.map((reason: any) => reason.code)).toContain(
+      "contains_user_name"
+    );
+  });
+
+  it("should always accept the password reset request", async () => {
+    const result = await axios.post(`${env.restApi}/password/reset`, {
+      user_name: `unknown_${genName()}`
+    });
+    expect(result.status).toEqual(202);
+  });
+
+  it("should not reset the password with an invalid token", async () => {
+    await expect(
+      axios.post(`${env.restApi}/password/reset/confirm`, {
+        token: "invalid",
+        new_password: uuid()
+      })
+    ).rejects.toThrow("400");
+  });
+});